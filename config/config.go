@@ -2,17 +2,52 @@ package config
 
 import (
 	"encoding/json"
+	"fmt"
 	"log"
 	"os"
+	"path/filepath"
+	"regexp"
 )
 
 type Config struct {
 	HttpServerPort int
 	GoFiledbRoot   string
+	// Name of the workspace (team) that this server is for. Every workspace keeps all of its data in its own folder inside GoFiledbRoot,
+	// so a server can't see the users or conversations of another workspace. Empty means the default workspace.
+	Workspace string
+	// User ids of the users who are allowed to use the admin endpoints of the default workspace
+	AdminUserIds []string
+	// Settings of the named workspaces (see Admins), by workspace name
+	Workspaces map[string]WorkspaceConfig
+	// Global retention policy, applied to conversations that don't have their own. 0 means no limit.
+	RetentionDays        int
+	RetentionMaxMessages int
+	// Limits of the in-memory cache of conversations: how many conversations, and roughly how many bytes. A size of 0 turns the cache off.
+	ConversationCacheSize     int
+	ConversationCacheMaxBytes int
+	// If true, the first messages to a user who isn't a buddy yet are held in a contact request, until the user accepts it
+	RequireContactRequests bool
+	// How many messages can be pinned in a conversation. 0 uses the default (50).
+	MaxPinnedMessages int
+}
+
+// Settings that only apply to one workspace
+type WorkspaceConfig struct {
+	// User ids of the users who are allowed to use the admin endpoints of the workspace
+	AdminUserIds []string
 }
 
 var config Config
 
+// Workspace names are 2 to 50 characters long: lowercase letters, digits, '-' and '_', starting with a letter or a digit
+var workspaceNameRegex *regexp.Regexp = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{1,49}$`)
+
+// Name of the folder (inside the GoFiledbRoot) where the data of each workspace is stored
+const workspacesDirName string = "workspaces"
+
+// Name of the workspace that a server is for, when it isn't given one
+const defaultWorkspaceName string = "default"
+
 func InitConfig(configFilePath string) {
 
 	file, err := os.Open(configFilePath)
@@ -27,8 +62,66 @@ func InitConfig(configFilePath string) {
 	if err != nil {
 		log.Fatal(err)
 	}
+
+	err = validateWorkspace(config.Workspace)
+	if err != nil {
+		log.Fatal(err)
+	}
+}
+
+// Sets the workspace that this server is for, overriding the one in the settings file. It should be called before the database client is started.
+func SetWorkspace(name string) error {
+	err := validateWorkspace(name)
+	if err != nil {
+		return err
+	}
+	config.Workspace = name
+	return nil
+}
+
+// Sets the port that the HTTP server of this server listens on, overriding the one in the settings file, so several servers (e.g. one per workspace) can run side by side
+func SetHttpServerPort(port int) error {
+	if port < 1 || port > 65535 {
+		return fmt.Errorf("Port validation failed: it should be between 1 and 65535, got %d", port)
+	}
+	config.HttpServerPort = port
+	return nil
 }
 
 func GetConfig() *Config {
 	return &config
 }
+
+// Given a Config, get the folder where all the data of its workspace is stored. The default workspace has a folder of its own too, next to the others.
+func (c *Config) StorageRoot() string {
+	return filepath.Join(c.GoFiledbRoot, workspacesDirName, c.workspaceName())
+}
+
+// Given a Config, get the user ids of the admins of its workspace. The admins of the default workspace are AdminUserIds, unless it's listed in Workspaces.
+// The admins of one workspace are never admins of another.
+func (c *Config) Admins() []string {
+	name := c.workspaceName()
+	if workspace, exists := c.Workspaces[name]; exists {
+		return workspace.AdminUserIds
+	}
+	if name == defaultWorkspaceName {
+		return c.AdminUserIds
+	}
+	return nil
+}
+
+// Given a Config, get the name of its workspace
+func (c *Config) workspaceName() string {
+	if c.Workspace == "" {
+		return defaultWorkspaceName
+	}
+	return c.Workspace
+}
+
+// Given a workspace name, it ensures that the name is valid. The name becomes a folder name, so it can't be anything that leads out of the workspaces folder.
+func validateWorkspace(name string) error {
+	if name != "" && !workspaceNameRegex.MatchString(name) {
+		return fmt.Errorf("Workspace validation failed: names should be 2 to 50 characters long, made of lowercase letters, digits, '-' and '_', starting with a letter or a digit")
+	}
+	return nil
+}
@@ -1,9 +1,16 @@
 package handler
 
 import (
+	"../service/conversation_service"
+	"../service/moderation_service"
+	"../service/retention_service"
+	"../service/schedule_service"
+	"../service/user_service"
 	"fmt"
 	"github.com/julienschmidt/httprouter"
 	"net/http"
+	"strings"
+	"time"
 )
 
 /**************************************************************************
@@ -21,14 +28,26 @@ func GetChatHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params)
 		return
 	}
 
-	// 2. Logic: Fetch all the conversations of the provided user
-	data, err := user.GetConversations()
+	// 2. Logic: Fetch all the conversations of the provided user, or only the ones it has archived (?archived=true)
+	var data []*conversation_service.Conversation
+	if r.URL.Query().Get("archived") == "true" {
+		data, err = user.GetArchivedConversations()
+	} else {
+		data, err = user.GetConversations()
+	}
 	if err != nil {
 		writeError(w, err)
 		return
 	}
 
-	// 3. Serve Response
+	// 3. If the client asked for it (?render=html), include a safe HTML version of every message
+	if r.URL.Query().Get("render") == "html" {
+		for _, conv := range data {
+			conv.RenderMessages()
+		}
+	}
+
+	// 4. Serve Response
 	writeData(w, data)
 }
 
@@ -37,6 +56,7 @@ type ChatBodyParams struct {
 	MessageId int
 	Content   string
 	To        string
+	Format    string
 }
 
 // POST: Listens for requests to send a message to another user
@@ -59,13 +79,17 @@ func PostChatHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params
 	}
 
 	// 3. Logic: Send the message from the caller to the provided user
-	messageId, err := user.SendMessage(body.To, body.Content)
+	messageId, err := user.SendMessageWithFormat(body.To, body.Content, body.Format)
 	if err != nil {
 		writeError(w, err)
 		return
 	}
 
-	// 4. Serve Response
+	// 4. Serve Response. The message might be held until the recipient accepts a contact request, in which case it doesn't have an id yet
+	if messageId == user_service.HeldMessageId {
+		writeData(w, fmt.Sprintf("Message held until %s accepts the contact request", body.To))
+		return
+	}
 	writeData(w, fmt.Sprintf("Message Id: %d", messageId))
 
 }
@@ -129,3 +153,1667 @@ func DeleteChatHandler(w http.ResponseWriter, r *http.Request, p httprouter.Para
 	// 4. Serve Response
 	writeData(w, "Message deleted")
 }
+
+// Define a struct that can be used by requests to forward a message to send body
+type ForwardBodyParams struct {
+	With      string
+	MessageId int
+	To        string
+}
+
+// POST: Listens for requests to forward a message from the conversation with one user into the conversation with another user
+func PostForwardHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	fmt.Println("POST request to /v1/forward")
+
+	// 1. Authenticate (dummy)
+	user, err := authenticateRequest(r, p)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	// 2. Parse the body of the request so we know what message to forward, and to whom
+	var body ForwardBodyParams
+	err = parseBody(r, &body)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	// 3. Logic: Forward the message
+	messageId, err := user.ForwardMessage(body.With, body.MessageId, body.To)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	// 4. Serve Response
+	writeData(w, fmt.Sprintf("Message Id: %d", messageId))
+}
+
+/**************************************************************************
+* I N B O X  H A N D L E R S
+**************************************************************************/
+
+// Define a struct that can be used by requests that mark a conversation as read to send body
+type InboxBodyParams struct {
+	With      string
+	Channel   string
+	MessageId int
+}
+
+// GET: Listens for requests to serve the inbox of a user: a summary of each of its conversations, most recently active first
+func GetInboxHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	fmt.Println("GET request to /v1/inbox")
+
+	// 1. Authenticate (dummy) the requester
+	user, err := authenticateRequest(r, p)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	// 2. Logic: Fetch the conversation summaries of the user, or only the ones it has archived (?archived=true)
+	data := user.GetInbox()
+	if r.URL.Query().Get("archived") == "true" {
+		data = user.GetArchivedInbox()
+	}
+
+	// 3. Serve Response
+	writeData(w, data)
+}
+
+// PUT: Listens for requests to mark the messages of a conversation as read, up to a message id (or all of them, if there's no message id)
+func PutInboxHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	fmt.Println("PUT request to /v1/inbox")
+
+	// 1. Authenticate (dummy)
+	user, err := authenticateRequest(r, p)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	// 2. Parse the body of the request so we know which conversation has been read
+	var body InboxBodyParams
+	err = parseBody(r, &body)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	// 3. Logic: Mark the messages as read, in a conversation with a user, or in a channel
+	if body.Channel != "" {
+		err = user.MarkChannelRead(body.Channel, body.MessageId)
+	} else {
+		err = user.MarkRead(body.With, body.MessageId)
+	}
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	// 4. Serve Response
+	writeData(w, "Conversation marked as read")
+}
+
+/**************************************************************************
+* C O N V E R S A T I O N  S E T T I N G S  H A N D L E R S
+**************************************************************************/
+
+// Define a struct that can be used by requests that update the settings a user has for a conversation to send body. Only the provided settings are changed.
+type SettingsBodyParams struct {
+	With       string
+	MutedUntil *time.Time
+	Archived   *bool
+	Pinned     *bool
+}
+
+// GET: Listens for requests to serve the settings (mute, archive, pin) a user has for its conversation with the user in ?with=
+func GetSettingsHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	fmt.Println("GET request to /v1/settings")
+
+	// 1. Authenticate (dummy) the requester
+	user, err := authenticateRequest(r, p)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	// 2. Logic: Fetch the settings
+	data, err := user.GetConversationSettings(r.URL.Query().Get("with"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	// 3. Serve Response
+	writeData(w, data)
+}
+
+// PUT: Listens for requests to mute, archive or pin (or undo any of those) the conversation of a user with a given user
+func PutSettingsHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	fmt.Println("PUT request to /v1/settings")
+
+	// 1. Authenticate (dummy)
+	user, err := authenticateRequest(r, p)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	// 2. Parse the body of the request so we know what conversation to update, and how
+	var body SettingsBodyParams
+	err = parseBody(r, &body)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	// 3. Logic: Change the settings that were provided, all at once so a request never leaves them half changed
+	err = user.UpdateConversationSettings(body.With, body.MutedUntil, body.Archived, body.Pinned)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	// 4. Serve Response
+	writeData(w, "Conversation settings updated")
+}
+
+/**************************************************************************
+* P I N N E D  M E S S A G E  H A N D L E R S
+**************************************************************************/
+
+// Define a struct that can be used by POST and DELETE requests to pinned messages to send body
+type PinBodyParams struct {
+	With      string
+	MessageId int
+}
+
+// GET: Listens for requests to serve the pinned messages of the conversation of a user with the user in ?with=
+func GetPinsHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	fmt.Println("GET request to /v1/pins")
+
+	// 1. Authenticate (dummy) the requester
+	user, err := authenticateRequest(r, p)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	// 2. Logic: Fetch the pinned messages
+	data, err := user.GetPinnedMessages(r.URL.Query().Get("with"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	// 3. Serve Response
+	writeData(w, data)
+}
+
+// POST: Listens for requests to pin a message in a conversation
+func PostPinHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	fmt.Println("POST request to /v1/pins")
+
+	// 1. Authenticate (dummy)
+	user, err := authenticateRequest(r, p)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	// 2. Parse the body of the request so we know what message to pin
+	var body PinBodyParams
+	err = parseBody(r, &body)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	// 3. Logic: Pin the message
+	err = user.PinMessage(body.With, body.MessageId)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	// 4. Serve Response
+	writeData(w, "Message pinned")
+}
+
+// DELETE: Listens for requests to unpin a message in a conversation
+func DeletePinHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	fmt.Println("DELETE request to /v1/pins")
+
+	// 1. Authenticate (dummy)
+	user, err := authenticateRequest(r, p)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	// 2. Parse the body of the request so we know what message to unpin
+	var body PinBodyParams
+	err = parseBody(r, &body)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	// 3. Logic: Unpin the message
+	err = user.UnpinMessage(body.With, body.MessageId)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	// 4. Serve Response
+	writeData(w, "Message unpinned")
+}
+
+/**************************************************************************
+* U S E R  H A N D L E R S
+**************************************************************************/
+
+// Define a struct that can be used by POST and PUT requests to user profiles to send body
+type ProfileBodyParams struct {
+	DisplayName string
+	AvatarRef   string
+	StatusText  string
+}
+
+// Define a struct that can be used by requests to rename a user to send body
+type RenameBodyParams struct {
+	NewUserId string
+}
+
+// GET: Listens for requests to serve the profile of a user. By default it's the requester's own profile, or another user's if asked for (?id=)
+func GetUserHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	fmt.Println("GET request to /v1/user")
+
+	// 1. Authenticate (dummy) the requester
+	user, err := authenticateRequest(r, p)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	// 2. Figure out whose profile is being asked for
+	if id := r.URL.Query().Get("id"); id != "" {
+		user, err = user_service.GetRegisteredUser(id)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+	}
+
+	// 3. Logic: Fetch the profile
+	data, err := user.GetProfile()
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	// 4. Serve Response
+	writeData(w, data)
+}
+
+// POST: Listens for requests to register a new user
+func PostUserHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	fmt.Println("POST request to /v1/user")
+
+	// 1. Authenticate (dummy)
+	user, err := authenticateRequest(r, p)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	// 2. Parse the body of the request so we know what the profile of the new user is
+	var body ProfileBodyParams
+	err = parseBody(r, &body)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	// 3. Logic: Register the user
+	data, err := user_service.RegisterUser(user.UserId, body.DisplayName, body.AvatarRef, body.StatusText)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	// 4. Serve Response
+	writeData(w, data)
+}
+
+// PUT: Listens for requests to update the profile of a user
+func PutUserHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	fmt.Println("PUT request to /v1/user")
+
+	// 1. Authenticate (dummy)
+	user, err := authenticateRequest(r, p)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	// 2. Parse the body of the request so we know what the new profile is
+	var body ProfileBodyParams
+	err = parseBody(r, &body)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	// 3. Logic: Update the profile
+	err = user.UpdateProfile(body.DisplayName, body.AvatarRef, body.StatusText)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	// 4. Serve Response
+	writeData(w, "Profile updated")
+}
+
+// DELETE: Listens for requests to delete the account of a user. Their messages are anonymized, and the conversations nobody else is in are erased.
+func DeleteUserHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	fmt.Println("DELETE request to /v1/user")
+
+	// 1. Authenticate (dummy)
+	user, err := authenticateRequest(r, p)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	// 2. Logic: Delete the account
+	err = user.DeleteAccount()
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	// 3. Serve Response
+	writeData(w, "Account deleted")
+}
+
+// POST: Listens for requests to change the user id of a user. Their conversations and messages move to the new user id.
+func PostRenameHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	fmt.Println("POST request to /v1/rename")
+
+	// 1. Authenticate (dummy)
+	user, err := authenticateRequest(r, p)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	// 2. Parse the body of the request so we know what the new user id is
+	var body RenameBodyParams
+	err = parseBody(r, &body)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	// 3. Logic: Rename the user
+	renamed, err := user.Rename(body.NewUserId)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	// 4. Serve Response
+	writeData(w, renamed)
+}
+
+// GET: Listens for requests to export all the data of a user, as a downloadable zip archive of json files
+func GetExportHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	fmt.Println("GET request to /v1/export")
+
+	// 1. Authenticate (dummy) the requester
+	user, err := authenticateRequest(r, p)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	// 2. Logic: Collect all the data of the user
+	data, err := user.ExportData()
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	// 3. Serve Response: one file for each kind of data, and one for each conversation
+	var files map[string]interface{} = map[string]interface{}{
+		"profile.json":            data.Profile,
+		"buddies.json":            data.Buddies,
+		"blocked_users.json":      data.BlockedUserIds,
+		"contact_requests.json":   data.ContactRequests,
+		"authored_messages.json":  data.AuthoredMessages,
+		"scheduled_messages.json": schedule_service.GetScheduledMessages(user),
+	}
+	for _, conv := range data.Conversations {
+		files["conversations/"+conv.UniqueKey()+".json"] = conv
+	}
+	err = writeArchive(w, fmt.Sprintf("%s_export_%s.zip", user.UserId, data.TimestampExported.Format("20060102150405")), files)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+}
+
+/**************************************************************************
+* P R E S E N C E  H A N D L E R S
+**************************************************************************/
+
+// Define a struct that can be used by requests that update the presence settings of a user to send body
+type PresenceBodyParams struct {
+	Hidden bool
+}
+
+// GET: Listens for requests to serve all the buddies of a user, along with their presence (online, away, offline, last seen)
+func GetBuddiesHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	fmt.Println("GET request to /v1/buddies")
+
+	// 1. Authenticate (dummy) the requester
+	user, err := authenticateRequest(r, p)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	// 2. Logic: Fetch all the buddies of the user
+	data, err := user.GetBuddies()
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	// 3. Serve Response
+	writeData(w, data)
+}
+
+// PUT: Listens for requests to hide (or show) the presence of a user from other users
+func PutPresenceHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	fmt.Println("PUT request to /v1/presence")
+
+	// 1. Authenticate (dummy)
+	user, err := authenticateRequest(r, p)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	// 2. Parse the body of the request so we know what the new setting is
+	var body PresenceBodyParams
+	err = parseBody(r, &body)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	// 3. Logic: Hide or show the presence
+	err = user.SetPresenceHidden(body.Hidden)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	// 4. Serve Response
+	writeData(w, "Presence updated")
+}
+
+/**************************************************************************
+* B L O C K  H A N D L E R S
+**************************************************************************/
+
+// Define a struct that can be used by POST and DELETE requests to blocks to send body
+type BlockBodyParams struct {
+	UserId string
+}
+
+// GET: Listens for requests to serve the user ids of all the users a user has blocked
+func GetBlocksHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	fmt.Println("GET request to /v1/blocks")
+
+	// 1. Authenticate (dummy) the requester
+	user, err := authenticateRequest(r, p)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	// 2. Logic: Fetch the blocked users
+	data := user.GetBlockedUserIds()
+
+	// 3. Serve Response
+	writeData(w, data)
+}
+
+// POST: Listens for requests to block a user
+func PostBlockHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	fmt.Println("POST request to /v1/blocks")
+
+	// 1. Authenticate (dummy)
+	user, err := authenticateRequest(r, p)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	// 2. Parse the body of the request so we know whom to block
+	var body BlockBodyParams
+	err = parseBody(r, &body)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	// 3. Logic: Block the user
+	err = user.Block(body.UserId)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	// 4. Serve Response
+	writeData(w, "User blocked")
+}
+
+// DELETE: Listens for requests to unblock a user
+func DeleteBlockHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	fmt.Println("DELETE request to /v1/blocks")
+
+	// 1. Authenticate (dummy)
+	user, err := authenticateRequest(r, p)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	// 2. Parse the body of the request so we know whom to unblock
+	var body BlockBodyParams
+	err = parseBody(r, &body)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	// 3. Logic: Unblock the user
+	err = user.Unblock(body.UserId)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	// 4. Serve Response
+	writeData(w, "User unblocked")
+}
+
+/**************************************************************************
+* C O N T A C T  R E Q U E S T  H A N D L E R S
+**************************************************************************/
+
+// Define a struct that can be used by PUT and DELETE requests to contact requests to send body
+type ContactBodyParams struct {
+	From string
+}
+
+// GET: Listens for requests to serve all the pending contact requests of a user, sent and received
+func GetContactsHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	fmt.Println("GET request to /v1/contacts")
+
+	// 1. Authenticate (dummy) the requester
+	user, err := authenticateRequest(r, p)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	// 2. Logic: Fetch the pending contact requests
+	data := user.GetContactRequests()
+
+	// 3. Serve Response
+	writeData(w, data)
+}
+
+// PUT: Listens for requests to accept a contact request
+func PutContactHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	fmt.Println("PUT request to /v1/contacts")
+
+	// 1. Authenticate (dummy)
+	user, err := authenticateRequest(r, p)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	// 2. Parse the body of the request so we know whose contact request to accept
+	var body ContactBodyParams
+	err = parseBody(r, &body)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	// 3. Logic: Accept the contact request, which delivers the held messages
+	err = user.AcceptContactRequest(body.From)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	// 4. Serve Response
+	writeData(w, "Contact request accepted")
+}
+
+// DELETE: Listens for requests to reject a contact request
+func DeleteContactHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	fmt.Println("DELETE request to /v1/contacts")
+
+	// 1. Authenticate (dummy)
+	user, err := authenticateRequest(r, p)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	// 2. Parse the body of the request so we know whose contact request to reject
+	var body ContactBodyParams
+	err = parseBody(r, &body)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	// 3. Logic: Reject the contact request, which throws away the held messages
+	err = user.RejectContactRequest(body.From)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	// 4. Serve Response
+	writeData(w, "Contact request rejected")
+}
+
+/**************************************************************************
+* R E A L - T I M E  H A N D L E R S
+**************************************************************************/
+
+// GET: Listens for requests to open a real-time connection, and streams the events for the user (Server-Sent Events) until the client goes away
+func GetEventsHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	fmt.Println("GET request to /v1/events")
+
+	// 1. Authenticate (dummy) the requester
+	user, err := authenticateRequest(r, p)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	// 2. Make sure the connection can be streamed to
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		writeError(w, fmt.Errorf("Streaming is not supported by the connection"))
+		return
+	}
+
+	// 3. Logic: Open the real-time connection, and close it when the client goes away
+	events, disconnect, err := user.Connect()
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+	defer disconnect()
+
+	// 4. Serve Response: every event, as soon as it happens
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.WriteHeader(http.StatusOK)
+	flusher.Flush()
+	for {
+		select {
+		case <-r.Context().Done():
+			return
+		case e, open := <-events:
+			if !open {
+				return
+			}
+			err = writeEvent(w, e)
+			if err != nil {
+				return
+			}
+			flusher.Flush()
+		}
+	}
+}
+
+// Define a struct that can be used by requests that signal typing to send body
+type TypingBodyParams struct {
+	To     string
+	Typing bool
+}
+
+// POST: Listens for requests to signal that a user started (or stopped) typing to a given user
+func PostTypingHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	fmt.Println("POST request to /v1/typing")
+
+	// 1. Authenticate (dummy)
+	user, err := authenticateRequest(r, p)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	// 2. Parse the body of the request so we know to whom the user is typing
+	var body TypingBodyParams
+	err = parseBody(r, &body)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	// 3. Logic: Tell the other user over the real-time channel
+	err = user.SetTyping(body.To, body.Typing)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	// 4. Serve Response
+	writeData(w, "Typing updated")
+}
+
+/**************************************************************************
+* C O N V E R S A T I O N  H A N D L E R S
+**************************************************************************/
+
+// Define a struct that can be used by requests that update the settings of a conversation to send body
+type ConversationBodyParams struct {
+	To                string
+	MessageTtlSeconds int
+}
+
+// PUT: Listens for requests to update the settings (e.g. message TTL) of the conversation with a given user
+func PutConversationHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	fmt.Println("PUT request to /v1/conversation")
+
+	// 1. Authenticate (dummy)
+	user, err := authenticateRequest(r, p)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	// 2. Parse the body of the request so we know what conversation to update, and how
+	var body ConversationBodyParams
+	err = parseBody(r, &body)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	// 3. Logic: Set the message TTL of the conversation
+	err = user.SetMessageTtl(body.To, body.MessageTtlSeconds)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	// 4. Serve Response
+	writeData(w, "Conversation updated")
+}
+
+// Define a struct that can be used by requests that update the info of a conversation to send body. Only the provided info is changed.
+type InfoBodyParams struct {
+	With        string
+	Title       *string
+	Description *string
+	AvatarRef   *string
+}
+
+// PUT: Listens for requests to update the info (title, description, avatar) of the conversation with a given user
+func PutInfoHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	fmt.Println("PUT request to /v1/info")
+
+	// 1. Authenticate (dummy)
+	user, err := authenticateRequest(r, p)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	// 2. Parse the body of the request so we know what conversation to update, and the new info
+	var body InfoBodyParams
+	err = parseBody(r, &body)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	// 3. Logic: Update the info of the conversation
+	err = user.UpdateConversationInfo(body.With, body.Title, body.Description, body.AvatarRef)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	// 4. Serve Response
+	writeData(w, "Conversation info updated")
+}
+
+// Define a struct that can be used by requests that change the role of a member of a channel to send body
+type RoleBodyParams struct {
+	Channel string
+	UserId  string
+	Role    conversation_service.Role
+}
+
+// GET: Listens for requests to serve the role of each member of the channel in ?channel=
+func GetRolesHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	fmt.Println("GET request to /v1/roles")
+
+	// 1. Authenticate (dummy) the requester
+	user, err := authenticateRequest(r, p)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	// 2. Logic: Fetch the roles
+	data, err := user.GetChannelRoles(r.URL.Query().Get("channel"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	// 3. Serve Response
+	writeData(w, data)
+}
+
+// PUT: Listens for requests to change the role of a member of a channel, or to transfer its ownership
+func PutRoleHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	fmt.Println("PUT request to /v1/roles")
+
+	// 1. Authenticate (dummy)
+	user, err := authenticateRequest(r, p)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	// 2. Parse the body of the request so we know what channel to update, whose role to change, and to what
+	var body RoleBodyParams
+	err = parseBody(r, &body)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	// 3. Logic: Change the role
+	err = user.SetChannelRole(body.Channel, body.UserId, body.Role)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	// 4. Serve Response
+	writeData(w, "Role updated")
+}
+
+/**************************************************************************
+* C H A N N E L  H A N D L E R S
+**************************************************************************/
+
+// Define a struct that can be used by requests to channels to send body
+type ChannelBodyParams struct {
+	Channel   string
+	Topic     string
+	Private   bool
+	Token     string
+	Content   string
+	Format    string
+	MessageId int
+	UserId    string
+}
+
+// GET: Listens for requests to list the channels whose name or topic contain ?q= (all of them if there's no query), the ones with the most members first
+func GetChannelsHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	fmt.Println("GET request to /v1/channels")
+
+	// 1. Authenticate (dummy) the requester
+	_, err := authenticateRequest(r, p)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	// 2. Logic: Search the channels
+	data := conversation_service.SearchChannels(r.URL.Query().Get("q"))
+
+	// 3. Serve Response
+	writeData(w, data)
+}
+
+// POST: Listens for requests to create a new channel
+func PostChannelsHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	fmt.Println("POST request to /v1/channels")
+
+	// 1. Authenticate (dummy)
+	user, err := authenticateRequest(r, p)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	// 2. Parse the body of the request so we know the name and the topic of the channel
+	var body ChannelBodyParams
+	err = parseBody(r, &body)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	// 3. Logic: Create the channel
+	err = user.CreateChannel(body.Channel, body.Topic, body.Private)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	// 4. Serve Response
+	writeData(w, "Channel created")
+}
+
+// PUT: Listens for requests to change the topic of a channel
+func PutChannelsHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	fmt.Println("PUT request to /v1/channels")
+
+	// 1. Authenticate (dummy)
+	user, err := authenticateRequest(r, p)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	// 2. Parse the body of the request so we know what channel to update, and its new topic
+	var body ChannelBodyParams
+	err = parseBody(r, &body)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	// 3. Logic: Change the topic
+	err = user.SetChannelTopic(body.Channel, body.Topic)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	// 4. Serve Response
+	writeData(w, "Channel topic updated")
+}
+
+// POST: Listens for requests to join a channel, either a public one by its name, or any channel with an invite token, or to add another user (UserId) to a channel
+func PostMembershipHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	fmt.Println("POST request to /v1/membership")
+
+	// 1. Authenticate (dummy)
+	user, err := authenticateRequest(r, p)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	// 2. Parse the body of the request so we know what channel to join
+	var body ChannelBodyParams
+	err = parseBody(r, &body)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	// 3. Logic: Join the channel, or add the other user to it
+	if body.UserId != "" {
+		err = user.AddChannelMember(body.Channel, body.UserId)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		writeData(w, "Member added")
+		return
+	}
+	if body.Token != "" {
+		err = user.JoinWithInvite(body.Token)
+	} else {
+		err = user.JoinChannel(body.Channel)
+	}
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	// 4. Serve Response
+	writeData(w, "Channel joined")
+}
+
+// DELETE: Listens for requests to leave a channel, or to remove another member (UserId) from it
+func DeleteMembershipHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	fmt.Println("DELETE request to /v1/membership")
+
+	// 1. Authenticate (dummy)
+	user, err := authenticateRequest(r, p)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	// 2. Parse the body of the request so we know what channel to leave
+	var body ChannelBodyParams
+	err = parseBody(r, &body)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	// 3. Logic: Leave the channel, or remove the other member from it
+	if body.UserId != "" {
+		err = user.RemoveChannelMember(body.Channel, body.UserId)
+		if err != nil {
+			writeError(w, err)
+			return
+		}
+		writeData(w, "Member removed")
+		return
+	}
+	err = user.LeaveChannel(body.Channel)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	// 4. Serve Response
+	writeData(w, "Channel left")
+}
+
+// GET: Listens for requests to serve the channel in ?name=, with all of its messages
+func GetChannelHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	fmt.Println("GET request to /v1/channel")
+
+	// 1. Authenticate (dummy) the requester
+	user, err := authenticateRequest(r, p)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	// 2. Logic: Fetch the channel
+	data, err := user.GetChannel(r.URL.Query().Get("name"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	// 3. If the client asked for it (?render=html), include a safe HTML version of every message
+	if r.URL.Query().Get("render") == "html" {
+		data.RenderMessages()
+	}
+
+	// 4. Serve Response
+	writeData(w, data)
+}
+
+// POST: Listens for requests to send a message to a channel
+func PostChannelHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	fmt.Println("POST request to /v1/channel")
+
+	// 1. Authenticate (dummy)
+	user, err := authenticateRequest(r, p)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	// 2. Parse body of the request so we know what the message is, and to which channel
+	var body ChannelBodyParams
+	err = parseBody(r, &body)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	// 3. Logic: Send the message to the channel
+	messageId, err := user.SendChannelMessage(body.Channel, body.Content, body.Format)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	// 4. Serve Response
+	writeData(w, fmt.Sprintf("Message Id: %d", messageId))
+}
+
+// PUT: Listens for requests to edit a message in a channel
+func PutChannelHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	fmt.Println("PUT request to /v1/channel")
+
+	// 1. Authenticate (dummy)
+	user, err := authenticateRequest(r, p)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	// 2. Parse the body of the request so we know what message to edit, and in which channel
+	var body ChannelBodyParams
+	err = parseBody(r, &body)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	// 3. Logic: Edit the message
+	err = user.EditChannelMessage(body.Channel, body.MessageId, body.Content)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	// 4. Serve Response
+	writeData(w, "Message updated")
+}
+
+// DELETE: Listens for requests to delete a message in a channel
+func DeleteChannelHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	fmt.Println("DELETE request to /v1/channel")
+
+	// 1. Authenticate (dummy)
+	user, err := authenticateRequest(r, p)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	// 2. Parse the body of the request so we know what message to delete, and in which channel
+	var body ChannelBodyParams
+	err = parseBody(r, &body)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	// 3. Logic: Delete the message
+	err = user.DeleteChannelMessage(body.Channel, body.MessageId)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	// 4. Serve Response
+	writeData(w, "Message deleted")
+}
+
+// Define a struct that can be used by requests to the invites of a channel to send body
+type InviteBodyParams struct {
+	Channel   string
+	ExpiresAt *time.Time
+	MaxUses   int
+	Token     string
+}
+
+// GET: Listens for requests to serve the invites into the channel in ?channel=
+func GetInvitesHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	fmt.Println("GET request to /v1/invites")
+
+	// 1. Authenticate (dummy) the requester
+	user, err := authenticateRequest(r, p)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	// 2. Logic: Fetch the invites
+	data, err := user.GetInvites(r.URL.Query().Get("channel"))
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	// 3. Serve Response
+	writeData(w, data)
+}
+
+// POST: Listens for requests to create an invite into a channel
+func PostInviteHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	fmt.Println("POST request to /v1/invites")
+
+	// 1. Authenticate (dummy)
+	user, err := authenticateRequest(r, p)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	// 2. Parse the body of the request so we know what channel the invite is for, and its limits
+	var body InviteBodyParams
+	err = parseBody(r, &body)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	// 3. Logic: Create the invite
+	data, err := user.CreateInvite(body.Channel, body.ExpiresAt, body.MaxUses)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	// 4. Serve Response
+	writeData(w, data)
+}
+
+// DELETE: Listens for requests to revoke an invite into a channel
+func DeleteInviteHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	fmt.Println("DELETE request to /v1/invites")
+
+	// 1. Authenticate (dummy)
+	user, err := authenticateRequest(r, p)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	// 2. Parse the body of the request so we know which invite to revoke
+	var body InviteBodyParams
+	err = parseBody(r, &body)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	// 3. Logic: Revoke the invite
+	err = user.RevokeInvite(body.Channel, body.Token)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	// 4. Serve Response
+	writeData(w, "Invite revoked")
+}
+
+/**************************************************************************
+* S C H E D U L E D  M E S S A G E  H A N D L E R S
+**************************************************************************/
+
+// Define a struct that can be used by POST, PUT and DELETE requests to scheduled messages to send body
+type ScheduledBodyParams struct {
+	ScheduledMessageId int
+	Content            string
+	To                 string
+	Format             string
+	SendAt             time.Time
+}
+
+// GET: Listens for requests to serve all the pending scheduled messages of a user
+func GetScheduledHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	fmt.Println("GET request to /v1/scheduled")
+
+	// 1. Authenticate (dummy) the requester
+	user, err := authenticateRequest(r, p)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	// 2. Logic: Fetch all the messages the user has scheduled, but that haven't been sent yet
+	data := schedule_service.GetScheduledMessages(user)
+
+	// 3. Serve Response
+	writeData(w, data)
+}
+
+// POST: Listens for requests to schedule a message to another user, to be sent at a later time
+func PostScheduledHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	fmt.Println("POST request to /v1/scheduled")
+
+	// 1. Authenticate (dummy)
+	user, err := authenticateRequest(r, p)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	// 2. Parse body of the request so we know what the message is, to whom, and when to send it
+	var body ScheduledBodyParams
+	err = parseBody(r, &body)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	// 3. Logic: Schedule the message
+	scheduledMessageId, err := schedule_service.Schedule(user, body.To, body.Content, body.Format, body.SendAt)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	// 4. Serve Response
+	writeData(w, fmt.Sprintf("Scheduled Message Id: %d", scheduledMessageId))
+}
+
+// PUT: Listens for requests to edit the content or send time of a scheduled message
+func PutScheduledHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	fmt.Println("PUT request to /v1/scheduled")
+
+	// 1. Authenticate (dummy)
+	user, err := authenticateRequest(r, p)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	// 2. Parse the body of the request so we know what scheduled message to edit
+	var body ScheduledBodyParams
+	err = parseBody(r, &body)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	// 3. Logic: Edit the scheduled message mentioned in the request body
+	err = schedule_service.Edit(user, body.ScheduledMessageId, body.Content, body.SendAt)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	// 4. Serve Response
+	writeData(w, "Scheduled message updated")
+}
+
+// DELETE: Listens for requests to cancel a scheduled message
+func DeleteScheduledHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	fmt.Println("DELETE request to /v1/scheduled")
+
+	// 1. Authenticate (dummy)
+	user, err := authenticateRequest(r, p)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	// 2. Parse the body of the request so we know what scheduled message to cancel
+	var body ScheduledBodyParams
+	err = parseBody(r, &body)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	// 3. Logic: Cancel the scheduled message mentioned in the request body
+	err = schedule_service.Cancel(user, body.ScheduledMessageId)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	// 4. Serve Response
+	writeData(w, "Scheduled message cancelled")
+}
+
+/**************************************************************************
+* A D M I N  H A N D L E R S
+**************************************************************************/
+
+// Define a struct that can be used by requests that set the retention policy of a conversation to send body
+type RetentionBodyParams struct {
+	UserIds              []string
+	RetentionDays        int
+	RetentionMaxMessages int
+}
+
+// GET: Listens for requests (by admins) to serve the audit log of the messages pruned by the retention policies
+func GetRetentionHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	fmt.Println("GET request to /v1/admin/retention")
+
+	// 1. Authenticate (dummy) the requester, and make sure they are an admin
+	_, err := authenticateAdminRequest(r, p)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	// 2. Logic: Fetch the audit log
+	data := retention_service.GetAuditLog()
+
+	// 3. Serve Response
+	writeData(w, data)
+}
+
+// PUT: Listens for requests (by admins) to set the retention policy of a conversation
+func PutRetentionHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	fmt.Println("PUT request to /v1/admin/retention")
+
+	// 1. Authenticate (dummy) the requester, and make sure they are an admin
+	_, err := authenticateAdminRequest(r, p)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	// 2. Parse the body of the request so we know what conversation to update, and how
+	var body RetentionBodyParams
+	err = parseBody(r, &body)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	// 3. Logic: Set the retention policy of the conversation
+	err = retention_service.SetConversationRetention(body.UserIds, body.RetentionDays, body.RetentionMaxMessages)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	// 4. Serve Response
+	writeData(w, "Retention policy updated")
+}
+
+// GET: Listens for requests (by admins) to serve the metrics of the conversation cache
+func GetCacheHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	fmt.Println("GET request to /v1/admin/cache")
+
+	// 1. Authenticate (dummy) the requester, and make sure they are an admin
+	_, err := authenticateAdminRequest(r, p)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	// 2. Logic: Fetch the cache metrics
+	data := conversation_service.GetCacheStats()
+
+	// 3. Serve Response
+	writeData(w, data)
+}
+
+// Define a struct that can be used by requests that moderate users and messages to send body
+type ModerationBodyParams struct {
+	UserId    string
+	Until     *time.Time
+	UserIds   []string
+	Channel   string
+	MessageId int
+	Reason    string
+}
+
+// GET: Listens for requests (by admins) to serve all the registered users, along with their suspensions
+func GetAdminUsersHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	fmt.Println("GET request to /v1/admin/users")
+
+	// 1. Authenticate (dummy) the requester, and make sure they are an admin
+	_, err := authenticateAdminRequest(r, p)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	// 2. Logic: Fetch the users
+	data := moderation_service.ListUsers()
+
+	// 3. Serve Response
+	writeData(w, data)
+}
+
+// GET: Listens for requests (by admins) to serve all the conversations without their messages, or a single conversation (?users=a,b or ?channel=) with its messages
+func GetAdminConversationsHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	fmt.Println("GET request to /v1/admin/conversations")
+
+	// 1. Authenticate (dummy) the requester, and make sure they are an admin
+	admin, err := authenticateAdminRequest(r, p)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	// 2. Logic: Fetch the conversations, or the one conversation asked for
+	var data interface{}
+	users, channel := r.URL.Query().Get("users"), r.URL.Query().Get("channel")
+	if users == "" && channel == "" {
+		data, err = moderation_service.ListConversations()
+	} else {
+		var userIds []string
+		if users != "" {
+			userIds = strings.Split(users, ",")
+		}
+		data, err = moderation_service.ViewConversation(admin.UserId, userIds, channel)
+	}
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	// 3. Serve Response
+	writeData(w, data)
+}
+
+// DELETE: Listens for requests (by admins) to delete any message
+func DeleteAdminMessageHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	fmt.Println("DELETE request to /v1/admin/message")
+
+	// 1. Authenticate (dummy) the requester, and make sure they are an admin
+	admin, err := authenticateAdminRequest(r, p)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	// 2. Parse the body of the request so we know what message to delete, from what conversation
+	var body ModerationBodyParams
+	err = parseBody(r, &body)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	// 3. Logic: Delete the message
+	err = moderation_service.DeleteMessage(admin.UserId, body.UserIds, body.Channel, body.MessageId, body.Reason)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	// 4. Serve Response
+	writeData(w, "Message deleted")
+}
+
+// PUT: Listens for requests (by admins) to suspend a user until a given time, or ban them
+func PutSuspensionHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	fmt.Println("PUT request to /v1/admin/suspension")
+
+	// 1. Authenticate (dummy) the requester, and make sure they are an admin
+	admin, err := authenticateAdminRequest(r, p)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	// 2. Parse the body of the request so we know who to suspend, and until when
+	var body ModerationBodyParams
+	err = parseBody(r, &body)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	// 3. Logic: Suspend the user
+	err = moderation_service.Suspend(admin.UserId, body.UserId, body.Until, body.Reason)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	// 4. Serve Response
+	writeData(w, "User suspended")
+}
+
+// DELETE: Listens for requests (by admins) to lift the suspension (or the ban) of a user
+func DeleteSuspensionHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	fmt.Println("DELETE request to /v1/admin/suspension")
+
+	// 1. Authenticate (dummy) the requester, and make sure they are an admin
+	admin, err := authenticateAdminRequest(r, p)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	// 2. Parse the body of the request so we know who to reinstate
+	var body ModerationBodyParams
+	err = parseBody(r, &body)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	// 3. Logic: Reinstate the user
+	err = moderation_service.Reinstate(admin.UserId, body.UserId)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	// 4. Serve Response
+	writeData(w, "User reinstated")
+}
+
+// GET: Listens for requests (by admins) to serve the moderation log
+func GetModerationHandler(w http.ResponseWriter, r *http.Request, p httprouter.Params) {
+	fmt.Println("GET request to /v1/admin/moderation")
+
+	// 1. Authenticate (dummy) the requester, and make sure they are an admin
+	_, err := authenticateAdminRequest(r, p)
+	if err != nil {
+		writeError(w, err)
+		return
+	}
+
+	// 2. Logic: Fetch the moderation log
+	data := moderation_service.GetModerationLog()
+
+	// 3. Serve Response
+	writeData(w, data)
+}
@@ -1,13 +1,19 @@
 package handler
 
 import (
+	"../service/moderation_service"
+	"../service/realtime_service"
 	"../service/user_service"
+	"archive/zip"
+	"bytes"
 	"encoding/json"
 	"fmt"
 	"github.com/julienschmidt/httprouter"
 	"io/ioutil"
 	"net/http"
+	"sort"
 	"strings"
+	"time"
 )
 
 /**************************************************************************
@@ -22,7 +28,33 @@ func authenticateRequest(r *http.Request, p httprouter.Params) (*user_service.Us
 	if uid == "" {
 		return nil, fmt.Errorf("Invalid userid provided")
 	}
-	return user_service.GetUser(uid)
+	user, err := user_service.GetUser(uid)
+	if err != nil {
+		return nil, err
+	}
+	// Suspended and banned users can't do anything (see moderation_service)
+	err = moderation_service.CheckNotSuspended(user.UserId, time.Now())
+	if err != nil {
+		return nil, err
+	}
+	// Every authenticated request counts as activity, for the user's presence
+	err = user.Touch(time.Now())
+	if err != nil {
+		return nil, err
+	}
+	return user, nil
+}
+
+// Authenticates (dummy) the request like authenticateRequest, but also makes sure that the requester is an admin
+func authenticateAdminRequest(r *http.Request, p httprouter.Params) (*user_service.User, error) {
+	user, err := authenticateRequest(r, p)
+	if err != nil {
+		return nil, err
+	}
+	if !user.IsAdmin() {
+		return nil, fmt.Errorf("User %s is not an admin", user.UserId)
+	}
+	return user, nil
 }
 
 // The standard API response struct for any data that our server might return
@@ -55,6 +87,51 @@ func writeError(w http.ResponseWriter, err error) {
 	w.Write(b)
 }
 
+// Helps a streaming HTTP handler send a single real-time event, in the Server-Sent Events format
+func writeEvent(w http.ResponseWriter, e realtime_service.Event) error {
+	b, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	_, err = fmt.Fprintf(w, "event: %s\ndata: %s\n\n", e.Type, b)
+	return err
+}
+
+// Helps a HTTP handler return a downloadable zip archive, with each of the provided values encoded as a json file in it
+func writeArchive(w http.ResponseWriter, filename string, files map[string]interface{}) error {
+	// Build the whole archive first, so nothing is sent if something goes wrong half way
+	var buf bytes.Buffer
+	archive := zip.NewWriter(&buf)
+	var names []string
+	for name := range files {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, name := range names {
+		b, err := json.MarshalIndent(files[name], "", "\t")
+		if err != nil {
+			return err
+		}
+		f, err := archive.Create(name)
+		if err != nil {
+			return err
+		}
+		_, err = f.Write(b)
+		if err != nil {
+			return err
+		}
+	}
+	err := archive.Close()
+	if err != nil {
+		return err
+	}
+
+	w.Header().Add("Content-Type", "application/zip")
+	w.Header().Add("Content-Disposition", fmt.Sprintf("attachment; filename=%q", filename))
+	_, err = w.Write(buf.Bytes())
+	return err
+}
+
 // Helps unmarshal the request body into the provided struct
 func parseBody(r *http.Request, v interface{}) error {
 	b, err := ioutil.ReadAll(r.Body)
@@ -3,12 +3,19 @@ package main
 import (
 	"./config"
 	"./handler"
+	"./service/conversation_service"
+	"./service/moderation_service"
+	"./service/retention_service"
+	"./service/schedule_service"
 	"./service/user_service"
+	"flag"
 	"fmt"
 	"github.com/julienschmidt/httprouter"
 	"github.com/teejays/gofiledb"
 	"log"
 	"net/http"
+	"os"
+	"time"
 )
 
 /**************************************************************************
@@ -18,20 +25,133 @@ import (
 // This is the entry point of the app. We do two main things here:
 // -- 1) We initialize the various parts of the app that need to be initialized before the API can start working
 // -- 2) Set up a webserver, and forward the GET, POST, PUT and DELETE requests to the respecting handlers
+// If the app is started with the -rebuild flag, instead of starting the webserver, it rebuilds the conversation snapshots
+// and the buddies map from the conversation event logs, and exits.
 
 func main() {
 
+	rebuild := flag.Bool("rebuild", false, "rebuild the conversation snapshots and the buddies map from the event logs, and exit")
+	userIdReport := flag.Bool("userid-report", false, "report the existing user ids that don't follow the user id rules, and exit")
+	workspace := flag.String("workspace", "", "the workspace (team) to serve, overriding the Workspace in settings.json")
+	port := flag.Int("port", 0, "the port to listen on, overriding the HttpServerPort in settings.json")
+	settingsPath := flag.String("settings", "./config/settings.json", "the settings file to use")
+	flag.Parse()
+
 	// 1. Initialize the things we need in order to run the application
 	// -- Application settings, such as HTTP port, are provided in a settings.json file.
 	// -- Let's load that file into our config
-	config.InitConfig("./config/settings.json")
+	config.InitConfig(*settingsPath)
+	// -- Every workspace has its own storage, so this server only ever sees the data of its own workspace
+	if *workspace != "" {
+		err := config.SetWorkspace(*workspace)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	// -- Servers for different workspaces share the settings file, so each one can be given its own port
+	if *port != 0 {
+		err := config.SetHttpServerPort(*port)
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+	err := os.MkdirAll(config.GetConfig().StorageRoot(), 0755)
+	if err != nil {
+		log.Fatal(err)
+	}
 	// -- Start the gofiledb database client, so other services in the app can save and load their objects
-	gofiledb.InitClient(config.GetConfig().GoFiledbRoot)
+	gofiledb.InitClient(config.GetConfig().StorageRoot())
+	// -- If asked to, rebuild the data that is derived from the event logs, and stop there
+	if *rebuild {
+		n, err := user_service.RebuildFromEventLog()
+		if err != nil {
+			log.Fatal(err)
+		}
+		fmt.Printf("Rebuilt %d conversations and the buddies map from the event logs\n", n)
+		return
+	}
 	// -- Load an in-memory (from the db) that keeps track of what users converse with what other users
-	err := user_service.LoadBuddiesInfoToMemory()
+	err = user_service.LoadBuddiesInfoToMemory()
+	if err != nil {
+		log.Fatal(err)
+	}
+	// -- Load the registry of the users who have signed up, since messages can only be sent to them
+	err = user_service.LoadUserRegistryToMemory()
+	if err != nil {
+		log.Fatal(err)
+	}
+	// -- Load the last-seen times of the users, and whether they hide their presence
+	err = user_service.LoadPresenceToMemory()
+	if err != nil {
+		log.Fatal(err)
+	}
+	// -- Load the users that users have blocked
+	err = user_service.LoadBlocksToMemory()
+	if err != nil {
+		log.Fatal(err)
+	}
+	// -- Load the pending contact requests, along with the messages they hold
+	err = user_service.LoadContactRequestsToMemory()
+	if err != nil {
+		log.Fatal(err)
+	}
+	// -- Load the index of the public channels, that users can find and join
+	err = conversation_service.LoadChannelsToMemory()
+	if err != nil {
+		log.Fatal(err)
+	}
+	// -- Load the suspended users, and the moderation log
+	err = moderation_service.LoadModerationToMemory()
+	if err != nil {
+		log.Fatal(err)
+	}
+	// -- Load the invites into channels
+	err = conversation_service.LoadInvitesToMemory()
+	if err != nil {
+		log.Fatal(err)
+	}
+	// -- Load the index of conversation summaries that make up the inbox of every user
+	err = user_service.LoadInboxToMemory()
+	if err != nil {
+		log.Fatal(err)
+	}
+	// -- Load the queue of messages that users have scheduled to be sent later. It follows the renames and deletions of accounts, so it's loaded before renames are finished.
+	err = schedule_service.LoadScheduledMessagesToMemory()
+	if err != nil {
+		log.Fatal(err)
+	}
+	user_service.OnRename(schedule_service.RenameUser)
+	user_service.OnDelete(schedule_service.CancelAll)
+	// -- Finish the user id renames that were interrupted when the app stopped
+	err = user_service.ResumeRenames()
+	if err != nil {
+		log.Fatal(err)
+	}
+	// -- If asked to, report the existing user ids that should be migrated to ids that follow the user id rules, and stop there
+	if *userIdReport {
+		report := user_service.GetUserIdMigrationReport()
+		for _, r := range report {
+			fmt.Printf("%s: %s (suggested id: %s)\n", r.UserId, r.Problem, r.Suggestion)
+		}
+		fmt.Printf("Found %d user ids that don't follow the user id rules\n", len(report))
+		return
+	}
+	// -- Start expiring the typing indicators of users who stopped signaling that they type
+	user_service.StartTypingReaper(time.Second)
+	// -- Start delivering the scheduled messages when they are due
+	schedule_service.StartScheduler(time.Second)
+	// -- Load the index of conversations that have disappearing messages, and start removing the messages when they expire
+	err = conversation_service.LoadTtlIndexToMemory()
+	if err != nil {
+		log.Fatal(err)
+	}
+	user_service.StartMessageReaper(time.Second)
+	// -- Load the audit log of the retention policies, and start enforcing them periodically
+	err = retention_service.LoadAuditLogToMemory()
 	if err != nil {
 		log.Fatal(err)
 	}
+	retention_service.StartRetentionJob(time.Hour)
 
 	// II. Initialize the server
 	// -- We have four endpoints, following the RESTful standard.
@@ -46,6 +166,72 @@ func main() {
 	router.POST("/v1/chat/:userid", handler.PostChatHandler)
 	router.PUT("/v1/chat/:userid", handler.PutChatHandler)
 	router.DELETE("/v1/chat/:userid", handler.DeleteChatHandler)
+	router.POST("/v1/forward/:userid", handler.PostForwardHandler)
+	// -- Inbox: conversation summaries, read markers, and the settings (mute, archive, pin) each user has for its conversations
+	router.GET("/v1/inbox/:userid", handler.GetInboxHandler)
+	router.PUT("/v1/inbox/:userid", handler.PutInboxHandler)
+	router.GET("/v1/settings/:userid", handler.GetSettingsHandler)
+	router.PUT("/v1/settings/:userid", handler.PutSettingsHandler)
+	// -- Pinned messages of a conversation
+	router.GET("/v1/pins/:userid", handler.GetPinsHandler)
+	router.POST("/v1/pins/:userid", handler.PostPinHandler)
+	router.DELETE("/v1/pins/:userid", handler.DeletePinHandler)
+	// -- Users: registration, profiles, account deletion and data export
+	router.GET("/v1/user/:userid", handler.GetUserHandler)
+	router.POST("/v1/user/:userid", handler.PostUserHandler)
+	router.PUT("/v1/user/:userid", handler.PutUserHandler)
+	router.DELETE("/v1/user/:userid", handler.DeleteUserHandler)
+	router.POST("/v1/rename/:userid", handler.PostRenameHandler)
+	router.GET("/v1/export/:userid", handler.GetExportHandler)
+	// -- Presence: buddies with their presence, and hiding one's own presence
+	router.GET("/v1/buddies/:userid", handler.GetBuddiesHandler)
+	router.PUT("/v1/presence/:userid", handler.PutPresenceHandler)
+	// -- Blocking: list, block and unblock users
+	router.GET("/v1/blocks/:userid", handler.GetBlocksHandler)
+	router.POST("/v1/blocks/:userid", handler.PostBlockHandler)
+	router.DELETE("/v1/blocks/:userid", handler.DeleteBlockHandler)
+	// -- Contact requests: list, accept and reject the requests to become buddies
+	router.GET("/v1/contacts/:userid", handler.GetContactsHandler)
+	router.PUT("/v1/contacts/:userid", handler.PutContactHandler)
+	router.DELETE("/v1/contacts/:userid", handler.DeleteContactHandler)
+	// -- Real-time connection: a stream of events (Server-Sent Events), such as buddies coming online or typing, and signaling typing
+	router.GET("/v1/events/:userid", handler.GetEventsHandler)
+	router.POST("/v1/typing/:userid", handler.PostTypingHandler)
+	// -- Conversation settings, such as the message TTL of disappearing messages, and the info (title, description, avatar) of conversations
+	router.PUT("/v1/conversation/:userid", handler.PutConversationHandler)
+	router.PUT("/v1/info/:userid", handler.PutInfoHandler)
+	// -- Roles of the members of a channel (owner, admin, member), and transferring its ownership
+	router.GET("/v1/roles/:userid", handler.GetRolesHandler)
+	router.PUT("/v1/roles/:userid", handler.PutRoleHandler)
+	// -- Channels: public conversations that users can find, join and leave by themselves
+	router.GET("/v1/channels/:userid", handler.GetChannelsHandler)
+	router.POST("/v1/channels/:userid", handler.PostChannelsHandler)
+	router.PUT("/v1/channels/:userid", handler.PutChannelsHandler)
+	router.POST("/v1/membership/:userid", handler.PostMembershipHandler)
+	router.DELETE("/v1/membership/:userid", handler.DeleteMembershipHandler)
+	router.GET("/v1/channel/:userid", handler.GetChannelHandler)
+	router.POST("/v1/channel/:userid", handler.PostChannelHandler)
+	router.PUT("/v1/channel/:userid", handler.PutChannelHandler)
+	router.DELETE("/v1/channel/:userid", handler.DeleteChannelHandler)
+	// -- Invites into channels, that let users join them (even private ones) with a token
+	router.GET("/v1/invites/:userid", handler.GetInvitesHandler)
+	router.POST("/v1/invites/:userid", handler.PostInviteHandler)
+	router.DELETE("/v1/invites/:userid", handler.DeleteInviteHandler)
+	// -- Scheduled messages: messages that are sent into a conversation at a later time
+	router.GET("/v1/scheduled/:userid", handler.GetScheduledHandler)
+	router.POST("/v1/scheduled/:userid", handler.PostScheduledHandler)
+	router.PUT("/v1/scheduled/:userid", handler.PutScheduledHandler)
+	router.DELETE("/v1/scheduled/:userid", handler.DeleteScheduledHandler)
+	// -- Admin endpoints: only the users configured as admins of the workspace (see config.Admins) can use these
+	router.GET("/v1/admin/retention/:userid", handler.GetRetentionHandler)
+	router.PUT("/v1/admin/retention/:userid", handler.PutRetentionHandler)
+	router.GET("/v1/admin/cache/:userid", handler.GetCacheHandler)
+	router.GET("/v1/admin/users/:userid", handler.GetAdminUsersHandler)
+	router.GET("/v1/admin/conversations/:userid", handler.GetAdminConversationsHandler)
+	router.DELETE("/v1/admin/message/:userid", handler.DeleteAdminMessageHandler)
+	router.PUT("/v1/admin/suspension/:userid", handler.PutSuspensionHandler)
+	router.DELETE("/v1/admin/suspension/:userid", handler.DeleteSuspensionHandler)
+	router.GET("/v1/admin/moderation/:userid", handler.GetModerationHandler)
 
 	// -- Start the server, and listen on the port provided in the config
 	fmt.Printf("HTTP Server listening on port %d\n", config.GetConfig().HttpServerPort)
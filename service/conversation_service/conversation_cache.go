@@ -0,0 +1,198 @@
+package conversation_service
+
+import (
+	"../../config"
+	"../message_service"
+	"container/list"
+	"sync"
+	"time"
+)
+
+/**************************************************************************
+* C A C H E
+**************************************************************************/
+
+/*
+Loading a conversation means reading its snapshot and replaying its log, on every request. Since the same (hot) conversations
+are loaded over and over, we keep the most recently used conversations, already decoded, in an in-memory LRU cache.
+
+-- Limits: the cache is bounded by ConversationCacheSize (number of conversations) and ConversationCacheMaxBytes (estimated memory) in the config.
+-- -- A ConversationCacheSize of 0 turns the cache off. A ConversationCacheMaxBytes of 0 means there is no memory limit.
+-- -- When the cache goes over a limit, the least recently used conversations are evicted.
+-- Write-through: every time a change to a conversation is recorded in its log, the cache is updated with the new state.
+-- Invalidation: a copy of the conversation that doesn't have all the events of its log (e.g. its log was rewritten since it was loaded)
+-- doesn't have the right state, so the conversation is dropped from the cache instead.
+-- The cache always hands out copies, so callers can change the conversation they get without touching the cached one.
+*/
+
+// CacheStats: Metrics about how well the cache is doing
+type CacheStats struct {
+	Hits          int
+	Misses        int
+	Evictions     int
+	Invalidations int
+	Entries       int
+	Bytes         int
+}
+
+// A single conversation in the cache
+type cacheEntry struct {
+	key   string
+	conv  *Conversation
+	bytes int
+}
+
+var cacheList *list.List = list.New() // most recently used at the front
+var cacheItems map[string]*list.Element = make(map[string]*list.Element)
+var cacheBytes int
+var cacheStats CacheStats
+var cacheLock sync.Mutex
+
+// Get the metrics of the conversation cache
+func GetCacheStats() CacheStats {
+	cacheLock.Lock()
+	defer cacheLock.Unlock()
+
+	stats := cacheStats
+	stats.Entries = cacheList.Len()
+	stats.Bytes = cacheBytes
+	return stats
+}
+
+// Removes all the conversations from the cache, e.g. after they were rebuilt in the database
+func PurgeCache() {
+	cacheLock.Lock()
+	defer cacheLock.Unlock()
+
+	cacheList.Init()
+	cacheItems = make(map[string]*list.Element)
+	cacheBytes = 0
+}
+
+/**************************************************************************
+* H E L P E R S
+**************************************************************************/
+
+// Given a conversation key, returns a copy of the cached conversation, if there is one
+func cacheGet(key string) (*Conversation, bool) {
+	cacheLock.Lock()
+	defer cacheLock.Unlock()
+
+	if config.GetConfig().ConversationCacheSize <= 0 {
+		return nil, false
+	}
+	element, exists := cacheItems[key]
+	if !exists {
+		cacheStats.Misses++
+		return nil, false
+	}
+	cacheStats.Hits++
+	cacheList.MoveToFront(element)
+	c := element.Value.(*cacheEntry).conv.copy()
+	c.loaded = true
+	return c, true
+}
+
+// Given a conversation, puts a copy of it in the cache, as long as it has all the events of its log
+func cachePut(c *Conversation) {
+	// Hold the lock of the log too, so no event can be appended between checking the log and updating the cache
+	key := c.UniqueKey()
+	l := lockLog(key)
+	defer l.Unlock()
+	cacheLock.Lock()
+	defer cacheLock.Unlock()
+
+	if config.GetConfig().ConversationCacheSize <= 0 {
+		return
+	}
+
+	// If the log has events that this conversation doesn't, caching it would serve an old state
+	if l.known && l.lastSequence != c.LogSequence {
+		cacheRemove(key)
+		return
+	}
+	// Never replace a cached conversation with an older one
+	if element, exists := cacheItems[key]; exists {
+		if element.Value.(*cacheEntry).conv.LogSequence > c.LogSequence {
+			return
+		}
+		cacheRemoveElement(element)
+	}
+
+	entry := &cacheEntry{key: key, conv: c.copy(), bytes: c.estimateBytes()}
+	cacheItems[key] = cacheList.PushFront(entry)
+	cacheBytes += entry.bytes
+
+	// Evict the least recently used conversations until we're back within the limits
+	maxBytes := config.GetConfig().ConversationCacheMaxBytes
+	for cacheList.Len() > config.GetConfig().ConversationCacheSize || (maxBytes > 0 && cacheBytes > maxBytes) {
+		cacheRemoveElement(cacheList.Back())
+		cacheStats.Evictions++
+	}
+}
+
+// Given a conversation key, drops the conversation from the cache because it changed. The caller should be holding the cache lock.
+func cacheRemove(key string) {
+	if element, exists := cacheItems[key]; exists {
+		cacheRemoveElement(element)
+		cacheStats.Invalidations++
+	}
+}
+
+// Removes a single element from the cache. The caller should be holding the cache lock.
+func cacheRemoveElement(element *list.Element) {
+	entry := element.Value.(*cacheEntry)
+	cacheList.Remove(element)
+	delete(cacheItems, entry.key)
+	cacheBytes -= entry.bytes
+}
+
+// Given a conversation, returns a copy of it that doesn't share anything (members, messages, roles, settings etc.) with it
+func (c *Conversation) copy() *Conversation {
+	var dup Conversation = *c
+	dup.UserIds = append([]string(nil), c.UserIds...)
+	dup.Messages = append([]message_service.Message(nil), c.Messages...)
+	for i := range dup.Messages {
+		dup.Messages[i].TimestampExpires = copyTime(dup.Messages[i].TimestampExpires)
+		if reference := dup.Messages[i].ForwardedFrom; reference != nil {
+			var referenceDup message_service.ForwardReference = *reference
+			referenceDup.UserIds = append([]string(nil), reference.UserIds...)
+			dup.Messages[i].ForwardedFrom = &referenceDup
+		}
+	}
+	dup.PinnedMessages = append([]PinnedMessage(nil), c.PinnedMessages...)
+	if c.Roles != nil {
+		dup.Roles = make(map[string]Role, len(c.Roles))
+		for userId, role := range c.Roles {
+			dup.Roles[userId] = role
+		}
+	}
+	if c.Settings != nil {
+		var settings MemberSettings = *c.Settings
+		settings.MutedUntil = copyTime(c.Settings.MutedUntil)
+		dup.Settings = &settings
+	}
+	return &dup
+}
+
+// Given a time that might not be set, returns a copy of it
+func copyTime(t *time.Time) *time.Time {
+	if t == nil {
+		return nil
+	}
+	var dup time.Time = *t
+	return &dup
+}
+
+// Given a conversation, roughly estimates how much memory it takes
+func (c *Conversation) estimateBytes() int {
+	// A rough fixed cost for the struct itself and for each message, plus the strings they hold
+	bytes := 200
+	for _, userId := range c.UserIds {
+		bytes += len(userId)
+	}
+	for _, m := range c.Messages {
+		bytes += 150 + len(m.Content) + len(m.ContentHtml) + len(m.From) + len(m.Format)
+	}
+	return bytes
+}
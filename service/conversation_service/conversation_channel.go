@@ -0,0 +1,468 @@
+package conversation_service
+
+import (
+	"fmt"
+	"github.com/teejays/gofiledb"
+	"log"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+/**************************************************************************
+* C H A N N E L S
+**************************************************************************/
+
+/*
+A channel is a conversation with a name, that any user can find, join and leave by themselves.
+
+-- A channel is stored just like any other conversation (a snapshot, and a message log), except that its key is made of its name
+-- ("channel_<name>") instead of the user ids of its members, so its members can change. Joining and leaving are recorded in the message log
+-- with a members event, and announced in the channel with a system message.
+-- Whoever creates a channel is its owner (see conversation_roles.go). The owner and admins can change its topic, and add or remove members.
+-- -- Admins can only remove plain members, and nobody can remove the owner.
+-- When the owner leaves, the ownership passes to an admin, or to the member who joined first if there is none.
+-- When somebody joins a channel that everyone has left, they become its owner.
+-- A channel can be private: it isn't listed, and it can only be joined with an invite (see conversation_invite.go).
+
+Channel: A channel, as it is listed for users who are looking for one.
+-- Structure:
+-- -- Name (string): the unique name of the channel: lowercase letters, digits, '-' and '_'
+-- -- Topic (string): what the channel is about
+-- -- MemberCount (int): how many members the channel has
+-- -- Private (bool): whether the channel can only be joined with an invite. Private channels aren't listed.
+-- -- TimestampCreated (time): when the channel was created
+
+So that listing and searching channels doesn't load every one of them, we keep an index of all the channels. Just like the buddies map,
+the index is kept in-memory, with a copy saved in the database.
+*/
+
+// Define the structure for a Channel
+type Channel struct {
+	Name             string
+	Topic            string
+	MemberCount      int
+	Private          bool
+	TimestampCreated time.Time
+}
+
+// Limits on channels
+const (
+	maxTopicLength int = 250
+)
+
+// Channel names are 2 to 50 characters long, and start with a letter or a digit
+var channelNameRegex *regexp.Regexp = regexp.MustCompile(`^[a-z0-9][a-z0-9_-]{1,49}$`)
+
+// channelIndex maps the name of every channel to its listing
+var channelIndex map[string]*Channel
+var channelLock sync.Mutex
+var channelCollectionName string = "channels" // name of the collection when storing the index in the db
+
+// Given a name and a topic, creates a new (public or private) channel on behalf of the provided user, who becomes its first member and owner
+func CreateChannel(name, topic, by string, private bool) (*Conversation, error) {
+	name = processChannelName(name)
+	err := validateChannelName(name)
+	if err != nil {
+		return nil, err
+	}
+	topic = strings.TrimSpace(topic)
+	err = validateTopic(topic)
+	if err != nil {
+		return nil, err
+	}
+
+	// Claim the name right away, so two users can't create the same channel at the same time
+	channelLock.Lock()
+	_, exists := channelIndex[name]
+	if !exists {
+		channelIndex[name] = &Channel{Name: name}
+	}
+	channelLock.Unlock()
+	if exists {
+		return nil, fmt.Errorf("Channel %s already exists", name)
+	}
+	// If the channel can't be created, give the name back, so the channel can be created again
+	releaseName := func() {
+		channelLock.Lock()
+		delete(channelIndex, name)
+		channelLock.Unlock()
+	}
+
+	var c *Conversation = &Conversation{
+		UserIds:          []string{by},
+		ChannelName:      name,
+		Topic:            topic,
+		Private:          private,
+		CreatedBy:        by,
+		TimestampCreated: time.Now(),
+	}
+	err = c.Save()
+	if err != nil {
+		releaseName()
+		return nil, err
+	}
+	// A channel that isn't in the index can't be found, so if it can't be listed, it's undone
+	err = c.updateChannelIndex()
+	if err != nil {
+		eraseErr := c.Erase()
+		if eraseErr != nil {
+			log.Printf("Could not undo the creation of channel %s: %s", name, eraseErr)
+		}
+		releaseName()
+		return nil, err
+	}
+	return c, c.announce(by, "created the channel")
+}
+
+// Given the name of a channel, load and return the channel
+func GetChannel(name string) (*Conversation, error) {
+	name = processChannelName(name)
+
+	channelLock.Lock()
+	_, exists := channelIndex[name]
+	channelLock.Unlock()
+	if !exists {
+		return nil, fmt.Errorf("No channel found with name %s", name)
+	}
+	return getConversation(Conversation{ChannelName: name})
+}
+
+// Given a query, get the public channels whose name or topic contain it (all of them if the query is empty), the ones with the most members first
+func SearchChannels(query string) []Channel {
+	query = strings.ToLower(strings.TrimSpace(query))
+
+	channelLock.Lock()
+	defer channelLock.Unlock()
+
+	var channels []Channel = []Channel{}
+	for _, channel := range channelIndex {
+		if channel.Private {
+			continue
+		}
+		if strings.Contains(channel.Name, query) || strings.Contains(strings.ToLower(channel.Topic), query) {
+			channels = append(channels, *channel)
+		}
+	}
+	sort.Slice(channels, func(i, j int) bool {
+		if channels[i].MemberCount == channels[j].MemberCount {
+			return channels[i].Name < channels[j].Name
+		}
+		return channels[i].MemberCount > channels[j].MemberCount
+	})
+	return channels
+}
+
+// Get all the channels
+func GetAllChannels() ([]*Conversation, error) {
+	channelLock.Lock()
+	var names []string
+	for name := range channelIndex {
+		names = append(names, name)
+	}
+	channelLock.Unlock()
+	sort.Strings(names)
+
+	var channels []*Conversation = []*Conversation{}
+	for _, name := range names {
+		c, err := getConversation(Conversation{ChannelName: name})
+		if err != nil {
+			return nil, err
+		}
+		channels = append(channels, c)
+	}
+	return channels, nil
+}
+
+// Given a user id, get all the channels that the user is a member of
+func GetChannelsOf(userId string) ([]*Conversation, error) {
+	all, err := GetAllChannels()
+	if err != nil {
+		return nil, err
+	}
+	var channels []*Conversation = []*Conversation{}
+	for _, c := range all {
+		if c.IsMember(userId) {
+			channels = append(channels, c)
+		}
+	}
+	return channels, nil
+}
+
+// Given a public channel, adds the provided user to its members
+func (c *Conversation) Join(userId string) error {
+	if c.Private {
+		return fmt.Errorf("Channel %s is private, it can only be joined with an invite", c.ChannelName)
+	}
+	return c.join(userId)
+}
+
+// Given a channel, removes the provided user from its members
+func (c *Conversation) Leave(userId string) error {
+	err := c.RemoveMember(userId)
+	if err != nil {
+		return err
+	}
+	return c.announce(userId, "left the channel")
+}
+
+// Given a channel, removes the provided user from its members without announcing it, e.g. because they deleted their account
+func (c *Conversation) RemoveMember(userId string) error {
+	if c.ChannelName == "" {
+		return fmt.Errorf("Only channels can be left")
+	}
+
+	err := c.change(func() error {
+		return c.dropMember(userId)
+	})
+	if err != nil {
+		return err
+	}
+	return c.forgetMember(userId)
+}
+
+// Given a channel, adds the provided user to its members on behalf of the provided member, who needs to be allowed to manage its members
+func (c *Conversation) AddMember(by, userId string) error {
+	if c.ChannelName == "" {
+		return fmt.Errorf("Only channels can have members added")
+	}
+
+	err := c.change(func() error {
+		err := c.CheckPermission(by, PermissionManageMembers)
+		if err != nil {
+			return err
+		}
+		return c.addMember(userId)
+	})
+	if err != nil {
+		return err
+	}
+	return c.announce(by, fmt.Sprintf("added %s to the channel", userId))
+}
+
+// Given a channel, removes the provided member from it on behalf of the provided member, who needs to be allowed to manage its members.
+// Admins can only remove plain members, and the owner can't be removed.
+func (c *Conversation) KickMember(by, userId string) error {
+	if c.ChannelName == "" {
+		return fmt.Errorf("Only channels can have members removed")
+	}
+	if userId == by {
+		return fmt.Errorf("Members can leave a channel, but not remove themselves from it")
+	}
+
+	err := c.change(func() error {
+		err := c.CheckPermission(by, PermissionManageMembers)
+		if err != nil {
+			return err
+		}
+		role, err := c.GetRole(userId)
+		if err != nil {
+			return err
+		}
+		if role == RoleOwner {
+			return fmt.Errorf("The owner of a channel can't be removed from it")
+		}
+		if byRole, _ := c.GetRole(by); role == RoleAdmin && byRole != RoleOwner {
+			return fmt.Errorf("Only the owner of the channel can remove an admin")
+		}
+		return c.dropMember(userId)
+	})
+	if err != nil {
+		return err
+	}
+	err = c.forgetMember(userId)
+	if err != nil {
+		return err
+	}
+	return c.announce(by, fmt.Sprintf("removed %s from the channel", userId))
+}
+
+// Given a channel, sets its topic on behalf of the provided user, and announces it
+func (c *Conversation) SetTopic(by, topic string) error {
+	if c.ChannelName == "" {
+		return fmt.Errorf("Only channels have a topic")
+	}
+	err := c.CheckPermission(by, PermissionUpdateInfo)
+	if err != nil {
+		return err
+	}
+	topic = strings.TrimSpace(topic)
+	err = validateTopic(topic)
+	if err != nil {
+		return err
+	}
+
+	var changed bool
+	err = c.change(func() error {
+		changed = topic != c.Topic
+		if !changed {
+			return nil
+		}
+
+		err := c.ensureInLog()
+		if err != nil {
+			return err
+		}
+		c.Topic = topic
+		err = c.persistInfo()
+		if err != nil {
+			return err
+		}
+		return c.updateChannelIndex()
+	})
+	if err != nil || !changed {
+		return err
+	}
+	return c.announce(by, describeChange("topic", topic, true))
+}
+
+// Upon start of the application, this function loads the channel index into memory from the db
+func LoadChannelsToMemory() error {
+	channelLock.Lock()
+	defer channelLock.Unlock()
+
+	db := gofiledb.GetClient()
+	exists, err := db.GetStructIfExists(channelCollectionName, "channel_index", &channelIndex)
+	// Even if the index can't be read, channels need an index to update. Rebuilding the snapshots (see RebuildSnapshots) fills it in again.
+	if err != nil || !exists {
+		channelIndex = make(map[string]*Channel)
+	}
+	return err
+}
+
+/**************************************************************************
+* H E L P E R S
+**************************************************************************/
+
+// Given a channel, adds the provided user to its members, whether the channel is public or not
+func (c *Conversation) join(userId string) error {
+	if c.ChannelName == "" {
+		return fmt.Errorf("Only channels can be joined")
+	}
+
+	// The members may have changed since the channel was loaded, so the change is made on its latest state (see conversation_log.go)
+	err := c.change(func() error {
+		return c.addMember(userId)
+	})
+	if err != nil {
+		return err
+	}
+	return c.announce(userId, "joined the channel")
+}
+
+// Given a channel, adds the provided user to its members. It should be called from a change (see conversation_log.go).
+func (c *Conversation) addMember(userId string) error {
+	if c.IsMember(userId) {
+		return fmt.Errorf("User %s is already a member of channel %s", userId, c.ChannelName)
+	}
+
+	err := c.ensureInLog()
+	if err != nil {
+		return err
+	}
+	// Somebody has to be able to manage a channel that everyone had left
+	if len(c.UserIds) == 0 {
+		c.Roles = map[string]Role{userId: RoleOwner}
+	}
+	c.UserIds = append(append([]string(nil), c.UserIds...), userId)
+	return c.persistMembers()
+}
+
+// Given a channel, removes the provided user from its members. If they owned the channel, the ownership passes on (see successor).
+// It should be called from a change (see conversation_log.go).
+func (c *Conversation) dropMember(userId string) error {
+	role, err := c.GetRole(userId)
+	if err != nil {
+		return err
+	}
+
+	err = c.ensureInLog()
+	if err != nil {
+		return err
+	}
+	var members []string
+	for _, memberId := range c.UserIds {
+		if memberId != userId {
+			members = append(members, memberId)
+		}
+	}
+	var changes map[string]Role = map[string]Role{userId: RoleMember}
+	if role == RoleOwner && len(members) > 0 {
+		changes[c.successor(members)] = RoleOwner
+	}
+	c.Roles = c.rolesWith(changes)
+	c.UserIds = members
+	return c.persistMembers()
+}
+
+// Given a channel, removes it from the inbox of a user who isn't a member anymore
+func (c *Conversation) forgetMember(userId string) error {
+	inboxLock.Lock()
+	defer inboxLock.Unlock()
+	return c.removeInboxEntry(userId)
+}
+
+// Given a channel, record a change to its members. The members (and their roles) should already be set on the conversation.
+func (c *Conversation) persistMembers() error {
+	var members Conversation = Conversation{UserIds: c.UserIds, Roles: c.Roles}
+	err := c.persistEvent(messageEvent{Type: eventTypeMembers, Conversation: &members})
+	if err != nil {
+		return err
+	}
+	return c.updateChannelIndex()
+}
+
+// Given a channel, and the members it has left after its owner leaves, picks who owns it next: an admin, or the member who joined first
+func (c *Conversation) successor(members []string) string {
+	for _, memberId := range members {
+		if c.Roles[memberId] == RoleAdmin {
+			return memberId
+		}
+	}
+	return members[0]
+}
+
+// Given a channel, updates its listing in the channel index
+func (c *Conversation) updateChannelIndex() error {
+	channelLock.Lock()
+	defer channelLock.Unlock()
+
+	channelIndex[c.ChannelName] = &Channel{
+		Name:             c.ChannelName,
+		Topic:            c.Topic,
+		MemberCount:      len(c.UserIds),
+		Private:          c.Private,
+		TimestampCreated: c.TimestampCreated,
+	}
+	db := gofiledb.GetClient()
+	return db.SetStruct(channelCollectionName, "channel_index", &channelIndex)
+}
+
+// Given the name of a channel, standardizes it by cleaning it up
+func processChannelName(name string) string {
+	return strings.ToLower(strings.TrimSpace(strings.TrimPrefix(strings.TrimSpace(name), "#")))
+}
+
+// Given a (processed) channel name, it ensures that the name is valid
+func validateChannelName(name string) error {
+	if !channelNameRegex.MatchString(name) {
+		return fmt.Errorf("Channel validation failed: names should be 2 to 50 characters long, made of lowercase letters, digits, '-' and '_', starting with a letter or a digit")
+	}
+	return nil
+}
+
+// Given a topic, it ensures that the topic is valid
+func validateTopic(topic string) error {
+	if len(topic) > maxTopicLength {
+		return fmt.Errorf("Channel validation failed: topic should be at most %d characters", maxTopicLength)
+	}
+	return nil
+}
+
+// Creates the unique key for a channel with the given name
+// Follows the simple pattern: "channel_<name>"
+func uniqueChannelKey(name string) string {
+	return "channel_" + name
+}
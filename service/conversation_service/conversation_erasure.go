@@ -0,0 +1,126 @@
+package conversation_service
+
+import (
+	"../message_service"
+	"github.com/teejays/gofiledb"
+	"os"
+)
+
+/**************************************************************************
+* E R A S U R E
+**************************************************************************/
+
+/*
+When a user deletes their account, what they leave behind in conversations is erased:
+-- Conversations that other users are still in are kept, but every message the user sent is attributed to DeletedUserId instead.
+-- Conversations that nobody else is in anymore are erased completely: their message log is removed, and their snapshot is emptied.
+-- Messages forwarded from the user, or from its conversations, into other conversations lose their reference to the user (and to the original conversation).
+
+In every case the message log is rewritten as well, since it's the source of truth and it carries the messages too.
+*/
+
+// The sender that messages are attributed to, once their sender has deleted their account
+const DeletedUserId string = "deleted-user"
+
+// Given a conversation, attributes all the messages sent (and pinned) by the provided user, and the conversation itself if the user created it,
+// to DeletedUserId instead, both in the conversation and in its log
+func (c *Conversation) AnonymizeSender(userId string) error {
+	anonymize := func(m *message_service.Message) {
+		if m.From == userId {
+			m.From = DeletedUserId
+		}
+		// Messages forwarded from the user (see conversation_forward.go) shouldn't point back to it either
+		if m.ForwardedFrom != nil && isForwardedFrom(m.ForwardedFrom, userId) {
+			var reference message_service.ForwardReference = *m.ForwardedFrom
+			if reference.From == userId {
+				reference.From = DeletedUserId
+			}
+			reference.ConversationKey = ""
+			reference.UserIds = nil
+			m.ForwardedFrom = &reference
+		}
+	}
+	anonymizeState := func(state *Conversation) {
+		for i := 0; i < len(state.PinnedMessages); i++ {
+			if state.PinnedMessages[i].PinnedBy == userId {
+				state.PinnedMessages[i].PinnedBy = DeletedUserId
+			}
+		}
+		if state.CreatedBy == userId {
+			state.CreatedBy = DeletedUserId
+		}
+		state.Roles = renameRole(state.Roles, userId, DeletedUserId)
+		// The members of a channel have come and gone over time (see conversation_channel.go), so the user can still be in its older members
+		if c.ChannelName != "" {
+			state.UserIds = renameMember(state.UserIds, userId, DeletedUserId)
+		}
+	}
+	return c.change(func() error {
+		err := c.ensureInLog()
+		if err != nil {
+			return err
+		}
+		for i := 0; i < len(c.Messages); i++ {
+			anonymize(&c.Messages[i])
+		}
+		anonymizeState(c)
+
+		// Rewriting changes where the events are in the log, so we need a new snapshot that points to the right place
+		offset, err := rewriteLog(c.UniqueKey(), c.LogSequence, anonymize, anonymizeState)
+		if err != nil {
+			return err
+		}
+		c.LogOffset = offset
+		return c.Save()
+	})
+}
+
+// Given a conversation, tells whether the provided user sent any of its messages
+func (c *Conversation) HasMessagesFrom(userId string) bool {
+	for _, m := range c.Messages {
+		if m.From == userId {
+			return true
+		}
+	}
+	return false
+}
+
+// Given a conversation, erases it completely: its messages, its message log, and its settings
+func (c *Conversation) Erase() error {
+	key := c.UniqueKey()
+
+	// Remove the message log
+	l := lockLog(key)
+	err := os.Remove(logFilePath(key))
+	if err == nil || os.IsNotExist(err) {
+		l.lastSequence, l.known = 0, true
+	}
+	l.Unlock()
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+
+	// The database can't delete documents, so replace the snapshot with an empty conversation that doesn't point to any log
+	db := gofiledb.GetClient()
+	err = db.SetStruct(conversationCollectionName, key, &Conversation{UserIds: c.UserIds})
+	if err != nil {
+		return err
+	}
+	cacheLock.Lock()
+	cacheRemove(key)
+	cacheLock.Unlock()
+	err = c.removeFromInbox()
+	if err != nil {
+		return err
+	}
+	*c = Conversation{UserIds: c.UserIds}
+
+	// An empty conversation has nothing that can expire
+	ttlIndexLock.Lock()
+	defer ttlIndexLock.Unlock()
+	if _, exists := ttlIndex[key]; !exists {
+		return nil
+	}
+	delete(ttlIndex, key)
+	return saveTtlIndex()
+}
@@ -0,0 +1,81 @@
+package conversation_service
+
+import (
+	"../message_service"
+	"fmt"
+	"time"
+)
+
+/**************************************************************************
+* F O R W A R D I N G
+**************************************************************************/
+
+/*
+A member of a conversation can forward one of its messages into another conversation it is a part of. The forwarded message is a new
+message, sent by the user who forwards it, with the same content and format, and a reference (ForwardedFrom) to where it was first sent.
+-- Only messages that are still in the conversation can be forwarded, so deleted and expired messages can't be brought back.
+-- Forwarded messages can't be edited, since they should keep saying what the original said.
+-- When the original sender deletes their account, the references to them are anonymized too (see AnonymizeSender).
+*/
+
+// Given a conversation, get a new message, from the provided user, that forwards the message with the provided id
+func (c *Conversation) ForwardMessage(messageId int, forwarder string, now time.Time) (message_service.Message, error) {
+	original := c.findMessage(messageId)
+	if original == nil {
+		return message_service.Message{}, fmt.Errorf("No message found in the conversation with message id %d", messageId)
+	}
+	if original.System {
+		return message_service.Message{}, fmt.Errorf("System messages cannot be forwarded")
+	}
+
+	// A message that was already forwarded keeps pointing to where it was first sent
+	var reference message_service.ForwardReference = message_service.ForwardReference{
+		From:             original.From,
+		ConversationKey:  c.UniqueKey(),
+		MessageId:        original.Id,
+		TimestampCreated: original.TimestampCreated,
+	}
+	if c.ChannelName == "" {
+		reference.UserIds = append([]string{}, c.UserIds...)
+	}
+	if original.ForwardedFrom != nil {
+		reference = *original.ForwardedFrom
+	}
+
+	var m message_service.Message = message_service.Message{
+		Content:          original.Content,
+		From:             forwarder,
+		Format:           original.Format,
+		TimestampCreated: now,
+		TimestampUpdated: now,
+		ForwardedFrom:    &reference,
+	}
+	return m, nil
+}
+
+// Given a conversation, tells whether it has messages forwarded from the provided user, or from a conversation the user is a part of
+func (c *Conversation) HasForwardsFrom(userId string) bool {
+	for _, m := range c.Messages {
+		if m.ForwardedFrom != nil && isForwardedFrom(m.ForwardedFrom, userId) {
+			return true
+		}
+	}
+	return false
+}
+
+/**************************************************************************
+* H E L P E R S
+**************************************************************************/
+
+// Given a forward reference, tells whether it refers to the provided user, either as the original sender or as a member of the original conversation
+func isForwardedFrom(reference *message_service.ForwardReference, userId string) bool {
+	if reference.From == userId {
+		return true
+	}
+	for _, memberId := range reference.UserIds {
+		if memberId == userId {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,473 @@
+package conversation_service
+
+import (
+	"../message_service"
+	"fmt"
+	"github.com/teejays/gofiledb"
+	"reflect"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+/**************************************************************************
+* I N B O X
+**************************************************************************/
+
+/*
+Listing the conversations of a user by loading every one of them gets slow as conversations grow. Instead, we maintain an index,
+per user, of a short summary of every conversation they are a part of (their inbox). Whenever an event is added to the log of a
+conversation, the summary is updated from that event alone, and only for the members whose summary it changes (see updateInbox).
+
+InboxEntry: A summary of a conversation, as one of its members sees it.
+-- Structure:
+-- -- ConversationKey (string): the unique key of the conversation
+-- -- UserIds ([]string): the user ids of the members of the conversation
+-- -- ChannelName (string): the name of the channel, if the conversation is a channel (see conversation_channel.go)
+-- -- LastMessage (MessagePreview): a preview of the last message in the conversation, if it has any
+-- -- TimestampLastActivity (time): when the last message was sent
+-- -- UnreadCount (int): how many messages, sent by the other members, the user hasn't read yet. System messages don't count.
+-- -- LastReadMessageId (int): the id of the last message the user has read. Sending a message marks everything before it as read.
+-- -- Settings (MemberSettings): how the user has set up the conversation for themselves
+
+MemberSettings: The settings of a conversation that only apply to one of its members.
+-- Structure:
+-- -- MutedUntil (time): until when the user doesn't want to be notified about the conversation, if they muted it
+-- -- Archived (bool): whether the conversation is moved out of the main list of conversations of the user
+-- -- Pinned (bool): whether the conversation is kept at the top of the list of conversations of the user
+
+MessagePreview: A short version of a message.
+-- Structure:
+-- -- Id (int)
+-- -- From (string)
+-- -- Preview (string): the content of the message on a single line, cut at previewLength characters
+-- -- TimestampCreated (time)
+
+Just like the buddies map, the index is kept in-memory, with a copy saved in the database. The inbox of every user is saved as its own record
+("inbox_<userid>"), so a change to a conversation only writes the inboxes of its members, along with a list of the users who have an inbox.
+*/
+
+// Define the structure for an InboxEntry
+type InboxEntry struct {
+	ConversationKey       string
+	UserIds               []string
+	ChannelName           string          `json:",omitempty"`
+	LastMessage           *MessagePreview `json:",omitempty"`
+	TimestampLastActivity time.Time
+	UnreadCount           int
+	LastReadMessageId     int
+	Settings              MemberSettings
+}
+
+// Define the structure for MemberSettings
+type MemberSettings struct {
+	MutedUntil *time.Time `json:",omitempty"`
+	Archived   bool
+	Pinned     bool
+}
+
+// Define the structure for a MessagePreview
+type MessagePreview struct {
+	Id               int
+	From             string
+	Preview          string
+	TimestampCreated time.Time
+}
+
+// How many characters of a message are shown in its preview
+const previewLength int = 100
+
+// inboxIndex maps a user id to the inbox entries of that user, by conversation key
+var inboxIndex map[string]map[string]*InboxEntry
+
+// inboxUserIds is the set of users whose inbox is saved in the db, so the inboxes can be found when the app starts
+var inboxUserIds map[string]bool
+var inboxLock sync.Mutex
+var inboxCollectionName string = "inbox" // name of the collection when storing the index in the db
+
+// Given a user id, get the inbox of that user, with the most recently active conversations first
+func GetInbox(userId string) []InboxEntry {
+	inboxLock.Lock()
+	defer inboxLock.Unlock()
+
+	var inbox []InboxEntry = []InboxEntry{}
+	for _, entry := range inboxIndex[userId] {
+		inbox = append(inbox, *entry)
+	}
+	sort.Slice(inbox, func(i, j int) bool {
+		if inbox[i].TimestampLastActivity.Equal(inbox[j].TimestampLastActivity) {
+			return inbox[i].ConversationKey < inbox[j].ConversationKey
+		}
+		return inbox[i].TimestampLastActivity.After(inbox[j].TimestampLastActivity)
+	})
+	return inbox
+}
+
+// Given a conversation, marks the messages up to the provided message id as read by the provided user. A message id of 0 marks all of them as read.
+func (c *Conversation) MarkRead(userId string, messageId int) error {
+	if messageId <= 0 || messageId > c.LastMessageId {
+		messageId = c.LastMessageId
+	}
+
+	inboxLock.Lock()
+	defer inboxLock.Unlock()
+
+	entry := c.inboxEntry(userId)
+	if entry == nil {
+		return nil
+	}
+	// Reading never goes backwards
+	if messageId > entry.LastReadMessageId {
+		entry.LastReadMessageId = messageId
+	}
+	c.summarize(userId, entry)
+	return saveInbox(userId)
+}
+
+// Given a conversation, get the settings that the provided user has for it. A mute that is over doesn't show up anymore.
+func (c *Conversation) GetMemberSettings(userId string, now time.Time) MemberSettings {
+	inboxLock.Lock()
+	defer inboxLock.Unlock()
+
+	entry := c.inboxEntry(userId)
+	if entry == nil {
+		return MemberSettings{}
+	}
+	var settings MemberSettings = entry.Settings
+	if !settings.IsMuted(now) {
+		settings.MutedUntil = nil
+	}
+	return settings
+}
+
+// Given a conversation, set the settings that the provided user has for it
+func (c *Conversation) SetMemberSettings(userId string, settings MemberSettings) error {
+	inboxLock.Lock()
+	defer inboxLock.Unlock()
+
+	// The settings live in the inbox of the user, which only lists conversations that have had a message
+	entry := c.inboxEntry(userId)
+	if entry == nil {
+		return fmt.Errorf("No messages in the conversation yet")
+	}
+	entry.Settings = settings
+	return saveInbox(userId)
+}
+
+// Given the settings of a member, tells whether the conversation is muted at the provided time
+func (s MemberSettings) IsMuted(now time.Time) bool {
+	return s.MutedUntil != nil && now.Before(*s.MutedUntil)
+}
+
+// Given a user id, removes the whole inbox of that user, e.g. because the user deleted their account
+func ForgetInbox(userId string) error {
+	inboxLock.Lock()
+	defer inboxLock.Unlock()
+
+	if _, exists := inboxIndex[userId]; !exists {
+		return nil
+	}
+	delete(inboxIndex, userId)
+	return saveInbox(userId)
+}
+
+// Upon start of the application, this function loads the inbox index into memory from the db.
+// It tells whether there was an index to load, since conversations from before the index existed need to be added to it (see UpdateInbox).
+func LoadInboxToMemory() (bool, error) {
+	inboxLock.Lock()
+	defer inboxLock.Unlock()
+
+	// Even if the index can't be read, conversations need an index to update
+	inboxIndex = make(map[string]map[string]*InboxEntry)
+	inboxUserIds = make(map[string]bool)
+
+	db := gofiledb.GetClient()
+	var userIds []string
+	exists, err := db.GetStructIfExists(inboxCollectionName, "inbox_users", &userIds)
+	if err != nil {
+		return false, err
+	}
+	if !exists {
+		return false, nil
+	}
+	for _, userId := range userIds {
+		var entries map[string]*InboxEntry
+		_, err = db.GetStructIfExists(inboxCollectionName, inboxKey(userId), &entries)
+		if err != nil {
+			return true, err
+		}
+		inboxUserIds[userId] = true
+		if len(entries) > 0 {
+			inboxIndex[userId] = entries
+		}
+	}
+	return true, nil
+}
+
+// Given a conversation, updates its summary in the inbox of each of its members, going through all of its messages.
+// Only the inboxes where the summary changed are saved.
+func (c *Conversation) UpdateInbox() error {
+	// A conversation that never had a message isn't worth listing
+	if c.LastMessageId == 0 {
+		return nil
+	}
+
+	inboxLock.Lock()
+	defer inboxLock.Unlock()
+
+	var changed []string
+	for _, userId := range c.UserIds {
+		entry := c.inboxEntry(userId)
+		if entry == nil {
+			entry = c.addInboxEntry(userId)
+		}
+		var before InboxEntry = *entry
+		before.UserIds = append([]string{}, entry.UserIds...)
+		c.summarize(userId, entry)
+		if !reflect.DeepEqual(before, *entry) {
+			changed = append(changed, userId)
+		}
+	}
+	return saveInbox(changed...)
+}
+
+/**************************************************************************
+* H E L P E R S
+**************************************************************************/
+
+// Given a conversation, and an event that was just added to its log, updates the summary of the conversation in the inbox of its members.
+// The entries are worked out from the event, without going through the messages again, and only the inboxes where an entry changed are saved.
+func (c *Conversation) updateInbox(e messageEvent) error {
+	// A conversation that never had a message isn't worth listing
+	if c.LastMessageId == 0 {
+		return nil
+	}
+
+	inboxLock.Lock()
+	defer inboxLock.Unlock()
+
+	var changed []string
+	for _, userId := range c.UserIds {
+		entry := c.inboxEntry(userId)
+		if entry == nil || entry.ConversationKey == "" || e.Type == eventTypeCreate {
+			// New to the inbox (or, for a renamed copy, only carried over), so the summary has to be worked out in full
+			if entry == nil {
+				entry = c.addInboxEntry(userId)
+			}
+			c.summarize(userId, entry)
+			changed = append(changed, userId)
+			continue
+		}
+		if c.applyToInboxEntry(userId, entry, e) {
+			changed = append(changed, userId)
+		}
+	}
+	return saveInbox(changed...)
+}
+
+// Given a conversation, and an event that was just added to its log, updates the summary of the conversation for the provided user.
+// It tells whether the summary changed. The caller should be holding the inbox lock.
+func (c *Conversation) applyToInboxEntry(userId string, entry *InboxEntry, e messageEvent) bool {
+	switch e.Type {
+	case eventTypeAdd:
+		m := e.Message
+		entry.LastMessage = newMessagePreview(m)
+		entry.TimestampLastActivity = m.TimestampCreated
+		if m.From == userId {
+			// A user has read everything up to the last message they sent
+			entry.LastReadMessageId = m.Id
+			entry.UnreadCount = 0
+		} else if !m.System && m.Id > entry.LastReadMessageId {
+			entry.UnreadCount++
+		}
+		return true
+
+	case eventTypeEdit:
+		if entry.LastMessage == nil || entry.LastMessage.Id != e.Message.Id {
+			return false
+		}
+		entry.LastMessage = newMessagePreview(e.Message)
+		return true
+
+	case eventTypeDelete:
+		var changed bool
+		m := e.deleted
+		if m.Id > entry.LastReadMessageId && m.From != userId && !m.System && entry.UnreadCount > 0 {
+			entry.UnreadCount--
+			changed = true
+		}
+		if entry.LastMessage != nil && entry.LastMessage.Id == e.MessageId {
+			entry.LastMessage = nil
+			if len(c.Messages) > 0 {
+				last := c.Messages[len(c.Messages)-1]
+				entry.LastMessage = newMessagePreview(last)
+				entry.TimestampLastActivity = last.TimestampCreated
+			}
+			changed = true
+		}
+		return changed
+
+	case eventTypeMembers:
+		if reflect.DeepEqual(entry.UserIds, c.UserIds) {
+			return false
+		}
+		entry.UserIds = c.UserIds
+		return true
+	}
+	return false
+}
+
+// Given a conversation, adds an empty entry for it to the inbox of the provided user. The caller should be holding the inbox lock.
+func (c *Conversation) addInboxEntry(userId string) *InboxEntry {
+	var entry *InboxEntry = &InboxEntry{}
+	if _, exists := inboxIndex[userId]; !exists {
+		inboxIndex[userId] = make(map[string]*InboxEntry)
+	}
+	inboxIndex[userId][c.UniqueKey()] = entry
+	return entry
+}
+
+// Given a conversation, get the entry of the conversation in the inbox of the provided user, if there is one. The caller should be holding the inbox lock.
+func (c *Conversation) inboxEntry(userId string) *InboxEntry {
+	return inboxIndex[userId][c.UniqueKey()]
+}
+
+// Given a conversation, fills in the summary of the conversation for the provided user. The caller should be holding the inbox lock.
+func (c *Conversation) summarize(userId string, entry *InboxEntry) {
+	entry.ConversationKey = c.UniqueKey()
+	entry.UserIds = c.UserIds
+	entry.ChannelName = c.ChannelName
+	entry.LastMessage = nil
+	entry.UnreadCount = 0
+	if len(c.Messages) == 0 {
+		return
+	}
+
+	last := c.Messages[len(c.Messages)-1]
+	entry.LastMessage = newMessagePreview(last)
+	entry.TimestampLastActivity = last.TimestampCreated
+
+	// A user has read everything up to the last message they sent
+	for _, m := range c.Messages {
+		if m.From == userId && m.Id > entry.LastReadMessageId {
+			entry.LastReadMessageId = m.Id
+		}
+	}
+	for _, m := range c.Messages {
+		if m.From != userId && !m.System && m.Id > entry.LastReadMessageId {
+			entry.UnreadCount++
+		}
+	}
+}
+
+// Given a conversation, removes it from the inbox of each of its members
+func (c *Conversation) removeFromInbox() error {
+	inboxLock.Lock()
+	defer inboxLock.Unlock()
+
+	for _, userId := range c.UserIds {
+		err := c.removeInboxEntry(userId)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Given a conversation, removes it from the inbox of the provided user. The caller should be holding the inbox lock.
+func (c *Conversation) removeInboxEntry(userId string) error {
+	if _, exists := inboxIndex[userId][c.UniqueKey()]; !exists {
+		return nil
+	}
+	delete(inboxIndex[userId], c.UniqueKey())
+	if len(inboxIndex[userId]) == 0 {
+		delete(inboxIndex, userId)
+	}
+	return saveInbox(userId)
+}
+
+// Given a conversation, and a copy of it where a member was renamed (see conversation_rename.go), carries over what each member has read, and their settings, to the copy.
+// The entries of the copy are only filled in when the copy is saved.
+func (c *Conversation) copyInboxEntries(dup *Conversation, oldUserId, newUserId string) {
+	inboxLock.Lock()
+	defer inboxLock.Unlock()
+
+	for _, userId := range c.UserIds {
+		entry := c.inboxEntry(userId)
+		if entry == nil {
+			continue
+		}
+		if userId == oldUserId {
+			userId = newUserId
+		}
+		if _, exists := inboxIndex[userId]; !exists {
+			inboxIndex[userId] = make(map[string]*InboxEntry)
+		}
+		inboxIndex[userId][dup.UniqueKey()] = &InboxEntry{LastReadMessageId: entry.LastReadMessageId, Settings: entry.Settings}
+	}
+}
+
+// Given a message, get its preview
+func newMessagePreview(m message_service.Message) *MessagePreview {
+	return &MessagePreview{
+		Id:               m.Id,
+		From:             m.From,
+		Preview:          previewContent(m.Content),
+		TimestampCreated: m.TimestampCreated,
+	}
+}
+
+// Given the content of a message, shortens it to a single line of at most previewLength characters
+func previewContent(content string) string {
+	var preview []rune = []rune(strings.Join(strings.Fields(content), " "))
+	if len(preview) <= previewLength {
+		return string(preview)
+	}
+	return string(preview[:previewLength-3]) + "..."
+}
+
+// Given some user ids, saves the inboxes of those users into the database so we don't lose them. The caller should be holding the inbox lock.
+// The list of the users who have an inbox is only saved when a user gets their first conversation, or loses their last one.
+func saveInbox(userIds ...string) error {
+	db := gofiledb.GetClient()
+	var usersChanged bool
+	for _, userId := range userIds {
+		entries, exists := inboxIndex[userId]
+		if !exists && !inboxUserIds[userId] {
+			continue
+		}
+		err := db.SetStruct(inboxCollectionName, inboxKey(userId), &entries)
+		if err != nil {
+			return err
+		}
+		if exists && !inboxUserIds[userId] {
+			inboxUserIds[userId] = true
+			usersChanged = true
+		}
+		if !exists && inboxUserIds[userId] {
+			delete(inboxUserIds, userId)
+			usersChanged = true
+		}
+	}
+	if !usersChanged {
+		return nil
+	}
+	return saveInboxUsers()
+}
+
+// Saves the list of the users who have an inbox into the database. The caller should be holding the inbox lock.
+func saveInboxUsers() error {
+	var userIds []string = []string{}
+	for userId := range inboxUserIds {
+		userIds = append(userIds, userId)
+	}
+	sort.Strings(userIds)
+	db := gofiledb.GetClient()
+	return db.SetStruct(inboxCollectionName, "inbox_users", &userIds)
+}
+
+// Given a user id, get the key that the inbox of that user is saved with
+func inboxKey(userId string) string {
+	return "inbox_" + userId
+}
@@ -0,0 +1,178 @@
+package conversation_service
+
+import (
+	"../message_service"
+	"fmt"
+	"strings"
+	"time"
+)
+
+/**************************************************************************
+* C O N V E R S A T I O N  I N F O
+**************************************************************************/
+
+/*
+Besides its members and messages, a conversation has some information about itself:
+-- Title, Description, AvatarRef (string): set by its members, all optional
+-- CreatedBy (string), TimestampCreated (time): who sent the first message of the conversation (or set its info first), and when
+
+Every change to the title, description or avatar is announced in the conversation with a system message (see Message.System),
+sent on behalf of the member who made the change, so everyone can tell what changed, when, and who changed it.
+The info itself is recorded in the message log with an info event.
+*/
+
+// Limits on the info of a conversation
+const (
+	maxTitleLength       int = 100
+	maxDescriptionLength int = 1000
+	maxAvatarRefLength   int = 512
+)
+
+// Given a conversation, sets its title, description and avatar on behalf of the provided user, and announces what changed with system messages.
+// Only the provided info is changed, an empty string removes it.
+func (c *Conversation) UpdateInfo(by string, title, description, avatarRef *string) error {
+	title = trimInfo(title)
+	description = trimInfo(description)
+	avatarRef = trimInfo(avatarRef)
+	if title != nil && len(*title) > maxTitleLength {
+		return fmt.Errorf("Conversation validation failed: title should be at most %d characters", maxTitleLength)
+	}
+	if description != nil && len(*description) > maxDescriptionLength {
+		return fmt.Errorf("Conversation validation failed: description should be at most %d characters", maxDescriptionLength)
+	}
+	if avatarRef != nil && len(*avatarRef) > maxAvatarRefLength {
+		return fmt.Errorf("Conversation validation failed: avatar reference should be at most %d characters", maxAvatarRefLength)
+	}
+
+	// The announcements that haven't been added yet. If someone else changes the conversation in between, the change is made again,
+	// but once the info is recorded, only the announcements are left to add.
+	var announcements []string
+	var infoRecorded bool
+	now := time.Now()
+	return c.change(func() error {
+		if !infoRecorded {
+			err := c.CheckPermission(by, PermissionUpdateInfo)
+			if err != nil {
+				return err
+			}
+
+			// Figure out what changed, so we can tell the members
+			announcements = nil
+			if title != nil && *title != c.Title {
+				announcements = append(announcements, describeChange("title", *title, true))
+			}
+			if description != nil && *description != c.Description {
+				announcements = append(announcements, describeChange("description", *description, false))
+			}
+			if avatarRef != nil && *avatarRef != c.AvatarRef {
+				announcements = append(announcements, describeChange("avatar", *avatarRef, false))
+			}
+			if len(announcements) == 0 {
+				return nil
+			}
+
+			err = c.ensureInLog()
+			if err != nil {
+				return err
+			}
+			if title != nil {
+				c.Title = *title
+			}
+			if description != nil {
+				c.Description = *description
+			}
+			if avatarRef != nil {
+				c.AvatarRef = *avatarRef
+			}
+			err = c.persistInfo()
+			if err != nil {
+				return err
+			}
+			infoRecorded = true
+		}
+
+		for len(announcements) > 0 {
+			m := newSystemMessage(by, announcements[0], now)
+			err := c.appendMessage(&m)
+			if err != nil {
+				return err
+			}
+			announcements = announcements[1:]
+		}
+		return nil
+	})
+}
+
+/**************************************************************************
+* H E L P E R S
+**************************************************************************/
+
+// Given a conversation, record a change to its info. The info should already be set on the conversation.
+func (c *Conversation) persistInfo() error {
+	var info Conversation
+	info.copyInfo(c)
+	return c.persistEvent(messageEvent{Type: eventTypeInfo, Conversation: &info})
+}
+
+// Given a piece of info that might not be provided, trims the spaces around it
+func trimInfo(value *string) *string {
+	if value == nil {
+		return nil
+	}
+	var trimmed string = strings.TrimSpace(*value)
+	return &trimmed
+}
+
+// Given a conversation, copies the info (title, description, avatar, topic, who created it and when) of another conversation into it
+func (c *Conversation) copyInfo(from *Conversation) {
+	c.Title = from.Title
+	c.Description = from.Description
+	c.AvatarRef = from.AvatarRef
+	c.Topic = from.Topic
+	c.CreatedBy = from.CreatedBy
+	c.TimestampCreated = from.TimestampCreated
+}
+
+// Given a conversation, fills in who created it and when from its first message, if it's not known yet
+func (c *Conversation) fillCreated() {
+	if c.CreatedBy != "" || len(c.Messages) == 0 {
+		return
+	}
+	c.CreatedBy = c.Messages[0].From
+	c.TimestampCreated = c.Messages[0].TimestampCreated
+}
+
+// Given a conversation, announces changes to it with system messages from the provided user
+func (c *Conversation) announce(by string, announcements ...string) error {
+	now := time.Now()
+	for _, announcement := range announcements {
+		_, err := c.AddMessage(newSystemMessage(by, announcement, now))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Given a user and an announcement, get a system message that announces it on behalf of the user
+func newSystemMessage(by, announcement string, now time.Time) message_service.Message {
+	return message_service.Message{
+		Content:          announcement,
+		From:             by,
+		Format:           message_service.FormatPlain,
+		TimestampCreated: now,
+		TimestampUpdated: now,
+		System:           true,
+	}
+}
+
+// Given the name of a piece of info, and its new value, describes the change for a system message. Only short values (like the title) are quoted.
+func describeChange(name, value string, quote bool) string {
+	if value == "" {
+		return fmt.Sprintf("removed the %s", name)
+	}
+	if quote {
+		return fmt.Sprintf("changed the %s to %q", name, value)
+	}
+	return fmt.Sprintf("changed the %s", name)
+}
@@ -0,0 +1,255 @@
+package conversation_service
+
+import (
+	"crypto/rand"
+	"encoding/hex"
+	"fmt"
+	"github.com/teejays/gofiledb"
+	"log"
+	"sort"
+	"sync"
+	"time"
+)
+
+/**************************************************************************
+* I N V I T E S
+**************************************************************************/
+
+/*
+The owner and admins of a channel (see conversation_roles.go) can invite users into it with an invite: a secret token that they can share,
+e.g. as a link. Whoever has the token can join the channel with it, even if the channel is private (see conversation_channel.go).
+
+Invite: A token that lets users join a channel.
+-- Structure:
+-- -- Token (string): the secret that users join with
+-- -- ChannelName (string): the name of the channel it lets users join
+-- -- CreatedBy (string): the user id of the user who created it
+-- -- TimestampCreated (time): when it was created
+-- -- ExpiresAt (time): when it stops working, if it ever does
+-- -- MaxUses (int): how many users can join with it, or 0 if there is no limit
+-- -- Uses (int): how many users have joined with it so far
+
+-- Invites stop working once they have expired or been used up, but they are still listed until they are revoked.
+-- Revoking an invite removes it for good.
+
+Just like the buddies map, the invites are kept in-memory, with a copy saved in the database.
+*/
+
+// Define the structure for an Invite
+type Invite struct {
+	Token            string
+	ChannelName      string
+	CreatedBy        string
+	TimestampCreated time.Time
+	ExpiresAt        *time.Time `json:",omitempty"`
+	MaxUses          int
+	Uses             int
+}
+
+// How many random bytes make up an invite token
+const inviteTokenBytes int = 16
+
+// invites maps the token of every invite to the invite
+var invites map[string]*Invite
+var invitesLock sync.Mutex
+var inviteCollectionName string = "invites" // name of the collection when storing the invites in the db
+
+// Given a channel, creates an invite into it on behalf of the provided user. The invite can expire (a nil expiresAt means never), and be limited to maxUses users (0 means no limit).
+func (c *Conversation) CreateInvite(by string, expiresAt *time.Time, maxUses int) (*Invite, error) {
+	if c.ChannelName == "" {
+		return nil, fmt.Errorf("Users can only be invited into channels")
+	}
+	err := c.CheckPermission(by, PermissionManageMembers)
+	if err != nil {
+		return nil, err
+	}
+	now := time.Now()
+	if expiresAt != nil && !expiresAt.After(now) {
+		return nil, fmt.Errorf("Invite validation failed: it should expire in the future")
+	}
+	if maxUses < 0 {
+		return nil, fmt.Errorf("Invite validation failed: max uses should not be negative")
+	}
+	token, err := newInviteToken()
+	if err != nil {
+		return nil, err
+	}
+
+	var invite Invite = Invite{
+		Token:            token,
+		ChannelName:      c.ChannelName,
+		CreatedBy:        by,
+		TimestampCreated: now,
+		ExpiresAt:        expiresAt,
+		MaxUses:          maxUses,
+	}
+
+	invitesLock.Lock()
+	defer invitesLock.Unlock()
+	invites[token] = &invite
+	return &invite, saveInvites()
+}
+
+// Given a channel, get its invites, oldest first, for the provided user
+func (c *Conversation) GetInvites(by string) ([]Invite, error) {
+	err := c.CheckPermission(by, PermissionManageMembers)
+	if err != nil {
+		return nil, err
+	}
+
+	invitesLock.Lock()
+	defer invitesLock.Unlock()
+
+	var channelInvites []Invite = []Invite{}
+	for _, invite := range invites {
+		if invite.ChannelName == c.ChannelName {
+			channelInvites = append(channelInvites, *invite)
+		}
+	}
+	sort.Slice(channelInvites, func(i, j int) bool {
+		return channelInvites[i].TimestampCreated.Before(channelInvites[j].TimestampCreated)
+	})
+	return channelInvites, nil
+}
+
+// Given a channel, revokes the invite with the provided token on behalf of the provided user
+func (c *Conversation) RevokeInvite(by, token string) error {
+	err := c.CheckPermission(by, PermissionManageMembers)
+	if err != nil {
+		return err
+	}
+
+	invitesLock.Lock()
+	defer invitesLock.Unlock()
+
+	invite, exists := invites[token]
+	if !exists || invite.ChannelName != c.ChannelName {
+		return fmt.Errorf("No invite found in channel %s with that token", c.ChannelName)
+	}
+	delete(invites, token)
+	return saveInvites()
+}
+
+// Given an invite token, makes the provided user a member of the channel it is for, and returns the channel
+func JoinWithInvite(token, userId string) (*Conversation, error) {
+	// Joining takes a while, so the use of the invite is reserved first, and the invites aren't held on to while the user joins
+	channelName, err := reserveInviteUse(token)
+	if err != nil {
+		return nil, err
+	}
+
+	c, err := GetChannel(channelName)
+	if err == nil {
+		err = c.join(userId)
+	}
+	if err != nil {
+		// The user didn't join, so somebody else can have the use
+		releaseErr := releaseInviteUse(token)
+		if releaseErr != nil {
+			log.Printf("Could not release a use of an invite into channel %s: %s", channelName, releaseErr)
+		}
+		return nil, err
+	}
+	return c, nil
+}
+
+// Given a user id and the new user id, switches who created the invites, e.g. because the user was renamed or deleted their account
+func RenameInInvites(oldUserId, newUserId string) error {
+	invitesLock.Lock()
+	defer invitesLock.Unlock()
+
+	var changed bool
+	for _, invite := range invites {
+		if invite.CreatedBy == oldUserId {
+			invite.CreatedBy = newUserId
+			changed = true
+		}
+	}
+	if !changed {
+		return nil
+	}
+	return saveInvites()
+}
+
+// Upon start of the application, this function loads the invites into memory from the db
+func LoadInvitesToMemory() error {
+	invitesLock.Lock()
+	defer invitesLock.Unlock()
+
+	db := gofiledb.GetClient()
+	exists, err := db.GetStructIfExists(inviteCollectionName, "invites", &invites)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		invites = make(map[string]*Invite)
+	}
+	return nil
+}
+
+/**************************************************************************
+* H E L P E R S
+**************************************************************************/
+
+// Given an invite, checks that it can still be used at the provided time
+func (invite *Invite) checkUsable(now time.Time) error {
+	if invite.ExpiresAt != nil && !now.Before(*invite.ExpiresAt) {
+		return fmt.Errorf("Invalid invite: it has expired")
+	}
+	if invite.MaxUses > 0 && invite.Uses >= invite.MaxUses {
+		return fmt.Errorf("Invalid invite: it has been used up")
+	}
+	return nil
+}
+
+// Given an invite token, checks that the invite can still be used, and counts one more use of it. It returns the name of the channel the invite is for.
+func reserveInviteUse(token string) (string, error) {
+	invitesLock.Lock()
+	defer invitesLock.Unlock()
+
+	invite, exists := invites[token]
+	if !exists {
+		return "", fmt.Errorf("Invalid invite: it doesn't exist, or it was revoked")
+	}
+	err := invite.checkUsable(time.Now())
+	if err != nil {
+		return "", err
+	}
+	invite.Uses++
+	err = saveInvites()
+	if err != nil {
+		invite.Uses--
+		return "", err
+	}
+	return invite.ChannelName, nil
+}
+
+// Given an invite token, takes back a use of the invite that was reserved (see reserveInviteUse), but didn't lead to the user joining
+func releaseInviteUse(token string) error {
+	invitesLock.Lock()
+	defer invitesLock.Unlock()
+
+	// The invite might have been revoked in the meantime
+	invite, exists := invites[token]
+	if !exists || invite.Uses == 0 {
+		return nil
+	}
+	invite.Uses--
+	return saveInvites()
+}
+
+// Generates a new random invite token
+func newInviteToken() (string, error) {
+	b := make([]byte, inviteTokenBytes)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(b), nil
+}
+
+// Saves the invites into the database so we don't lose them. The caller should be holding the invites lock.
+func saveInvites() error {
+	db := gofiledb.GetClient()
+	return db.SetStruct(inviteCollectionName, "invites", &invites)
+}
@@ -0,0 +1,694 @@
+package conversation_service
+
+import (
+	"../../config"
+	"../message_service"
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+)
+
+/**************************************************************************
+* M E S S A G E  E V E N T  L O G
+**************************************************************************/
+
+/*
+Every change to a conversation is recorded as an immutable event, in an append-only log file per conversation.
+The log is the source of truth: the state of a conversation is whatever we get by replaying its events in order.
+
+-- Events: each event has a sequence number (1, 2, 3...) within its conversation, assigned by the log when it's appended, and a type:
+-- -- create: the conversation was created. Carries the whole state of the conversation (UserIds, ChannelName, Private, and any messages it already had).
+-- --    It is also used to record the whole state of a conversation that wasn't in the log yet, so replaying it resets the conversation.
+-- -- add, edit: a message was added or edited. Carries the message after the change.
+-- -- delete: a message was deleted. Carries the id of the message, and why (by its sender, by an admin, expired, retention).
+-- -- settings: the settings of the conversation (e.g. message TTL, retention) changed. Carries the conversation with the new settings.
+-- -- pins: messages were pinned or unpinned. Carries the conversation with all of its pins.
+-- -- info: the info of the conversation (title, description, avatar, topic) changed. Carries the conversation with the new info.
+-- -- roles: the role of a member changed. Carries the conversation with all of its roles.
+-- -- members: a member joined or left a channel. Carries the conversation with all of its members, and their roles.
+-- Snapshot: the whole Conversation object, saved in gofiledb (see Save), is only a cache of the replayed state.
+-- -- LogSequence and LogOffset tell which event it includes last, and where in the log file the events after it start.
+-- -- Every snapshotThreshold events, we save a new snapshot, so loading a conversation never has to replay too much.
+-- -- If the snapshot doesn't line up with the log (e.g. it got corrupted), we ignore it and replay the whole log instead.
+-- -- RebuildSnapshots replays all the logs from scratch, and saves a fresh snapshot for each.
+-- Compaction: when a snapshot is saved, the events it includes are replaced in the log by a single create event carrying the same state,
+-- so the log doesn't keep growing, and it stays the source of truth.
+
+Sending, editing or deleting a message only appends a single line to the log, no matter how long the conversation is.
+
+When messages are removed by the message TTL, a retention policy or a moderator, only a delete event is appended as well. The whole point
+of removing them is to not keep their content though, so the conversation remembers that it has removed messages (removedSinceSnapshot),
+and the jobs that remove them in batches (the reaper, the retention job) and moderators compact its log right after (see redactRemoved).
+Otherwise, the content is gone from the log when the next snapshot is saved.
+
+Concurrent changes: several copies of a conversation can be loaded at the same time (e.g. by two requests). Every change is made on one
+of them, so a copy that missed the events recorded by another copy would make its change on an old state (and e.g. give a new message
+an id that is already taken). To prevent that, every event says which event it comes after (the LogSequence of the copy), and the log
+rejects it if that's not the last event anymore. The change is then made again on the latest state (see change).
+The only exception is a conversation that the caller built itself, rather than loaded: it is the whole state the caller wants,
+so the create event that records it replaces whatever the log had.
+
+Crash safety:
+-- Every event is synced to disk before the write is considered done.
+-- If the app crashes in the middle of appending an event, the log is left with a partial line. It can't be decoded, so it's skipped when replaying.
+-- Rewriting the log (for compaction) happens in a temporary file, which then replaces the log, so the log is never half written.
+-- If the app crashes after compacting the log but before saving the snapshot, the old snapshot doesn't line up with the log anymore, so the whole log is replayed.
+*/
+
+// Types of events that can be recorded in the message log
+const (
+	eventTypeCreate   string = "create"
+	eventTypeAdd      string = "add"
+	eventTypeEdit     string = "edit"
+	eventTypeDelete   string = "delete"
+	eventTypeSettings string = "settings"
+	eventTypePins     string = "pins"
+	eventTypeInfo     string = "info"
+	eventTypeRoles    string = "roles"
+	eventTypeMembers  string = "members"
+)
+
+// Reasons for which a message can be deleted
+const (
+	DeleteReasonUser      string = "user"
+	DeleteReasonModerator string = "moderator"
+	DeleteReasonExpired   string = "expired"
+	DeleteReasonRetention string = "retention"
+)
+
+// Define the structure of a single event in the message log
+type messageEvent struct {
+	Sequence     int
+	Type         string
+	Conversation *Conversation           `json:",omitempty"` // for create, settings, pins, info, roles and members events
+	Message      message_service.Message // for add and edit events, the message after the event
+	MessageId    int                     // for delete events, the id of the deleted message
+	Reason       string                  `json:",omitempty"` // for delete events, why the message was deleted
+
+	deleted message_service.Message // for delete events, the message that was deleted, only known while adding the event (it isn't written to the log)
+
+	end int64 // where this event ends in the log file, only known after reading or writing it
+}
+
+// After this many events in the log since the last snapshot, we save a new snapshot
+var snapshotThreshold int = 100
+
+// Name of the folder (inside the storage root of the workspace, see config.StorageRoot) where the message logs are stored
+var conversationLogDirName string = "conversation_log"
+
+// The state of the message log file of a single conversation
+type conversationLog struct {
+	sync.Mutex        // every operation on the log file holds it, so an append never runs into a rewrite
+	lastSequence int  // the sequence number of the last event in the log
+	known        bool // whether lastSequence has been read from the log yet
+}
+
+// The message logs that have been used since the app started, by conversation key
+var conversationLogs map[string]*conversationLog = make(map[string]*conversationLog)
+var conversationLogsLock sync.Mutex
+
+// Returned when a change is recorded on a copy of a conversation that missed some of the events in its log
+var errLogConflict error = fmt.Errorf("The conversation was changed by someone else at the same time, try again")
+
+// Appending an event after anySequence appends it after whatever the last event in the log is
+const anySequence int = -1
+
+// How many times a change is made again after running into a change made by someone else at the same time
+const maxConflictRetries int = 5
+
+// Given a conversation, makes a change to it with the provided function, which should change the conversation and record the change in its log.
+// If another copy of the conversation recorded a change first, this copy is reloaded with the latest state, and the change is made again.
+// The function should check everything it depends on itself, since the conversation can be different every time it runs.
+func (c *Conversation) change(apply func() error) error {
+	for attempt := 0; ; attempt++ {
+		err := apply()
+		if err != errLogConflict || attempt == maxConflictRetries {
+			return err
+		}
+		err = c.reload()
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// Given a conversation, replaces it with the latest state recorded in its log
+func (c *Conversation) reload() error {
+	var blank Conversation = Conversation{UserIds: c.UserIds, ChannelName: c.ChannelName}
+	latest, cached := cacheGet(blank.UniqueKey())
+	if !cached {
+		var err error
+		latest, err = loadConversation(blank)
+		if err != nil {
+			return err
+		}
+	}
+	*c = *latest
+	c.setMessageExpiry()
+	return nil
+}
+
+// Given a conversation, persist a change to it by appending a single event to the log of the conversation
+func (c *Conversation) persistEvent(e messageEvent) error {
+	// Before the first change, the log needs to know that the conversation exists, and what it looked like
+	err := c.ensureInLog()
+	if err != nil {
+		return err
+	}
+	return c.appendToLog(e)
+}
+
+// Given a conversation, makes sure that its log has recorded it, with a create event carrying its current state.
+// If the change about to be made is the first one to the conversation, its log needs to know what the conversation looked like before,
+// so every change calls this before it changes the conversation.
+// This is also how conversations saved before the message log existed make their way into it.
+func (c *Conversation) ensureInLog() error {
+	if c.inLog {
+		return nil
+	}
+	state := c.logState()
+	return c.appendToLog(messageEvent{Type: eventTypeCreate, Conversation: &state})
+}
+
+// Given a conversation, get its whole state the way a create event carries it
+func (c *Conversation) logState() Conversation {
+	var state Conversation = Conversation{
+		UserIds:        c.UserIds,
+		ChannelName:    c.ChannelName,
+		Private:        c.Private,
+		Messages:       c.Messages,
+		LastMessageId:  c.LastMessageId,
+		PinnedMessages: c.PinnedMessages,
+		Roles:          c.Roles,
+	}
+	state.copySettings(c)
+	state.copyInfo(c)
+	return state
+}
+
+// Given a conversation, appends an event to its log, updates the cache, and saves a snapshot if it's time to.
+// If the log has events that this copy of the conversation missed, the event is rejected with errLogConflict.
+func (c *Conversation) appendToLog(e messageEvent) error {
+	var expectedSequence int = c.LogSequence
+	if e.Type == eventTypeCreate && !c.loaded {
+		expectedSequence = anySequence
+	}
+	sequence, end, err := appendEvent(c.UniqueKey(), expectedSequence, e)
+	if err != nil {
+		return err
+	}
+	c.LogSequence = sequence
+	c.LogOffset = end
+	c.inLog = true
+	cachePut(c)
+
+	// Keep the summary of the conversation in the inbox of its members up to date (see conversation_inbox.go)
+	err = c.updateInbox(e)
+	if err != nil {
+		return err
+	}
+
+	// Once enough events have piled up, save a new snapshot so loading doesn't have to replay them all
+	c.eventsSinceSnapshot++
+	if c.eventsSinceSnapshot >= snapshotThreshold {
+		return c.Save()
+	}
+	return nil
+}
+
+// Given a conversation (loaded from its snapshot, if there is one), applies the events in its log that came after the snapshot
+func (c *Conversation) replayLog() error {
+	key := c.UniqueKey()
+	events, err := readEvents(key, c.LogOffset)
+
+	// If the snapshot doesn't line up with the log, we can't trust it. Start from scratch and replay the whole log instead.
+	if err == errInvalidLogOffset || (err == nil && len(events) > 0 && events[0].Sequence != c.LogSequence+1) {
+		log.Printf("Snapshot of %s doesn't match its message log, replaying the whole log", key)
+		*c = Conversation{UserIds: c.UserIds, ChannelName: c.ChannelName}
+		events, err = readEvents(key, 0)
+	}
+	if err != nil {
+		return err
+	}
+
+	for _, e := range events {
+		c.applyEvent(e)
+		c.LogSequence = e.Sequence
+		c.LogOffset = e.end
+		c.eventsSinceSnapshot++
+		if e.Type == eventTypeDelete && e.Reason != DeleteReasonUser {
+			c.removedSinceSnapshot = true
+		}
+	}
+
+	// If the conversation has any events, its log already has the create event
+	c.inLog = c.LogSequence > 0
+	return nil
+}
+
+// Given a conversation, applies a single event to it
+func (c *Conversation) applyEvent(e messageEvent) {
+	switch e.Type {
+	case eventTypeCreate:
+		c.UserIds = e.Conversation.UserIds
+		c.ChannelName = e.Conversation.ChannelName
+		c.Private = e.Conversation.Private
+		c.Messages = e.Conversation.Messages
+		c.LastMessageId = e.Conversation.LastMessageId
+		c.PinnedMessages = e.Conversation.PinnedMessages
+		c.Roles = e.Conversation.Roles
+		c.copySettings(e.Conversation)
+		c.copyInfo(e.Conversation)
+		c.fillCreated()
+	case eventTypeAdd:
+		c.Messages = append(c.Messages, e.Message)
+		if e.Message.Id > c.LastMessageId {
+			c.LastMessageId = e.Message.Id
+		}
+		c.fillCreated()
+	case eventTypeEdit:
+		for i := 0; i < len(c.Messages); i++ {
+			if c.Messages[i].Id == e.Message.Id {
+				c.Messages[i] = e.Message
+				break
+			}
+		}
+	case eventTypeDelete:
+		for i := 0; i < len(c.Messages); i++ {
+			if c.Messages[i].Id == e.MessageId {
+				c.Messages = append(c.Messages[0:i], c.Messages[i+1:]...)
+				break
+			}
+		}
+		c.removePin(e.MessageId)
+	case eventTypeSettings:
+		c.copySettings(e.Conversation)
+	case eventTypePins:
+		c.PinnedMessages = e.Conversation.PinnedMessages
+	case eventTypeInfo:
+		c.copyInfo(e.Conversation)
+	case eventTypeRoles:
+		c.Roles = e.Conversation.Roles
+	case eventTypeMembers:
+		c.UserIds = e.Conversation.UserIds
+		c.Roles = e.Conversation.Roles
+	}
+}
+
+// Given a conversation, record a change to its settings. The settings should already be set on the conversation.
+func (c *Conversation) persistSettings() error {
+	var settings Conversation
+	settings.copySettings(c)
+	return c.persistEvent(messageEvent{Type: eventTypeSettings, Conversation: &settings})
+}
+
+// Given a conversation, copies the settings (not the messages) of another conversation into it
+func (c *Conversation) copySettings(from *Conversation) {
+	c.MessageTtlSeconds = from.MessageTtlSeconds
+	c.RetentionDays = from.RetentionDays
+	c.RetentionMaxMessages = from.RetentionMaxMessages
+}
+
+// Given a conversation, removes the messages with the provided ids because of a policy (message TTL, retention), or a moderator.
+// Unlike a user deleting a message, the content of these messages should be redacted from the log too, with redactRemoved.
+func (c *Conversation) removeMessages(messageIds []int, reason string) error {
+	if len(messageIds) == 0 {
+		return nil
+	}
+
+	return c.change(func() error {
+		_, err := c.dropMessages(messageIds, reason)
+		return err
+	})
+}
+
+// Given a conversation, removes the messages with the provided ids that it still has, and returns them. It should be called from a change (see change).
+// If it fails partway through, it still returns the messages it removed before that.
+func (c *Conversation) dropMessages(messageIds []int, reason string) ([]message_service.Message, error) {
+	var remove map[int]bool = make(map[int]bool)
+	for _, id := range messageIds {
+		remove[id] = true
+	}
+	err := c.ensureInLog()
+	if err != nil {
+		return nil, err
+	}
+
+	// Somebody else might have removed some of the messages already
+	var removed []message_service.Message
+	for i := 0; i < len(c.Messages); i++ {
+		m := c.Messages[i]
+		if !remove[m.Id] {
+			continue
+		}
+		c.Messages = append(c.Messages[0:i], c.Messages[i+1:]...)
+		i--
+		c.removePin(m.Id)
+		err = c.persistEvent(messageEvent{Type: eventTypeDelete, MessageId: m.Id, Reason: reason, deleted: m})
+		if err != nil {
+			return removed, err
+		}
+		c.removedSinceSnapshot = true
+		removed = append(removed, m)
+	}
+	return removed, nil
+}
+
+// Given a conversation, redacts the content of the messages removed from it (see removeMessages) from its log, by saving a snapshot, which compacts the log
+func (c *Conversation) redactRemoved() error {
+	return c.change(func() error {
+		if !c.removedSinceSnapshot {
+			return nil
+		}
+		return c.Save()
+	})
+}
+
+/**************************************************************************
+* R E B U I L D
+**************************************************************************/
+
+// Rebuilds the snapshots of all the conversations that have a message log, by replaying their logs from scratch.
+// This is useful after a snapshot gets corrupted, or after the structure of the Conversation changes. It returns the rebuilt conversations.
+func RebuildSnapshots() ([]*Conversation, error) {
+	paths, err := filepath.Glob(filepath.Join(config.GetConfig().StorageRoot(), conversationLogDirName, "*.log"))
+	if err != nil {
+		return nil, err
+	}
+
+	var convs []*Conversation = []*Conversation{}
+	for _, path := range paths {
+		key := strings.TrimSuffix(filepath.Base(path), ".log")
+		events, err := readEvents(key, 0)
+		if err != nil {
+			return nil, err
+		}
+		// A log should always start with a create event, otherwise we don't know whose conversation it is
+		if len(events) == 0 || events[0].Type != eventTypeCreate {
+			log.Printf("Skipping message log %s: it doesn't start with a create event", key)
+			continue
+		}
+
+		var c Conversation
+		for _, e := range events {
+			c.applyEvent(e)
+			c.LogSequence = e.Sequence
+			c.LogOffset = e.end
+		}
+		c.inLog = true
+		if c.UniqueKey() != key {
+			return nil, fmt.Errorf("Message log %s belongs to conversation %s", key, c.UniqueKey())
+		}
+
+		err = c.Save()
+		if err != nil {
+			return nil, err
+		}
+		// Channels are listed in the channel index (see conversation_channel.go), which might not be up to date either
+		if c.ChannelName != "" {
+			err = c.updateChannelIndex()
+			if err != nil {
+				return nil, err
+			}
+		}
+		convs = append(convs, &c)
+	}
+
+	// The cache might have conversations from before the rebuild
+	PurgeCache()
+	return convs, nil
+}
+
+// Given a conversation, makes sure that it's in the message log, so it can be rebuilt from it.
+// Conversations saved before the message log existed only have a snapshot, this records it as their create event.
+func (c *Conversation) EnsureInLog() error {
+	return c.ensureInLog()
+}
+
+/**************************************************************************
+* H E L P E R S
+**************************************************************************/
+
+// Returned when a snapshot points to a place in the log that doesn't exist
+var errInvalidLogOffset error = fmt.Errorf("Invalid message log offset")
+
+// Given a conversation key, returns the path of the file that holds its message log
+func logFilePath(key string) string {
+	return filepath.Join(config.GetConfig().StorageRoot(), conversationLogDirName, key+".log")
+}
+
+// Given a conversation key, get its message log, locked. The caller should unlock it once it's done with the log file.
+func lockLog(key string) *conversationLog {
+	conversationLogsLock.Lock()
+	l, exists := conversationLogs[key]
+	if !exists {
+		l = &conversationLog{}
+		conversationLogs[key] = l
+	}
+	conversationLogsLock.Unlock()
+
+	l.Lock()
+	return l
+}
+
+// Given a message log that is locked, get the sequence number of its last event. We only need to read the log to find out the first time.
+func (l *conversationLog) getLastSequence(key string) (int, error) {
+	if l.known {
+		return l.lastSequence, nil
+	}
+	events, err := readLogFile(key, 0)
+	if err != nil {
+		return 0, err
+	}
+	l.lastSequence = 0
+	for _, event := range events {
+		if event.Sequence > l.lastSequence {
+			l.lastSequence = event.Sequence
+		}
+	}
+	l.known = true
+	return l.lastSequence, nil
+}
+
+// Appends a single event to the message log of a conversation, right after the event with the expected sequence number, and makes sure it's on disk.
+// If that's not the last event in the log anymore, the event is rejected with errLogConflict.
+// It returns the sequence number given to the event, and where the event ends in the log file.
+func appendEvent(key string, expectedSequence int, e messageEvent) (int, int64, error) {
+	l := lockLog(key)
+	defer l.Unlock()
+
+	err := os.MkdirAll(filepath.Dir(logFilePath(key)), 0755)
+	if err != nil {
+		return 0, 0, err
+	}
+	file, err := os.OpenFile(logFilePath(key), os.O_APPEND|os.O_CREATE|os.O_RDWR, 0644)
+	if err != nil {
+		return 0, 0, err
+	}
+	defer file.Close()
+	info, err := file.Stat()
+	if err != nil {
+		return 0, 0, err
+	}
+
+	// The event comes right after the last event in the log, which should be the last event the conversation knows about
+	if info.Size() == 0 {
+		l.lastSequence, l.known = 0, true
+	}
+	lastSequence, err := l.getLastSequence(key)
+	if err != nil {
+		return 0, 0, err
+	}
+	if expectedSequence != anySequence && lastSequence != expectedSequence {
+		return 0, 0, errLogConflict
+	}
+	e.Sequence = lastSequence + 1
+
+	b, err := json.Marshal(e)
+	if err != nil {
+		return 0, 0, err
+	}
+	b = append(b, '\n')
+
+	// If a crash left a partial line at the end of the log, start the event on a new line so it doesn't get mixed up with it
+	if info.Size() > 0 {
+		last := make([]byte, 1)
+		_, err = file.ReadAt(last, info.Size()-1)
+		if err != nil {
+			return 0, 0, err
+		}
+		if last[0] != '\n' {
+			b = append([]byte{'\n'}, b...)
+		}
+	}
+
+	_, err = file.Write(b)
+	if err != nil {
+		return 0, 0, err
+	}
+	err = file.Sync()
+	if err != nil {
+		return 0, 0, err
+	}
+	l.lastSequence = e.Sequence
+	return e.Sequence, info.Size() + int64(len(b)), nil
+}
+
+// Reads the events in the message log of a conversation, in order, starting at the provided offset in the file
+func readEvents(key string, offset int64) ([]messageEvent, error) {
+	l := lockLog(key)
+	defer l.Unlock()
+	return readLogFile(key, offset)
+}
+
+// Reads and decodes the message log file of a conversation, starting at the provided offset. The caller should be holding the lock of the log.
+func readLogFile(key string, offset int64) ([]messageEvent, error) {
+	file, err := os.Open(logFilePath(key))
+	if os.IsNotExist(err) {
+		if offset > 0 {
+			return nil, errInvalidLogOffset
+		}
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	info, err := file.Stat()
+	if err != nil {
+		return nil, err
+	}
+	if offset > info.Size() {
+		return nil, errInvalidLogOffset
+	}
+	_, err = file.Seek(offset, io.SeekStart)
+	if err != nil {
+		return nil, err
+	}
+
+	var events []messageEvent
+	scanner := bufio.NewScanner(file)
+	scanner.Buffer(make([]byte, 64*1024), 16*1024*1024)
+	for scanner.Scan() {
+		offset += int64(len(scanner.Bytes())) + 1
+		var e messageEvent
+		err = json.Unmarshal(scanner.Bytes(), &e)
+		if err != nil {
+			// This can only be a partial line, left behind by a crash in the middle of an append. That event never completed, so skip it.
+			continue
+		}
+		e.end = offset
+		events = append(events, e)
+	}
+	return events, scanner.Err()
+}
+
+// Given a conversation, compacts its message log: the events that the conversation includes are replaced by a single create event carrying its whole state,
+// so nothing that was removed from the conversation is left in the log. The events that came after are kept as they are.
+// It returns where the create event ends in the compacted log.
+func compactLog(c *Conversation) (int64, error) {
+	key := c.UniqueKey()
+	l := lockLog(key)
+	defer l.Unlock()
+
+	// The log can only be behind the conversation if it was erased since the conversation was loaded
+	lastSequence, err := l.getLastSequence(key)
+	if err != nil {
+		return 0, err
+	}
+	if lastSequence < c.LogSequence {
+		return 0, errLogConflict
+	}
+	events, err := readLogFile(key, 0)
+	if err != nil {
+		return 0, err
+	}
+
+	state := c.logState()
+	var compacted []messageEvent = []messageEvent{{Sequence: c.LogSequence, Type: eventTypeCreate, Conversation: &state}}
+	for _, e := range events {
+		if e.Sequence > c.LogSequence {
+			compacted = append(compacted, e)
+		}
+	}
+	return writeLogFile(key, compacted, c.LogSequence)
+}
+
+// Rewrites every message carried by the events in the message log of a conversation with the provided function, and, unless rewriteState is nil,
+// the rest of the state of the conversation (e.g. pins, who created it) carried by the events with the other one.
+// It returns where the event with the sequence number upTo ends in the rewritten log. If that's not the last event in the log, nothing is rewritten,
+// and errLogConflict is returned.
+func rewriteLog(key string, upTo int, rewrite func(m *message_service.Message), rewriteState func(state *Conversation)) (int64, error) {
+	l := lockLog(key)
+	defer l.Unlock()
+
+	lastSequence, err := l.getLastSequence(key)
+	if err != nil {
+		return 0, err
+	}
+	if lastSequence != upTo {
+		return 0, errLogConflict
+	}
+	events, err := readLogFile(key, 0)
+	if err != nil {
+		return 0, err
+	}
+	for i := 0; i < len(events); i++ {
+		if events[i].Type == eventTypeCreate {
+			for j := 0; j < len(events[i].Conversation.Messages); j++ {
+				rewrite(&events[i].Conversation.Messages[j])
+			}
+		}
+		if events[i].Type == eventTypeAdd || events[i].Type == eventTypeEdit {
+			rewrite(&events[i].Message)
+		}
+		if events[i].Conversation != nil && rewriteState != nil {
+			rewriteState(events[i].Conversation)
+		}
+	}
+	return writeLogFile(key, events, upTo)
+}
+
+// Writes the provided events as the whole message log file of a conversation, replacing the log if there is one.
+// It returns where the event with the sequence number upTo ends in the new log. The caller should be holding the lock of the log.
+func writeLogFile(key string, events []messageEvent, upTo int) (int64, error) {
+	var b []byte
+	var offset int64
+	for _, e := range events {
+		line, err := json.Marshal(e)
+		if err != nil {
+			return 0, err
+		}
+		b = append(b, line...)
+		b = append(b, '\n')
+		if e.Sequence == upTo {
+			offset = int64(len(b))
+		}
+	}
+
+	err := os.MkdirAll(filepath.Dir(logFilePath(key)), 0755)
+	if err != nil {
+		return 0, err
+	}
+	tmpPath := logFilePath(key) + ".tmp"
+	file, err := os.Create(tmpPath)
+	if err != nil {
+		return 0, err
+	}
+	_, err = file.Write(b)
+	if err == nil {
+		err = file.Sync()
+	}
+	file.Close()
+	if err != nil {
+		return 0, err
+	}
+	return offset, os.Rename(tmpPath, logFilePath(key))
+}
@@ -0,0 +1,134 @@
+package conversation_service
+
+import (
+	"../../config"
+	"../message_service"
+	"fmt"
+	"time"
+)
+
+/**************************************************************************
+* P I N N E D  M E S S A G E S
+**************************************************************************/
+
+/*
+Members of a conversation can pin messages, so everyone in the conversation can find them quickly. The pins are part of the
+conversation (PinnedMessages), in the order they were pinned, and are recorded in the message log like any other change.
+
+PinnedMessage: A message that has been pinned in a conversation.
+-- Structure:
+-- -- MessageId (int): the id of the pinned message
+-- -- PinnedBy (string): the user id of the user who pinned it
+-- -- TimestampPinned (time): when it was pinned
+
+-- A conversation can have at most MaxPinnedMessages pins (in the config), or defaultMaxPinnedMessages if it's not set.
+-- When a pinned message is deleted (by its sender, or because it expired or was pruned), its pin goes away with it.
+*/
+
+// Define the structure for a PinnedMessage
+type PinnedMessage struct {
+	MessageId       int
+	PinnedBy        string
+	TimestampPinned time.Time
+}
+
+// How many messages can be pinned in a conversation, if the config doesn't say
+const defaultMaxPinnedMessages int = 50
+
+// Given a conversation, pins the message with the provided id on behalf of the provided user
+func (c *Conversation) PinMessage(messageId int, pinnedBy string) error {
+	return c.change(func() error {
+		if c.findMessage(messageId) == nil {
+			return fmt.Errorf("No message found in the conversation with message id %d", messageId)
+		}
+		if c.isPinned(messageId) {
+			return fmt.Errorf("Message %d is already pinned", messageId)
+		}
+		maxPins := getMaxPinnedMessages()
+		if len(c.PinnedMessages) >= maxPins {
+			return fmt.Errorf("Cannot pin more than %d messages in a conversation, unpin one first", maxPins)
+		}
+
+		err := c.ensureInLog()
+		if err != nil {
+			return err
+		}
+		c.PinnedMessages = append(c.PinnedMessages, PinnedMessage{MessageId: messageId, PinnedBy: pinnedBy, TimestampPinned: time.Now()})
+		return c.persistPins()
+	})
+}
+
+// Given a conversation, unpins the message with the provided id
+func (c *Conversation) UnpinMessage(messageId int) error {
+	return c.change(func() error {
+		if !c.isPinned(messageId) {
+			return fmt.Errorf("Message %d is not pinned", messageId)
+		}
+
+		err := c.ensureInLog()
+		if err != nil {
+			return err
+		}
+		c.removePin(messageId)
+		return c.persistPins()
+	})
+}
+
+// Given a conversation, get its pinned messages, in the order they were pinned
+func (c *Conversation) GetPinnedMessages() []message_service.Message {
+	var messages []message_service.Message = []message_service.Message{}
+	for _, p := range c.PinnedMessages {
+		if m := c.findMessage(p.MessageId); m != nil {
+			messages = append(messages, *m)
+		}
+	}
+	return messages
+}
+
+/**************************************************************************
+* H E L P E R S
+**************************************************************************/
+
+// Given a conversation, record a change to its pins. The pins should already be set on the conversation.
+func (c *Conversation) persistPins() error {
+	var pins Conversation = Conversation{PinnedMessages: c.PinnedMessages}
+	return c.persistEvent(messageEvent{Type: eventTypePins, Conversation: &pins})
+}
+
+// Given a conversation, tells whether the message with the provided id is pinned
+func (c *Conversation) isPinned(messageId int) bool {
+	for _, p := range c.PinnedMessages {
+		if p.MessageId == messageId {
+			return true
+		}
+	}
+	return false
+}
+
+// Given a conversation, removes the pin of the message with the provided id, if it's pinned
+func (c *Conversation) removePin(messageId int) {
+	for i := 0; i < len(c.PinnedMessages); i++ {
+		if c.PinnedMessages[i].MessageId == messageId {
+			c.PinnedMessages = append(c.PinnedMessages[0:i], c.PinnedMessages[i+1:]...)
+			return
+		}
+	}
+}
+
+// Given a conversation, finds the message with the provided id
+func (c *Conversation) findMessage(messageId int) *message_service.Message {
+	for i := 0; i < len(c.Messages); i++ {
+		if c.Messages[i].Id == messageId {
+			return &c.Messages[i]
+		}
+	}
+	return nil
+}
+
+// Get how many messages can be pinned in a conversation
+func getMaxPinnedMessages() int {
+	if maxPins := config.GetConfig().MaxPinnedMessages; maxPins > 0 {
+		return maxPins
+	}
+	return defaultMaxPinnedMessages
+}
@@ -0,0 +1,170 @@
+package conversation_service
+
+import (
+	"../message_service"
+	"fmt"
+)
+
+/**************************************************************************
+* R E N A M E
+**************************************************************************/
+
+/*
+The key of a conversation (and so, where its snapshot and its message log are stored) is made of the user ids of its members,
+and every message carries the user id of its sender. So when a user changes their user id, their conversations have to move:
+-- CopyWithRenamedMember writes a copy of the conversation, and its whole message log, under the new key, with the new user id
+-- everywhere the old one was (the members, the sender of the messages, who pinned them, and who created the conversation). The sequence numbers of the events are kept.
+-- The original conversation is left as is, so if anything fails half way, nothing is lost. Once the rename is done, the original can be erased (see Erase).
+
+The key of a channel is made of its name instead (see conversation_channel.go), so channels don't have to move: RenameMember rewrites them in place.
+*/
+
+// Given a conversation, copies it (and its message log) to a new conversation where the provided member has the new user id, and returns the copy
+func (c *Conversation) CopyWithRenamedMember(oldUserId, newUserId string) (*Conversation, error) {
+	// The log is the source of truth, so it needs to have everything before we copy it
+	err := c.ensureInLog()
+	if err != nil {
+		return nil, err
+	}
+
+	rename, renameState := renamers(oldUserId, newUserId)
+
+	// Build the new conversation
+	var dup *Conversation = c.copy()
+	dup.UserIds = renameMember(c.UserIds, oldUserId, newUserId)
+	for i := 0; i < len(dup.Messages); i++ {
+		rename(&dup.Messages[i])
+	}
+	renameState(dup)
+	newKey := dup.UniqueKey()
+
+	// Write its log: the same events, with the new user id
+	events, err := readEvents(c.UniqueKey(), 0)
+	if err != nil {
+		return nil, err
+	}
+	for i := 0; i < len(events); i++ {
+		if events[i].Type == eventTypeCreate {
+			events[i].Conversation.UserIds = renameMember(events[i].Conversation.UserIds, oldUserId, newUserId)
+			for j := 0; j < len(events[i].Conversation.Messages); j++ {
+				rename(&events[i].Conversation.Messages[j])
+			}
+		}
+		if events[i].Type == eventTypeAdd || events[i].Type == eventTypeEdit {
+			rename(&events[i].Message)
+		}
+		if events[i].Conversation != nil {
+			renameState(events[i].Conversation)
+		}
+	}
+	l := lockLog(newKey)
+	offset, err := writeLogFile(newKey, events, dup.LogSequence)
+	if err == nil && len(events) > 0 {
+		l.lastSequence, l.known = events[len(events)-1].Sequence, true
+	}
+	l.Unlock()
+	if err != nil {
+		return nil, err
+	}
+	dup.LogOffset = offset
+	dup.inLog = true
+	c.copyInboxEntries(dup, oldUserId, newUserId)
+
+	// Save its snapshot (which also lists it in the inbox of its members, with what they have already read and their settings), and keep reaping its messages if it has a message TTL
+	err = dup.Save()
+	if err != nil {
+		return nil, err
+	}
+	if dup.MessageTtlSeconds <= 0 {
+		return dup, nil
+	}
+	ttlIndexLock.Lock()
+	defer ttlIndexLock.Unlock()
+	ttlIndex[newKey] = dup.UserIds
+	return dup, saveTtlIndex()
+}
+
+// Given a channel, switches the provided member to the new user id everywhere in the channel and in its log
+func (c *Conversation) RenameMember(oldUserId, newUserId string) error {
+	if c.ChannelName == "" {
+		return fmt.Errorf("Only channels can be renamed in place, other conversations have to be copied")
+	}
+	rename, renameState := renamers(oldUserId, newUserId)
+	renameChannelState := func(state *Conversation) {
+		renameState(state)
+		state.UserIds = renameMember(state.UserIds, oldUserId, newUserId)
+	}
+	err := c.change(func() error {
+		// The log is the source of truth, so it needs to have everything before we rewrite it
+		err := c.ensureInLog()
+		if err != nil {
+			return err
+		}
+
+		// What the members have read has to be carried over before the member is renamed (the entries of the new user id are filled in by Save)
+		c.copyInboxEntries(c, oldUserId, newUserId)
+
+		for i := 0; i < len(c.Messages); i++ {
+			rename(&c.Messages[i])
+		}
+		renameChannelState(c)
+
+		// Rewriting changes where the events are in the log, so we need a new snapshot that points to the right place
+		offset, err := rewriteLog(c.UniqueKey(), c.LogSequence, rename, renameChannelState)
+		if err != nil {
+			return err
+		}
+		c.LogOffset = offset
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+
+	// The channel isn't in the inbox of the old user id anymore
+	inboxLock.Lock()
+	err = c.removeInboxEntry(oldUserId)
+	inboxLock.Unlock()
+	if err != nil {
+		return err
+	}
+	return c.Save()
+}
+
+/**************************************************************************
+* H E L P E R S
+**************************************************************************/
+
+// Given a user id and the new user id, get the functions that switch it in a message (its sender), and in the state of a conversation
+// (who pinned messages, who created the conversation, and the roles)
+func renamers(oldUserId, newUserId string) (func(m *message_service.Message), func(state *Conversation)) {
+	rename := func(m *message_service.Message) {
+		if m.From == oldUserId {
+			m.From = newUserId
+		}
+	}
+	renameState := func(state *Conversation) {
+		for i := 0; i < len(state.PinnedMessages); i++ {
+			if state.PinnedMessages[i].PinnedBy == oldUserId {
+				state.PinnedMessages[i].PinnedBy = newUserId
+			}
+		}
+		if state.CreatedBy == oldUserId {
+			state.CreatedBy = newUserId
+		}
+		state.Roles = renameRole(state.Roles, oldUserId, newUserId)
+	}
+	return rename, renameState
+}
+
+// Given some user ids, get a copy of them where the provided user id is switched to the new one
+func renameMember(userIds []string, oldUserId, newUserId string) []string {
+	var renamed []string
+	for _, userId := range userIds {
+		if userId == oldUserId {
+			userId = newUserId
+		}
+		renamed = append(renamed, userId)
+	}
+	return renamed
+}
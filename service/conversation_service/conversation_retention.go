@@ -0,0 +1,78 @@
+package conversation_service
+
+import (
+	"../message_service"
+	"fmt"
+	"time"
+)
+
+/**************************************************************************
+* R E T E N T I O N
+**************************************************************************/
+
+/*
+A conversation can have a retention policy, which limits how long its messages are kept:
+-- RetentionDays (int): messages older than this many days are pruned
+-- RetentionMaxMessages (int): only this many of the most recent messages are kept
+A value of 0 means that the conversation doesn't have a limit of its own, and the global policy (see retention_service) applies.
+*/
+
+// Given a conversation, set its own retention policy (overriding the global one). Zero values fall back to the global policy.
+func (c *Conversation) SetRetention(retentionDays, retentionMaxMessages int) error {
+	if retentionDays < 0 || retentionMaxMessages < 0 {
+		return fmt.Errorf("Retention limits cannot be negative")
+	}
+
+	return c.change(func() error {
+		err := c.ensureInLog()
+		if err != nil {
+			return err
+		}
+		c.RetentionDays = retentionDays
+		c.RetentionMaxMessages = retentionMaxMessages
+		return c.persistSettings()
+	})
+}
+
+// Given a conversation, removes the messages that are older than retentionDays, or that are beyond the most recent retentionMaxMessages.
+// A limit of 0 is not applied. The pruned messages are deleted through the event log (and their content redacted from it).
+// What is pruned is worked out on the latest state of the conversation, and handed to record as part of the same change,
+// so the caller can tell exactly what was pruned, even if pruning fails partway through.
+func (c *Conversation) ApplyRetention(retentionDays, retentionMaxMessages int, now time.Time, record func(pruned []message_service.Message) error) error {
+	err := c.change(func() error {
+		pruned, err := c.dropMessages(c.retentionPrunedIds(retentionDays, retentionMaxMessages, now), DeleteReasonRetention)
+		if len(pruned) > 0 {
+			recordErr := record(pruned)
+			if err == nil {
+				err = recordErr
+			}
+		}
+		return err
+	})
+	if err != nil {
+		return err
+	}
+	return c.redactRemoved()
+}
+
+/**************************************************************************
+* H E L P E R S
+**************************************************************************/
+
+// Given a conversation, returns the ids of the messages that its retention limits don't allow to be kept at the provided time
+func (c *Conversation) retentionPrunedIds(retentionDays, retentionMaxMessages int, now time.Time) []int {
+	// Since messages are ordered with the oldest first, the messages to drop for the max messages limit are the first ones
+	var overflow int
+	if retentionMaxMessages > 0 && len(c.Messages) > retentionMaxMessages {
+		overflow = len(c.Messages) - retentionMaxMessages
+	}
+	cutoff := now.AddDate(0, 0, -retentionDays)
+
+	var prunedIds []int
+	for i, m := range c.Messages {
+		if i < overflow || (retentionDays > 0 && m.TimestampCreated.Before(cutoff)) {
+			prunedIds = append(prunedIds, m.Id)
+		}
+	}
+	return prunedIds
+}
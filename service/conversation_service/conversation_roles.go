@@ -0,0 +1,281 @@
+package conversation_service
+
+import (
+	"../message_service"
+	"fmt"
+)
+
+/**************************************************************************
+* R O L E S  &  P E R M I S S I O N S
+**************************************************************************/
+
+/*
+Every member of a channel (see conversation_channel.go) has a role, which decides what they can do in the channel besides sending messages:
+-- owner: the member who created the channel (see CreatedBy), until they transfer the ownership to another member.
+-- -- The owner can do everything admins can, appoint and dismiss admins, and transfer the ownership.
+-- admin: can delete the messages of other members, change the topic of the channel, add and remove members, and invite users into it (see conversation_invite.go).
+-- member: everyone else. Members can only edit and delete their own messages.
+
+Conversations that aren't channels don't have roles: their members are all equal, and they can all change its info,
+but only the sender of a message can delete it. Nobody can edit a message sent by someone else, whatever their role.
+
+Roles are kept in the channel (Roles), which only lists the members whose role isn't plain member, except for the owner.
+Every change of role is announced in the channel with a system message, and recorded in the message log with a roles event.
+
+Every action that depends on the role of a member goes through CheckPermission (or checkCanEdit and checkCanDelete for messages),
+so what each role can do is only decided in one place (rolePermissions, and conversationPermissions for conversations that aren't channels).
+*/
+
+// Define the type for the Role of a member
+type Role string
+
+// Roles that a member of a conversation can have
+const (
+	RoleOwner  Role = "owner"
+	RoleAdmin  Role = "admin"
+	RoleMember Role = "member"
+)
+
+// Define the type for a Permission to do something in a conversation
+type Permission string
+
+// Things that only some roles can do in a conversation
+const (
+	PermissionDeleteMessages    Permission = "delete the messages of other members"
+	PermissionUpdateInfo        Permission = "change the info"
+	PermissionManageMembers     Permission = "add or remove members"
+	PermissionManageRoles       Permission = "appoint or dismiss admins"
+	PermissionTransferOwnership Permission = "transfer the ownership"
+)
+
+// What each role is allowed to do
+var rolePermissions map[Role][]Permission = map[Role][]Permission{
+	RoleOwner:  []Permission{PermissionDeleteMessages, PermissionUpdateInfo, PermissionManageMembers, PermissionManageRoles, PermissionTransferOwnership},
+	RoleAdmin:  []Permission{PermissionDeleteMessages, PermissionUpdateInfo, PermissionManageMembers},
+	RoleMember: []Permission{},
+}
+
+// What every member of a conversation that isn't a channel can do
+var conversationPermissions []Permission = []Permission{PermissionUpdateInfo}
+
+// Given a conversation, get the role of the provided user in it. Users who aren't members of the conversation don't have a role,
+// and the members of a conversation that isn't a channel are all plain members.
+func (c *Conversation) GetRole(userId string) (Role, error) {
+	if !c.IsMember(userId) {
+		return "", fmt.Errorf("User %s is not a member of the conversation", userId)
+	}
+	if c.ChannelName == "" {
+		return RoleMember, nil
+	}
+	if role, exists := c.Roles[userId]; exists {
+		return role, nil
+	}
+	if userId == c.owner() {
+		return RoleOwner, nil
+	}
+	return RoleMember, nil
+}
+
+// Given a conversation, get the role of each of its members, by user id
+func (c *Conversation) GetRoles() map[string]Role {
+	var roles map[string]Role = make(map[string]Role)
+	for _, userId := range c.UserIds {
+		roles[userId], _ = c.GetRole(userId)
+	}
+	return roles
+}
+
+// Given a conversation, checks that the provided user is allowed to do what the provided permission is for
+func (c *Conversation) CheckPermission(userId string, p Permission) error {
+	role, err := c.GetRole(userId)
+	if err != nil {
+		return err
+	}
+	var permissions []Permission = rolePermissions[role]
+	if c.ChannelName == "" {
+		permissions = conversationPermissions
+	}
+	for _, allowed := range permissions {
+		if allowed == p {
+			return nil
+		}
+	}
+	if c.ChannelName == "" {
+		return fmt.Errorf("Only channels have an owner and admins, who can %s", p)
+	}
+	return fmt.Errorf("Only the %s of the conversation can %s", describeRolesWith(p), p)
+}
+
+// Given a conversation, makes the provided member an admin (or a plain member again) on behalf of the provided user
+func (c *Conversation) SetRole(by, userId string, role Role) error {
+	if role != RoleAdmin && role != RoleMember {
+		return fmt.Errorf("Invalid role %q: members can only be made %s or %s", role, RoleAdmin, RoleMember)
+	}
+	var changed bool
+	err := c.change(func() error {
+		err := c.CheckPermission(by, PermissionManageRoles)
+		if err != nil {
+			return err
+		}
+		current, err := c.GetRole(userId)
+		if err != nil {
+			return err
+		}
+		if current == RoleOwner {
+			return fmt.Errorf("The role of the owner can only change by transferring the ownership")
+		}
+		changed = current != role
+		if !changed {
+			return nil
+		}
+
+		err = c.ensureInLog()
+		if err != nil {
+			return err
+		}
+		c.Roles = c.rolesWith(map[string]Role{userId: role})
+		return c.persistRoles()
+	})
+	if err != nil || !changed {
+		return err
+	}
+
+	if role == RoleAdmin {
+		return c.announce(by, fmt.Sprintf("made %s an admin", userId))
+	}
+	return c.announce(by, fmt.Sprintf("removed %s as an admin", userId))
+}
+
+// Given a conversation, transfers its ownership from the provided user to another member. The previous owner stays on as an admin.
+func (c *Conversation) TransferOwnership(by, userId string) error {
+	if userId == by {
+		return fmt.Errorf("User %s already owns the conversation", userId)
+	}
+	err := c.change(func() error {
+		err := c.CheckPermission(by, PermissionTransferOwnership)
+		if err != nil {
+			return err
+		}
+		if !c.IsMember(userId) {
+			return fmt.Errorf("User %s is not a member of the conversation", userId)
+		}
+
+		err = c.ensureInLog()
+		if err != nil {
+			return err
+		}
+		c.Roles = c.rolesWith(map[string]Role{userId: RoleOwner, by: RoleAdmin})
+		return c.persistRoles()
+	})
+	if err != nil {
+		return err
+	}
+
+	return c.announce(by, fmt.Sprintf("transferred the ownership to %s", userId))
+}
+
+/**************************************************************************
+* H E L P E R S
+**************************************************************************/
+
+// Given a conversation, checks that the provided user can edit the provided message. Only the sender of a message can edit it.
+func (c *Conversation) checkCanEdit(userId string, m *message_service.Message) error {
+	if m.From != userId {
+		return fmt.Errorf("Only the sender of a message can edit it")
+	}
+	return nil
+}
+
+// Given a conversation, checks that the provided user can delete the provided message: their own, or anyone's if they're allowed to in a channel
+func (c *Conversation) checkCanDelete(userId string, m *message_service.Message) error {
+	if m.From == userId {
+		return nil
+	}
+	if c.ChannelName == "" {
+		return fmt.Errorf("Only the sender of a message can delete it")
+	}
+	return c.CheckPermission(userId, PermissionDeleteMessages)
+}
+
+// Given a conversation, get the user id of its owner
+func (c *Conversation) owner() string {
+	for userId, role := range c.Roles {
+		if role == RoleOwner {
+			return userId
+		}
+	}
+	return c.CreatedBy
+}
+
+// Given a conversation, tells whether the provided user is one of its members
+func (c *Conversation) IsMember(userId string) bool {
+	for _, memberId := range c.UserIds {
+		if memberId == userId {
+			return true
+		}
+	}
+	return false
+}
+
+// Given a conversation, get a copy of its roles with the provided changes. The roles are never changed in place, since copies of the conversation (e.g. in the cache) share them.
+// Plain members aren't listed, but the owner always is, so who owns the conversation doesn't depend on CreatedBy anymore.
+func (c *Conversation) rolesWith(changes map[string]Role) map[string]Role {
+	var roles map[string]Role = make(map[string]Role)
+	if owner := c.owner(); owner != "" {
+		roles[owner] = RoleOwner
+	}
+	for userId, role := range c.Roles {
+		roles[userId] = role
+	}
+	for userId, role := range changes {
+		roles[userId] = role
+	}
+	for userId, role := range roles {
+		if role == RoleMember {
+			delete(roles, userId)
+		}
+	}
+	return roles
+}
+
+// Given a conversation, record a change to its roles. The roles should already be set on the conversation.
+func (c *Conversation) persistRoles() error {
+	var roles Conversation = Conversation{Roles: c.Roles}
+	return c.persistEvent(messageEvent{Type: eventTypeRoles, Conversation: &roles})
+}
+
+// Given some roles, get a copy of them where the role of a user (if they have one) is given to another user id, e.g. because the user was renamed
+func renameRole(roles map[string]Role, oldUserId, newUserId string) map[string]Role {
+	if _, exists := roles[oldUserId]; !exists {
+		return roles
+	}
+	var renamed map[string]Role = make(map[string]Role)
+	for userId, role := range roles {
+		if userId == oldUserId {
+			userId = newUserId
+		}
+		renamed[userId] = role
+	}
+	return renamed
+}
+
+// Given a permission, lists the roles that have it, for error messages (e.g. "owner or admins")
+func describeRolesWith(p Permission) string {
+	var names string
+	for _, role := range []Role{RoleOwner, RoleAdmin} {
+		for _, allowed := range rolePermissions[role] {
+			if allowed != p {
+				continue
+			}
+			name := string(role)
+			if role != RoleOwner {
+				name += "s"
+			}
+			if names != "" {
+				names += " or "
+			}
+			names += name
+		}
+	}
+	return names
+}
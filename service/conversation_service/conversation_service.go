@@ -6,6 +6,7 @@ import (
 	"github.com/teejays/gofiledb"
 	"sort"
 	"strings"
+	"time"
 )
 
 /**************************************************************************
@@ -16,21 +17,55 @@ import (
 Conversation: A conversation is stored communication between two or more users.
 Structure:
 -- UserIds: an array of user ids of all the users that are a part of a conversation.
+-- ChannelName (string): If set, the conversation is a public channel (see conversation_channel.go), and its members can come and go.
 -- Messages: An array of Message between the UserIds, ordered with the oldest up first.
 -- LastMessageId (int): Keeps track of the last (also largest) unique message id so the new messages can be given an appropriate id.
+-- MessageTtlSeconds (int): If set, messages disappear this many seconds after they were sent (see conversation_ttl.go).
+-- RetentionDays, RetentionMaxMessages (int): If set, the retention policy of this conversation (see conversation_retention.go).
+-- Title, Description, AvatarRef (string): Optional info about the conversation, set by its members (see conversation_info.go).
+-- Topic (string): For channels, what the channel is about.
+-- Private (bool): For channels, whether the channel can only be joined with an invite (see conversation_invite.go).
+-- CreatedBy (string), TimestampCreated (time): Who created the conversation, and when.
+-- Roles (map[string]Role): For channels, the members who are the owner or admins of the channel (see conversation_roles.go).
+-- PinnedMessages: The messages that have been pinned in the conversation, in the order they were pinned (see conversation_pins.go).
+-- LogSequence (int): The sequence number of the last event (see conversation_log.go) included in this conversation.
+-- LogOffset (int): Where the events after LogSequence start in the message log file.
+-- Settings (MemberSettings): The settings (mute, archive, pin) of the user who lists the conversation, only filled in when a user lists its conversations (see conversation_inbox.go).
 */
 
 /* How are the conversations stored in the DB?
--- Each individual conversation is stored as a separate file
--- Name of the files follow the pattern: "conversation_<userid>_<userid>"
+-- Every change to a conversation is recorded as an event in an append-only log, and each individual conversation is also stored as a separate file (a snapshot)
+-- Name of the files follow the pattern: "conversation_<userid>_<userid>", or "channel_<name>" for channels
 -- ^ The filename is also the "key" that the DB client uses while storing an object
+-- See conversation_log.go for how the log and the snapshot work together
 */
 
 // Define the structure for the Conversation object
 type Conversation struct {
-	UserIds       []string
-	Messages      []message_service.Message
-	LastMessageId int
+	UserIds              []string
+	ChannelName          string
+	Messages             []message_service.Message
+	LastMessageId        int
+	MessageTtlSeconds    int
+	RetentionDays        int
+	RetentionMaxMessages int
+	Title                string
+	Description          string
+	AvatarRef            string
+	Topic                string
+	Private              bool
+	CreatedBy            string
+	TimestampCreated     time.Time
+	Roles                map[string]Role `json:",omitempty"`
+	PinnedMessages       []PinnedMessage
+	LogSequence          int
+	LogOffset            int64
+	Settings             *MemberSettings `json:",omitempty"`
+
+	inLog                bool // whether the message log has the create event of this conversation
+	loaded               bool // whether this copy was loaded from the database, rather than built by the caller
+	eventsSinceSnapshot  int  // number of events in the log that are not part of the snapshot yet
+	removedSinceSnapshot bool // whether messages were removed by a policy or a moderator since the last snapshot, so their content is still in the log
 }
 
 // Since we store the conversations in the database, we need to have a collection name it.
@@ -38,12 +73,40 @@ var conversationCollectionName string = "conversation"
 
 // Given a list of user ids, load and return the conversation between them
 func GetConversationByUserIds(userIds []string) (*Conversation, error) {
+	return getConversation(Conversation{UserIds: userIds})
+}
+
+// Given an empty conversation that knows its key (from its members, or the name of its channel), load and return the whole conversation
+func getConversation(blank Conversation) (*Conversation, error) {
+	// Hot conversations are kept in a cache (see conversation_cache.go), so we only need to load it if it's not there
+	c, cached := cacheGet(blank.UniqueKey())
+	if !cached {
+		var err error
+		c, err = loadConversation(blank)
+		if err != nil {
+			return nil, err
+		}
+		cachePut(c)
+	}
+
+	// Remove the messages that have expired but haven't been removed by the reaper yet
+	err := c.removeMessages(c.expiredMessageIds(time.Now()), DeleteReasonExpired)
+	if err != nil {
+		return nil, err
+	}
+	c.setMessageExpiry()
+
+	return c, nil
+}
+
+// Given an empty conversation that knows its key, load the conversation from its snapshot and event log
+func loadConversation(blank Conversation) (*Conversation, error) {
 
 	// Initialize an empty conversation variable so we can load the saved conversation file into it
 	var c Conversation
 
 	// First we need to get the key used to store the conversation
-	key := uniqueConversationKey(userIds)
+	key := blank.UniqueKey()
 
 	// Get the db client and then get the conversation using the key
 	db := gofiledb.GetClient()
@@ -52,113 +115,216 @@ func GetConversationByUserIds(userIds []string) (*Conversation, error) {
 		return nil, err
 	}
 	// If the conversation doesn't exist between the given users
-	// Return the empty conversation object after setting the UserIds field
+	// Return the empty conversation object that we were given
 	if !exists {
-		c.UserIds = userIds
+		c = blank
+	}
+
+	// Apply all the changes that happened since the snapshot was saved
+	err = c.replayLog()
+	if err != nil {
+		return nil, err
 	}
+	// Conversations from before we kept track of who created them were created by whoever sent the first message
+	c.fillCreated()
+	c.loaded = true
+
 	return &c, nil
 }
 
 // Given a conversation, add a new message to it.
 func (c *Conversation) AddMessage(m message_service.Message) (int, error) {
-	// Make sure that the message is valid, passes sanity checks
+	// Clean up the message, and make sure that it is valid, passes sanity checks
+	m.Sanitize()
 	err := m.Validate()
 	if err != nil {
 		return -1, err
 	}
 
+	err = c.change(func() error {
+		// Only the members of a channel can send messages in it (announcements are about them, so they can be about members who just left)
+		if c.ChannelName != "" && !m.System && !c.IsMember(m.From) {
+			return fmt.Errorf("Only the members of channel %s can send messages in it", c.ChannelName)
+		}
+
+		return c.appendMessage(&m)
+	})
+	if err != nil {
+		return -1, err
+	}
+	return m.Id, nil
+}
+
+// Given a conversation, adds a message (that is already valid) to it, and records it in its log. It should be called from within a change.
+func (c *Conversation) appendMessage(m *message_service.Message) error {
+	err := c.ensureInLog()
+	if err != nil {
+		return err
+	}
+
 	// Assign a new message id to the message
 	// The new message id is the message id of the last added message + 1
 	// We store the message id of the last added message in the LastMessageId field in Conversation
 	m.Id = c.LastMessageId + 1
 	c.LastMessageId++
 
-	// Append the new message to the conversation messages
-	c.Messages = append(c.Messages, m)
+	// Append the new message to the conversation messages, and let it know when it expires (if it does)
+	c.Messages = append(c.Messages, *m)
+	c.fillCreated()
+	c.setMessageExpiry()
 
-	// Save the conversation
-	err = c.Save()
-	if err != nil {
-		return -1, err
-	}
-	return m.Id, nil
+	// Record the new message in the conversation's log
+	return c.persistEvent(messageEvent{Type: eventTypeAdd, Message: *m})
 }
 
-// Given a conversation, a sender, and a message id, edit the message to the new content
-func (c *Conversation) EditMessage(messageId int, newContent string, from string) error {
+// Given a conversation, the user editing, and a message id, edit the message to the new content
+func (c *Conversation) EditMessage(messageId int, newContent string, by string) error {
+	return c.change(func() error {
 
-	// Before we can edit the message, we need to find it
-	// Loop through all the messages to find a message that has the provided message id, and is sent by the provided user id
-	var message *message_service.Message
-	for i := 0; i < len(c.Messages); i++ {
-		if c.Messages[i].Id == messageId && c.Messages[i].From == from {
-			// If we find such message, we should store a reference to it, and end the loop
-			message = &c.Messages[i]
-			break
-		}
-	}
+		// Before we can edit the message, we need to find it
+		message := c.findMessage(messageId)
 
-	// If the message we are looking for is not found in the above loop, return an error
-	if message == nil {
-		return fmt.Errorf("No message found in the conversation with message id %d", messageId)
-	}
+		// If the message we are looking for is not found, return an error
+		if message == nil {
+			return fmt.Errorf("No message found in the conversation with message id %d", messageId)
+		}
+		// Only the sender can edit a message (see conversation_roles.go)
+		err := c.checkCanEdit(by, message)
+		if err != nil {
+			return err
+		}
+		// Forwarded messages should keep saying what the original said (see conversation_forward.go), and system messages what changed (see conversation_info.go)
+		if message.ForwardedFrom != nil {
+			return fmt.Errorf("Forwarded messages cannot be edited")
+		}
+		if message.System {
+			return fmt.Errorf("System messages cannot be edited")
+		}
 
-	// If the message is found, edit the content of the message
-	err := message.Edit(newContent)
-	if err != nil {
-		return err
-	}
+		err = c.ensureInLog()
+		if err != nil {
+			return err
+		}
 
-	// Save the conversation with the edited message
-	err = c.Save()
-	if err != nil {
-		return err
-	}
+		// If the message is found, edit the content of the message
+		err = message.Edit(newContent)
+		if err != nil {
+			return err
+		}
 
-	return nil
+		// Record the edited message in the conversation's log
+		return c.persistEvent(messageEvent{Type: eventTypeEdit, Message: *message})
+	})
 }
 
-// Given a conversation, a sender, and a message id, delete that message from the record
-func (c *Conversation) DeleteMessage(messageId int, from string) error {
+// Given a conversation, the user deleting, and a message id, delete that message from the record
+func (c *Conversation) DeleteMessage(messageId int, by string) error {
+	return c.change(func() error {
+
+		// Before we can delete the message, we need to find it
+		// Loop through all the messages to find a message that has the provided message id
+		var messageExists bool
+		var messageIndex int
+		for i := 0; i < len(c.Messages); i++ {
+			if c.Messages[i].Id == messageId {
+				// If we find such message, we should store a reference to it, and end the loop
+				messageExists = true
+				messageIndex = i
+				break
+			}
+		}
+
+		// If the message we're looking for is not found, return an error
+		if !messageExists {
+			return fmt.Errorf("No message found with the given params")
+		}
+		// System messages are the record of what changed in the conversation (see conversation_info.go)
+		if c.Messages[messageIndex].System {
+			return fmt.Errorf("System messages cannot be deleted")
+		}
+		// Members can delete their own messages, and the admins of a channel anyone's (see conversation_roles.go)
+		err := c.checkCanDelete(by, &c.Messages[messageIndex])
+		if err != nil {
+			return err
+		}
+		var reason string = DeleteReasonUser
+		if c.Messages[messageIndex].From != by {
+			reason = DeleteReasonModerator
+		}
+
+		err = c.ensureInLog()
+		if err != nil {
+			return err
+		}
+
+		// If found, remove it from the message array of the conversation, along with its pin
+		var deleted message_service.Message = c.Messages[messageIndex]
+		c.Messages = append(c.Messages[0:messageIndex], c.Messages[messageIndex+1:]...)
+		c.removePin(messageId)
 
-	// Before we can delete the message, we need to find it
-	// Loop through all the messages to find a message that has the provided message id, and is sent by the provided user id
-	var messageExists bool
-	var messageIndex int
+		// Record the deletion in the conversation's log
+		return c.persistEvent(messageEvent{Type: eventTypeDelete, MessageId: messageId, Reason: reason, deleted: deleted})
+	})
+}
+
+// Given a conversation, removes the message with the provided id on behalf of a moderator (see moderation_service), whoever sent it, and returns it.
+// Unlike a member deleting a message, its content is also redacted from the log.
+func (c *Conversation) RemoveMessage(messageId int) (*message_service.Message, error) {
 	for i := 0; i < len(c.Messages); i++ {
-		if c.Messages[i].Id == messageId && c.Messages[i].From == from {
-			// If we find such message, we should store a reference to it, and end the loop
-			messageExists = true
-			messageIndex = i
-			break
+		if c.Messages[i].Id != messageId {
+			continue
+		}
+		// System messages are the record of what changed in the conversation (see conversation_info.go)
+		if c.Messages[i].System {
+			return nil, fmt.Errorf("System messages cannot be deleted")
 		}
+		var removed message_service.Message = c.Messages[i]
+		err := c.removeMessages([]int{messageId}, DeleteReasonModerator)
+		if err != nil {
+			return nil, err
+		}
+		return &removed, c.redactRemoved()
 	}
+	return nil, fmt.Errorf("No message found with the given params")
+}
 
-	// If the message we're looking for is not found, return an error
-	if !messageExists {
-		return fmt.Errorf("No message found with the given params")
+// Given a conversation, populate the ContentHtml field of all of its messages so clients can display them as is
+func (c *Conversation) RenderMessages() {
+	for i := 0; i < len(c.Messages); i++ {
+		c.Messages[i].ContentHtml = c.Messages[i].RenderHtml()
 	}
+}
 
-	// If found, remove it from the message array of the conversation
-	c.Messages = append(c.Messages[0:messageIndex], c.Messages[messageIndex+1:]...)
-
-	// Save the conversation
-	err := c.Save()
+// Given a conversation object, saves the whole conversation to the database as a new snapshot, and compacts its log
+// The snapshot is only a cache of the event log (see conversation_log.go), so if the conversation isn't in the log yet, it's recorded there first
+func (c *Conversation) Save() error {
+	err := c.ensureInLog()
 	if err != nil {
 		return err
 	}
+	offset, err := compactLog(c)
+	if err != nil {
+		return err
+	}
+	c.LogOffset = offset
 
-	return nil
-}
-
-// Given a conversation object, saves the conversation to the database
-func (c *Conversation) Save() error {
 	db := gofiledb.GetClient()
-	return db.SetStruct(conversationCollectionName, c.UniqueKey(), c)
+	err = db.SetStruct(conversationCollectionName, c.UniqueKey(), c)
+	if err != nil {
+		return err
+	}
+	c.eventsSinceSnapshot = 0
+	c.removedSinceSnapshot = false
+	cachePut(c)
+	return c.UpdateInbox()
 }
 
 // Given a conversatoin object, returns the unique key that is used to refer to the object while saving and loading in the database
 func (c *Conversation) UniqueKey() string {
+	// The members of a channel change, so its key can't depend on them
+	if c.ChannelName != "" {
+		return uniqueChannelKey(c.ChannelName)
+	}
 	return uniqueConversationKey(c.UserIds)
 }
 
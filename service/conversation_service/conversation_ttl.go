@@ -0,0 +1,159 @@
+package conversation_service
+
+import (
+	"fmt"
+	"github.com/teejays/gofiledb"
+	"log"
+	"sync"
+	"time"
+)
+
+/**************************************************************************
+* D I S A P P E A R I N G  M E S S A G E S
+**************************************************************************/
+
+/*
+A conversation can have a message time-to-live (MessageTtlSeconds). When it's set (> 0), every message in the conversation
+expires MessageTtlSeconds after it was created (TimestampCreated), and is removed from the conversation.
+
+-- When a conversation is loaded, expired messages that the reaper hasn't gotten to yet are removed, and every message gets a TimestampExpires so clients know when it will disappear.
+-- Expired messages are deleted through the event log, and their content is redacted from it (see conversation_log.go).
+-- A background reaper (see user_service.StartMessageReaper) periodically goes through all the conversations that have a TTL, and removes their expired messages from the database.
+-- To find those conversations quickly, we maintain an index (in-memory, with a copy in the db) of the keys of all the conversations that have a TTL.
+*/
+
+// ttlIndex maps the key of every conversation that has a message TTL to the user ids of that conversation
+var ttlIndex map[string][]string
+var ttlIndexLock sync.Mutex
+var ttlCollectionName string = "conversation_ttl" // name of the collection when storing the index in the db
+
+// Given a conversation, set the time-to-live of its messages. A ttl of 0 turns disappearing messages off.
+func (c *Conversation) SetMessageTtl(ttlSeconds int) error {
+	if ttlSeconds < 0 {
+		return fmt.Errorf("Message TTL cannot be negative")
+	}
+
+	err := c.change(func() error {
+		err := c.ensureInLog()
+		if err != nil {
+			return err
+		}
+		c.MessageTtlSeconds = ttlSeconds
+		return c.persistSettings()
+	})
+	if err != nil {
+		return err
+	}
+
+	// The messages that have already expired under the new TTL should go away right away, from the log too
+	err = c.removeMessages(c.expiredMessageIds(time.Now()), DeleteReasonExpired)
+	if err != nil {
+		return err
+	}
+	err = c.redactRemoved()
+	if err != nil {
+		return err
+	}
+	c.setMessageExpiry()
+
+	// Keep the index up to date, so the reaper knows whether to look at this conversation
+	ttlIndexLock.Lock()
+	defer ttlIndexLock.Unlock()
+	if ttlSeconds > 0 {
+		ttlIndex[c.UniqueKey()] = c.UserIds
+	} else {
+		delete(ttlIndex, c.UniqueKey())
+	}
+	return saveTtlIndex()
+}
+
+// Goes through all the conversations that have a message TTL, and removes the messages that have expired by the provided time.
+// Their members shouldn't be renamed meanwhile, so it's run through user_service.ExpireMessages.
+// A conversation that can't be expired is skipped (and logged), so it doesn't hold up the others.
+func ExpireMessages(now time.Time) error {
+	// Loading and changing the conversations takes a while, so the index isn't held on to meanwhile (setting a TTL would have to wait for all of it)
+	ttlIndexLock.Lock()
+	var conversations map[string][]string = make(map[string][]string)
+	for key, userIds := range ttlIndex {
+		conversations[key] = userIds
+	}
+	ttlIndexLock.Unlock()
+
+	for key, userIds := range conversations {
+		err := expireConversationMessages(userIds, now)
+		if err != nil {
+			log.Printf("Could not expire the messages of conversation %s: %s", key, err)
+		}
+	}
+	return nil
+}
+
+// Given the user ids of a conversation that has a message TTL, removes the messages of the conversation that have expired by the provided time
+func expireConversationMessages(userIds []string, now time.Time) error {
+	c, err := loadConversation(Conversation{UserIds: userIds})
+	if err != nil {
+		return err
+	}
+
+	err = c.removeMessages(c.expiredMessageIds(now), DeleteReasonExpired)
+	if err != nil {
+		return err
+	}
+	// Messages that expired while the conversation was being read were removed then, so their content might still be in the log too
+	return c.redactRemoved()
+}
+
+// Upon start of the application, this function loads the index of the conversations with a message TTL into memory from the db
+func LoadTtlIndexToMemory() error {
+	ttlIndexLock.Lock()
+	defer ttlIndexLock.Unlock()
+
+	db := gofiledb.GetClient()
+	exists, err := db.GetStructIfExists(ttlCollectionName, "ttl_index", &ttlIndex)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		ttlIndex = make(map[string][]string)
+	}
+	return nil
+}
+
+/**************************************************************************
+* H E L P E R S
+**************************************************************************/
+
+// Given a conversation, returns the ids of the messages that have expired by the provided time
+func (c *Conversation) expiredMessageIds(now time.Time) []int {
+	// If the conversation doesn't have a TTL, none of its messages expire
+	if c.MessageTtlSeconds <= 0 {
+		return nil
+	}
+
+	ttl := time.Duration(c.MessageTtlSeconds) * time.Second
+	var expired []int
+	for _, m := range c.Messages {
+		if !m.TimestampCreated.Add(ttl).After(now) {
+			expired = append(expired, m.Id)
+		}
+	}
+	return expired
+}
+
+// Given a conversation, sets the time at which each of its messages expires (if the conversation has a TTL)
+func (c *Conversation) setMessageExpiry() {
+	ttl := time.Duration(c.MessageTtlSeconds) * time.Second
+	for i := 0; i < len(c.Messages); i++ {
+		c.Messages[i].TimestampExpires = nil
+		if c.MessageTtlSeconds > 0 {
+			expires := c.Messages[i].TimestampCreated.Add(ttl)
+			c.Messages[i].TimestampExpires = &expires
+		}
+	}
+}
+
+// Saves the TTL index into the database so we don't lose it. The caller should be holding the index lock.
+func saveTtlIndex() error {
+	db := gofiledb.GetClient()
+	return db.SetStruct(ttlCollectionName, "ttl_index", &ttlIndex)
+}
@@ -0,0 +1,215 @@
+package message_service
+
+import (
+	"fmt"
+	"html"
+	"regexp"
+	"strings"
+	"unicode"
+)
+
+/**************************************************************************
+* F O R M A T
+**************************************************************************/
+
+/*
+Format: Tells us how the Content of a message should be interpreted.
+-- plain: the content is shown as is.
+-- markdown: the content uses a (small) subset of markdown:
+-- -- **bold**, *italic* or _italic_, ~~strikethrough~~, `inline code`, [links](https://...)
+-- -- ``` fenced code blocks, "- " or "* " bullet lists, and blank lines between paragraphs
+
+We never trust the content of a message to be safe HTML. When rendering, we always escape the content first,
+and only then add the HTML tags that our markdown subset allows. That way no raw HTML sent by a user ever reaches the client.
+*/
+
+const (
+	FormatPlain    string = "plain"
+	FormatMarkdown string = "markdown"
+)
+
+// All the formats that a message can have
+var validFormats map[string]bool = map[string]bool{
+	FormatPlain:    true,
+	FormatMarkdown: true,
+}
+
+// Given a message, clean up its content and format so they are safe to store
+func (m *Message) Sanitize() {
+	// Messages stored before formats were introduced don't have one, so they are plain text
+	m.Format = strings.ToLower(strings.Trim(m.Format, " "))
+	if m.Format == "" {
+		m.Format = FormatPlain
+	}
+
+	// Remove any control characters (except new lines and tabs) since they have no business being in a chat message
+	m.Content = strings.Map(func(r rune) rune {
+		if r == '\n' || r == '\t' {
+			return r
+		}
+		if unicode.IsControl(r) {
+			return -1
+		}
+		return r
+	}, m.Content)
+}
+
+// Given a message, make sure that its format is one that we support
+func (m *Message) validateFormat() error {
+	// An empty format is treated as plain
+	if m.Format == "" {
+		return nil
+	}
+	if !validFormats[m.Format] {
+		return fmt.Errorf("Message validation failed: unsupported format '%s'", m.Format)
+	}
+	return nil
+}
+
+// Given a message, returns a safe HTML representation of its content
+func (m *Message) RenderHtml() string {
+	if m.Format == FormatMarkdown {
+		return renderMarkdown(m.Content)
+	}
+	return renderPlain(m.Content)
+}
+
+/**************************************************************************
+* H E L P E R S
+**************************************************************************/
+
+// Plain text only needs to be escaped, and have its new lines preserved
+func renderPlain(content string) string {
+	lines := strings.Split(content, "\n")
+	for i := range lines {
+		lines[i] = html.EscapeString(lines[i])
+	}
+	return strings.Join(lines, "<br>")
+}
+
+// Renders our subset of markdown into HTML, block by block
+func renderMarkdown(content string) string {
+	var out []string
+
+	// Keep track of the block we're in the middle of building
+	var paragraph []string
+	var list []string
+	var code []string
+	var inCode bool
+
+	flushParagraph := func() {
+		if len(paragraph) > 0 {
+			out = append(out, "<p>"+strings.Join(paragraph, "<br>")+"</p>")
+			paragraph = nil
+		}
+	}
+	flushList := func() {
+		if len(list) > 0 {
+			out = append(out, "<ul><li>"+strings.Join(list, "</li><li>")+"</li></ul>")
+			list = nil
+		}
+	}
+
+	for _, line := range strings.Split(content, "\n") {
+		trimmed := strings.TrimSpace(line)
+
+		// Fenced code blocks: everything inside is escaped, but not formatted
+		if strings.HasPrefix(trimmed, "```") {
+			if inCode {
+				out = append(out, "<pre><code>"+strings.Join(code, "\n")+"</code></pre>")
+				code = nil
+				inCode = false
+			} else {
+				flushParagraph()
+				flushList()
+				inCode = true
+			}
+			continue
+		}
+		if inCode {
+			code = append(code, html.EscapeString(line))
+			continue
+		}
+
+		switch {
+		case trimmed == "":
+			// A blank line ends whatever block we were in
+			flushParagraph()
+			flushList()
+		case strings.HasPrefix(trimmed, "- ") || strings.HasPrefix(trimmed, "* "):
+			flushParagraph()
+			list = append(list, renderInline(trimmed[2:]))
+		default:
+			flushList()
+			paragraph = append(paragraph, renderInline(trimmed))
+		}
+	}
+
+	// If a code block was never closed, still show what we have
+	if inCode {
+		out = append(out, "<pre><code>"+strings.Join(code, "\n")+"</code></pre>")
+	}
+	flushParagraph()
+	flushList()
+
+	return strings.Join(out, "")
+}
+
+// Regular expressions for the inline markdown elements. They are applied on already escaped text.
+var (
+	mdLinkRegex   = regexp.MustCompile(`\[([^\]]+)\]\(([^)\s]+)\)`)
+	mdBoldRegex   = regexp.MustCompile(`\*\*([^*]+)\*\*`)
+	mdStrikeRegex = regexp.MustCompile(`~~([^~]+)~~`)
+	mdItalicRegex = regexp.MustCompile(`\*([^*]+)\*|\b_([^_]+)_\b`)
+)
+
+// Only these kinds of links are allowed, so things like javascript: urls never get rendered
+var allowedLinkPrefixes []string = []string{"http://", "https://", "mailto:"}
+
+// Renders the inline elements (bold, italic, code etc.) of a single line
+func renderInline(line string) string {
+	// Split the line on backticks: every odd part is inline code, and shouldn't be formatted any further
+	parts := strings.Split(line, "`")
+	// An unmatched backtick is just a backtick
+	if len(parts)%2 == 0 {
+		parts[len(parts)-2] += "`" + parts[len(parts)-1]
+		parts = parts[:len(parts)-1]
+	}
+
+	for i := range parts {
+		escaped := html.EscapeString(parts[i])
+		if i%2 == 1 {
+			parts[i] = "<code>" + escaped + "</code>"
+			continue
+		}
+
+		// Urls often have *, _ or ~~ in them, so only the text around the links, and the text of the links, is formatted
+		var formatted string
+		var last int
+		for _, match := range mdLinkRegex.FindAllStringSubmatchIndex(escaped, -1) {
+			formatted += formatInline(escaped[last:match[0]])
+			formatted += renderLink(formatInline(escaped[match[2]:match[3]]), escaped[match[4]:match[5]])
+			last = match[1]
+		}
+		parts[i] = formatted + formatInline(escaped[last:])
+	}
+	return strings.Join(parts, "")
+}
+
+// Formats the bold, strikethrough and italic elements of some (already escaped) text
+func formatInline(text string) string {
+	text = mdBoldRegex.ReplaceAllString(text, "<strong>$1</strong>")
+	text = mdStrikeRegex.ReplaceAllString(text, "<del>$1</del>")
+	return mdItalicRegex.ReplaceAllString(text, "<em>$1$2</em>")
+}
+
+// Renders a single markdown link, given its (already formatted) text and its (already escaped) url, if the url is allowed
+func renderLink(text, url string) string {
+	for _, prefix := range allowedLinkPrefixes {
+		if strings.HasPrefix(strings.ToLower(url), prefix) {
+			return `<a href="` + url + `" rel="nofollow noopener" target="_blank">` + text + `</a>`
+		}
+	}
+	// If the link is not allowed, just show the text
+	return text
+}
@@ -19,6 +19,19 @@ Message: The most basic data unit that makes a conversation.
 -- -- TimestampCreated (time): when the message was sent
 -- -- TimestampUpdated (time): when the message was last updated
 -- -- From (string): contributed the message in a conversation
+-- -- Format (string): how the content should be interpreted, "plain" or "markdown" (see message_format.go)
+-- -- ContentHtml (string): a safe HTML rendering of the content, only populated when a client asks for it
+-- -- TimestampExpires (time): when the message will disappear, only set if the conversation has a message TTL
+-- -- ForwardedFrom (ForwardReference): where the message was originally sent, only set if the message was forwarded
+-- -- System (bool): whether the message announces a change to the conversation (e.g. a new title), made by the user in From, rather than being written by them
+
+ForwardReference: Where a forwarded message was originally sent. A message forwarded again still points to where it was first sent.
+-- Structure:
+-- -- From (string): the user id of the original sender
+-- -- ConversationKey (string): the key of the conversation it was originally sent in
+-- -- UserIds ([]string): the user ids of the members of that conversation, unless it's a channel (whose members come and go)
+-- -- MessageId (int): the id of the original message in that conversation
+-- -- TimestampCreated (time): when the original message was sent
 
 */
 
@@ -29,6 +42,20 @@ type Message struct {
 	TimestampCreated time.Time
 	TimestampUpdated time.Time
 	From             string
+	Format           string
+	ContentHtml      string            `json:",omitempty"`
+	TimestampExpires *time.Time        `json:",omitempty"`
+	ForwardedFrom    *ForwardReference `json:",omitempty"`
+	System           bool              `json:",omitempty"`
+}
+
+// Define the structure for a ForwardReference
+type ForwardReference struct {
+	From             string
+	ConversationKey  string
+	UserIds          []string `json:",omitempty"`
+	MessageId        int
+	TimestampCreated time.Time
 }
 
 // Given a message, perform sanity checks to make sure it's valid
@@ -37,6 +64,11 @@ func (m *Message) Validate() error {
 	if strings.Trim(m.Content, " ") == "" {
 		return fmt.Errorf("Message validation failed: empty message")
 	}
+	// If the message has a format, it should be one we know how to handle
+	err := m.validateFormat()
+	if err != nil {
+		return err
+	}
 	return nil
 }
 
@@ -51,6 +83,9 @@ func (m *Message) Edit(newContent string) error {
 	m.Content = newContent
 	m.TimestampUpdated = time.Now()
 
+	// Clean up the new content the same way we did when the message was first sent
+	m.Sanitize()
+
 	// Make sure that the edited message is still valid
 	err := m.Validate()
 	if err != nil {
@@ -0,0 +1,325 @@
+package moderation_service
+
+import (
+	"../conversation_service"
+	"../user_service"
+	"fmt"
+	"github.com/teejays/gofiledb"
+	"strings"
+	"sync"
+	"time"
+)
+
+/**************************************************************************
+* M O D E R A T I O N
+**************************************************************************/
+
+/*
+Admins (configured in the config, per workspace, see config.Admins) can moderate the whole workspace:
+-- list all the users and all the conversations, and read any conversation
+-- delete any message (its content is also redacted from the conversation's log)
+-- suspend users until a given time, ban them for good, and reinstate them
+
+Suspended and banned users can't make any request (see authenticateRequest), and the messages they scheduled are not delivered. Admins can't be suspended.
+
+Everything the admins do here is recorded in a moderation log, so we can later tell who did what, to whom, and when.
+Reading a conversation is recorded too, since it's the only way anyone can read a conversation they're not a part of.
+
+Suspension: A user who isn't allowed to use the app.
+-- Structure:
+-- -- UserId (string): the user who is suspended
+-- -- Until (time): when the suspension ends. If it's not set, the user is banned for good.
+-- -- Reason (string): why the user was suspended
+-- -- By (string): the user id of the admin who suspended the user
+-- -- TimestampCreated (time): when the user was suspended
+
+Just like the buddies map, the suspensions and the moderation log are kept in-memory, with a copy saved in the database.
+*/
+
+// Define the structure for a Suspension
+type Suspension struct {
+	UserId           string
+	Until            *time.Time `json:",omitempty"`
+	Reason           string
+	By               string
+	TimestampCreated time.Time
+}
+
+// LogEntry: A record of one thing an admin did
+type LogEntry struct {
+	Timestamp       time.Time
+	By              string
+	Action          string
+	UserId          string     `json:",omitempty"`
+	ConversationKey string     `json:",omitempty"`
+	MessageId       int        `json:",omitempty"`
+	MessageFrom     string     `json:",omitempty"`
+	Until           *time.Time `json:",omitempty"`
+	Reason          string     `json:",omitempty"`
+}
+
+// Things that admins do, as recorded in the moderation log
+const (
+	ActionViewConversation string = "view_conversation"
+	ActionDeleteMessage    string = "delete_message"
+	ActionSuspend          string = "suspend"
+	ActionBan              string = "ban"
+	ActionReinstate        string = "reinstate"
+)
+
+// UserListing: A registered user, as listed for admins
+type UserListing struct {
+	user_service.Profile
+	Suspension *Suspension `json:",omitempty"`
+}
+
+// ConversationListing: A conversation, as listed for admins, without its messages
+type ConversationListing struct {
+	Key              string
+	UserIds          []string
+	ChannelName      string `json:",omitempty"`
+	MessageCount     int
+	TimestampCreated time.Time
+}
+
+// Limits on moderation
+const (
+	maxReasonLength int = 500
+)
+
+// suspensions maps the user id of every suspended user to its suspension
+var suspensions map[string]*Suspension
+var moderationLog []LogEntry
+var moderationLock sync.Mutex
+var moderationCollectionName string = "moderation" // name of the collection when storing the suspensions and the log in the db
+
+// Get all the registered users, along with their suspension if they have one
+func ListUsers() []UserListing {
+	moderationLock.Lock()
+	defer moderationLock.Unlock()
+
+	var users []UserListing = []UserListing{}
+	for _, p := range user_service.GetAllProfiles() {
+		var listing UserListing = UserListing{Profile: p}
+		if s, exists := suspensions[p.UserId]; exists {
+			var suspension Suspension = *s
+			listing.Suspension = &suspension
+		}
+		users = append(users, listing)
+	}
+	return users
+}
+
+// Get all the conversations and channels, without their messages
+func ListConversations() ([]ConversationListing, error) {
+	convs, err := user_service.GetAllConversations()
+	if err != nil {
+		return nil, err
+	}
+	var listings []ConversationListing = []ConversationListing{}
+	for _, conv := range convs {
+		listings = append(listings, ConversationListing{
+			Key:              conv.UniqueKey(),
+			UserIds:          conv.UserIds,
+			ChannelName:      conv.ChannelName,
+			MessageCount:     len(conv.Messages),
+			TimestampCreated: conv.TimestampCreated,
+		})
+	}
+	return listings, nil
+}
+
+// Given the user ids of a conversation (or the name of a channel), get the conversation on behalf of the provided admin
+func ViewConversation(by string, userIds []string, channelName string) (*conversation_service.Conversation, error) {
+	conv, err := getConversation(userIds, channelName)
+	if err != nil {
+		return nil, err
+	}
+
+	moderationLock.Lock()
+	defer moderationLock.Unlock()
+	return conv, record(LogEntry{Timestamp: time.Now(), By: by, Action: ActionViewConversation, ConversationKey: conv.UniqueKey()})
+}
+
+// Given the user ids of a conversation (or the name of a channel), deletes the message with the provided id on behalf of the provided admin
+func DeleteMessage(by string, userIds []string, channelName string, messageId int, reason string) error {
+	reason = strings.TrimSpace(reason)
+	err := validateReason(reason)
+	if err != nil {
+		return err
+	}
+	conv, err := getConversation(userIds, channelName)
+	if err != nil {
+		return err
+	}
+	removed, err := conv.RemoveMessage(messageId)
+	if err != nil {
+		return err
+	}
+
+	moderationLock.Lock()
+	defer moderationLock.Unlock()
+	return record(LogEntry{
+		Timestamp:       time.Now(),
+		By:              by,
+		Action:          ActionDeleteMessage,
+		ConversationKey: conv.UniqueKey(),
+		MessageId:       removed.Id,
+		MessageFrom:     removed.From,
+		Reason:          reason,
+	})
+}
+
+// Given a user id, suspends the user until the provided time on behalf of the provided admin. If no time is provided, the user is banned for good.
+// Suspending a user who is already suspended replaces their suspension.
+func Suspend(by, userId string, until *time.Time, reason string) error {
+	u, err := user_service.GetUser(userId)
+	if err != nil {
+		return err
+	}
+	if u.IsAdmin() {
+		return fmt.Errorf("User %s is an admin, and can't be suspended", u.UserId)
+	}
+	now := time.Now()
+	if until != nil && !until.After(now) {
+		return fmt.Errorf("Suspension validation failed: it should end in the future")
+	}
+	reason = strings.TrimSpace(reason)
+	err = validateReason(reason)
+	if err != nil {
+		return err
+	}
+
+	moderationLock.Lock()
+	defer moderationLock.Unlock()
+
+	suspensions[u.UserId] = &Suspension{
+		UserId:           u.UserId,
+		Until:            until,
+		Reason:           reason,
+		By:               by,
+		TimestampCreated: now,
+	}
+	var action string = ActionSuspend
+	if until == nil {
+		action = ActionBan
+	}
+	return record(LogEntry{Timestamp: now, By: by, Action: action, UserId: u.UserId, Until: until, Reason: reason})
+}
+
+// Given a user id, lifts the suspension (or the ban) of the user on behalf of the provided admin
+func Reinstate(by, userId string) error {
+	u, err := user_service.GetUser(userId)
+	if err != nil {
+		return err
+	}
+
+	moderationLock.Lock()
+	defer moderationLock.Unlock()
+
+	if _, exists := suspensions[u.UserId]; !exists {
+		return fmt.Errorf("User %s is not suspended", u.UserId)
+	}
+	delete(suspensions, u.UserId)
+	return record(LogEntry{Timestamp: time.Now(), By: by, Action: ActionReinstate, UserId: u.UserId})
+}
+
+// Given a user id, checks that the user isn't suspended (or banned) at the provided time
+func CheckNotSuspended(userId string, now time.Time) error {
+	moderationLock.Lock()
+	defer moderationLock.Unlock()
+
+	s, exists := suspensions[userId]
+	if !exists {
+		return nil
+	}
+	if s.Until == nil {
+		return fmt.Errorf("User %s has been banned", userId)
+	}
+	if now.Before(*s.Until) {
+		return fmt.Errorf("User %s has been suspended until %s", userId, s.Until.Format(time.RFC3339))
+	}
+	return nil
+}
+
+// Get all the entries of the moderation log, oldest first
+func GetModerationLog() []LogEntry {
+	moderationLock.Lock()
+	defer moderationLock.Unlock()
+
+	var entries []LogEntry = make([]LogEntry, len(moderationLog))
+	copy(entries, moderationLog)
+	return entries
+}
+
+// Upon start of the application, this function loads the suspensions and the moderation log into memory from the db
+func LoadModerationToMemory() error {
+	moderationLock.Lock()
+	defer moderationLock.Unlock()
+
+	db := gofiledb.GetClient()
+	exists, err := db.GetStructIfExists(moderationCollectionName, "suspensions", &suspensions)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		suspensions = make(map[string]*Suspension)
+	}
+	exists, err = db.GetStructIfExists(moderationCollectionName, "moderation_log", &moderationLog)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		moderationLog = []LogEntry{}
+	}
+	return nil
+}
+
+/**************************************************************************
+* H E L P E R S
+**************************************************************************/
+
+// Given the user ids of a conversation, or the name of a channel, load the conversation
+func getConversation(userIds []string, channelName string) (*conversation_service.Conversation, error) {
+	if channelName != "" {
+		return conversation_service.GetChannel(channelName)
+	}
+	if len(userIds) < 2 {
+		return nil, fmt.Errorf("A conversation needs at least two user ids, or the name of a channel")
+	}
+
+	// Clean up the user ids the same way they are cleaned up everywhere else, so we find the right conversation
+	var cleanUserIds []string
+	for _, userId := range userIds {
+		u, err := user_service.GetUser(userId)
+		if err != nil {
+			return nil, err
+		}
+		cleanUserIds = append(cleanUserIds, u.UserId)
+	}
+	return conversation_service.GetConversationByUserIds(cleanUserIds)
+}
+
+// Given a reason, it ensures that the reason is valid
+func validateReason(reason string) error {
+	if len(reason) > maxReasonLength {
+		return fmt.Errorf("Moderation validation failed: reason should be at most %d characters", maxReasonLength)
+	}
+	return nil
+}
+
+// Adds an entry to the moderation log, and saves the suspensions along with it. The caller should be holding the moderation lock.
+func record(entry LogEntry) error {
+	moderationLog = append(moderationLog, entry)
+	return saveModeration()
+}
+
+// Saves the suspensions and the moderation log into the database so we don't lose them. The caller should be holding the moderation lock.
+func saveModeration() error {
+	db := gofiledb.GetClient()
+	err := db.SetStruct(moderationCollectionName, "suspensions", &suspensions)
+	if err != nil {
+		return err
+	}
+	return db.SetStruct(moderationCollectionName, "moderation_log", &moderationLog)
+}
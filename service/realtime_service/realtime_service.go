@@ -0,0 +1,90 @@
+package realtime_service
+
+import (
+	"sync"
+	"time"
+)
+
+/**************************************************************************
+* R E A L - T I M E  E V E N T S
+**************************************************************************/
+
+/*
+Clients can keep a connection open (see GET /v1/events) to be told about things as they happen, instead of polling the API.
+This package keeps track of those connections, and hands out events to them. It doesn't know anything about users or conversations,
+it only knows user ids, so any service can use it to push events to a user.
+
+Event: Something that happened, that a user should be told about right away.
+-- Structure:
+-- -- Type (string): what happened, e.g. "presence"
+-- -- Data (any): the details, depending on the type
+-- -- Timestamp (time): when it happened
+
+Events are ephemeral: they are never saved in the database. If a user isn't connected when an event happens, they don't get it.
+*/
+
+// Define the structure for an Event
+type Event struct {
+	Type      string
+	Data      interface{}
+	Timestamp time.Time
+}
+
+// How many events can be waiting for a slow connection before new events are dropped for that connection
+const connectionBufferSize int = 32
+
+// connections maps a user id to all the open connections of that user (a user can be connected from multiple clients)
+var connections map[string]map[chan Event]bool = make(map[string]map[chan Event]bool)
+var connectionsLock sync.Mutex
+
+// Given a user id, opens a new connection for that user. It returns the channel where the events for the user arrive,
+// and a function that closes the connection, which should be called once the client goes away.
+func Subscribe(userId string) (<-chan Event, func()) {
+	connectionsLock.Lock()
+	defer connectionsLock.Unlock()
+
+	ch := make(chan Event, connectionBufferSize)
+	if _, exists := connections[userId]; !exists {
+		connections[userId] = make(map[chan Event]bool)
+	}
+	connections[userId][ch] = true
+
+	var once sync.Once
+	unsubscribe := func() {
+		once.Do(func() {
+			connectionsLock.Lock()
+			defer connectionsLock.Unlock()
+			delete(connections[userId], ch)
+			if len(connections[userId]) == 0 {
+				delete(connections, userId)
+			}
+			close(ch)
+		})
+	}
+	return ch, unsubscribe
+}
+
+// Given a user id, sends the event to all the open connections of that user. It never blocks: a connection that
+// isn't keeping up misses the event.
+func Publish(userId string, e Event) {
+	connectionsLock.Lock()
+	defer connectionsLock.Unlock()
+
+	if e.Timestamp.IsZero() {
+		e.Timestamp = time.Now()
+	}
+	for ch := range connections[userId] {
+		select {
+		case ch <- e:
+		default:
+		}
+	}
+}
+
+// Given a user id, tells how many open connections the user has
+func CountConnections(userId string) int {
+	connectionsLock.Lock()
+	defer connectionsLock.Unlock()
+
+	return len(connections[userId])
+}
@@ -0,0 +1,179 @@
+package retention_service
+
+import (
+	"../../config"
+	"../conversation_service"
+	"../message_service"
+	"../user_service"
+	"fmt"
+	"github.com/teejays/gofiledb"
+	"log"
+	"sync"
+	"time"
+)
+
+/**************************************************************************
+* R E T E N T I O N
+**************************************************************************/
+
+/*
+For compliance reasons, messages should not be kept forever. A retention policy limits how long the messages of a conversation are kept:
+-- Global policy: configured by the admins in the config (RetentionDays, RetentionMaxMessages), applies to all the conversations.
+-- Per-conversation policy: configured by the admins for a single conversation, overrides the global policy for that conversation.
+
+A periodic job goes through all the conversations and prunes the messages that the policy doesn't allow to be kept anymore.
+Everything that is pruned is recorded in an audit log, so we can later tell what was removed, from where, and when.
+The audit entry of a conversation is saved as part of pruning it, so a conversation that can't be pruned doesn't stop the job,
+or keep what was pruned from the other conversations out of the audit log.
+The audit log only records the metadata of the pruned messages, never their content.
+*/
+
+// AuditEntry: A record of the messages that were pruned from one conversation in one run of the retention job
+type AuditEntry struct {
+	Timestamp            time.Time
+	ConversationKey      string
+	UserIds              []string
+	RetentionDays        int
+	RetentionMaxMessages int
+	PrunedMessages       []PrunedMessage
+}
+
+// PrunedMessage: The metadata of a single pruned message
+type PrunedMessage struct {
+	Id               int
+	From             string
+	TimestampCreated time.Time
+}
+
+var auditLog []AuditEntry
+var auditLogLock sync.Mutex
+var retentionCollectionName string = "retention" // name of the collection when storing the audit log in the db
+
+// Given the user ids of a conversation, set the retention policy of that conversation. Zero values fall back to the global policy.
+func SetConversationRetention(userIds []string, retentionDays, retentionMaxMessages int) error {
+	if len(userIds) < 2 {
+		return fmt.Errorf("A conversation needs at least two user ids")
+	}
+
+	// Clean up the user ids the same way they are cleaned up everywhere else, so we find the right conversation
+	var cleanUserIds []string
+	for _, userId := range userIds {
+		u, err := user_service.GetUser(userId)
+		if err != nil {
+			return err
+		}
+		cleanUserIds = append(cleanUserIds, u.UserId)
+	}
+
+	conv, err := conversation_service.GetConversationByUserIds(cleanUserIds)
+	if err != nil {
+		return err
+	}
+	return conv.SetRetention(retentionDays, retentionMaxMessages)
+}
+
+// Starts a background process that enforces the retention policies every interval
+func StartRetentionJob(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		for now := range ticker.C {
+			err := EnforceRetention(now)
+			if err != nil {
+				log.Println(err)
+			}
+		}
+	}()
+}
+
+// Goes through all the conversations, and prunes the messages that their retention policy doesn't allow to be kept at the provided time.
+// Conversations that can't be pruned are logged and skipped, and their members can't be renamed meanwhile (see user_service.WithAccountLock).
+func EnforceRetention(now time.Time) error {
+	return user_service.WithAccountLock(func() error {
+		return enforceRetention(now)
+	})
+}
+
+// Get all the entries of the audit log, oldest first
+func GetAuditLog() []AuditEntry {
+	auditLogLock.Lock()
+	defer auditLogLock.Unlock()
+
+	var entries []AuditEntry = make([]AuditEntry, len(auditLog))
+	copy(entries, auditLog)
+	return entries
+}
+
+// Upon start of the application, this function loads the audit log into memory from the db
+func LoadAuditLogToMemory() error {
+	auditLogLock.Lock()
+	defer auditLogLock.Unlock()
+
+	db := gofiledb.GetClient()
+	exists, err := db.GetStructIfExists(retentionCollectionName, "audit_log", &auditLog)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		auditLog = []AuditEntry{}
+	}
+	return nil
+}
+
+/**************************************************************************
+* H E L P E R S
+**************************************************************************/
+
+// Goes through all the conversations, and prunes the messages that their retention policy doesn't allow to be kept at the provided time
+func enforceRetention(now time.Time) error {
+	auditLogLock.Lock()
+	defer auditLogLock.Unlock()
+
+	convs, err := user_service.GetAllConversations()
+	if err != nil {
+		return err
+	}
+
+	for _, conv := range convs {
+		// A conversation's own policy takes priority over the global policy
+		retentionDays, retentionMaxMessages := conv.RetentionDays, conv.RetentionMaxMessages
+		if retentionDays == 0 {
+			retentionDays = config.GetConfig().RetentionDays
+		}
+		if retentionMaxMessages == 0 {
+			retentionMaxMessages = config.GetConfig().RetentionMaxMessages
+		}
+		if retentionDays == 0 && retentionMaxMessages == 0 {
+			continue
+		}
+
+		err := conv.ApplyRetention(retentionDays, retentionMaxMessages, now, func(pruned []message_service.Message) error {
+			return recordPruned(conv, retentionDays, retentionMaxMessages, pruned, now)
+		})
+		if err != nil {
+			log.Printf("Could not apply the retention policy to conversation %s: %s", conv.UniqueKey(), err)
+		}
+	}
+	return nil
+}
+
+// Given a conversation, records the messages that were pruned from it in the audit log, and saves it. The caller should be holding the audit log lock.
+func recordPruned(conv *conversation_service.Conversation, retentionDays, retentionMaxMessages int, pruned []message_service.Message, now time.Time) error {
+	var entry AuditEntry = AuditEntry{
+		Timestamp:            now,
+		ConversationKey:      conv.UniqueKey(),
+		UserIds:              conv.UserIds,
+		RetentionDays:        retentionDays,
+		RetentionMaxMessages: retentionMaxMessages,
+	}
+	for _, m := range pruned {
+		entry.PrunedMessages = append(entry.PrunedMessages, PrunedMessage{Id: m.Id, From: m.From, TimestampCreated: m.TimestampCreated})
+	}
+	auditLog = append(auditLog, entry)
+	return saveAuditLog()
+}
+
+// Saves the audit log into the database so we don't lose it. The caller should be holding the audit log lock.
+func saveAuditLog() error {
+	db := gofiledb.GetClient()
+	return db.SetStruct(retentionCollectionName, "audit_log", &auditLog)
+}
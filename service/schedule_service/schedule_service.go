@@ -0,0 +1,424 @@
+package schedule_service
+
+import (
+	"../message_service"
+	"../moderation_service"
+	"../user_service"
+	"fmt"
+	"github.com/teejays/gofiledb"
+	"log"
+	"sync"
+	"time"
+)
+
+/**************************************************************************
+* S C H E D U L E D  M E S S A G E
+**************************************************************************/
+
+/*
+ScheduledMessage: A message that a user wants to be sent at a later time.
+-- Structure:
+-- -- Id (int): unique identifier of a scheduled message
+-- -- From (string): the user id of the user who scheduled the message
+-- -- To (string): the user id of the recipient
+-- -- Content (string): the content of the message
+-- -- Format (string): the format of the content, "plain" or "markdown"
+-- -- SendAt (time): when the message should be delivered into the conversation
+-- -- TimestampCreated (time): when the message was scheduled
+-- -- TimestampUpdated (time): when the scheduled message was last edited
+-- -- Sending (bool): whether the message is being delivered right now. It can't be edited or cancelled while it is.
+-- -- Attempts (int): how many times delivering the message failed
+-- -- LastError (string): why delivering the message failed the last time
+-- -- RetryAt (time): when delivering the message is tried again, after it failed
+-- -- Failed (bool): whether the scheduler gave up on delivering the message, after maxDeliveryAttempts. It stays listed until it's edited (which tries again) or cancelled.
+*/
+
+// Define the structure for a ScheduledMessage
+type ScheduledMessage struct {
+	Id               int
+	From             string
+	To               string
+	Content          string
+	Format           string
+	SendAt           time.Time
+	TimestampCreated time.Time
+	TimestampUpdated time.Time
+	Sending          bool       `json:",omitempty"`
+	Attempts         int        `json:",omitempty"`
+	LastError        string     `json:",omitempty"`
+	RetryAt          *time.Time `json:",omitempty"`
+	Failed           bool       `json:",omitempty"`
+}
+
+/* How are the scheduled messages stored?
+-- All the pending scheduled messages are kept in a single queue, in-memory, ordered by the time they were scheduled.
+-- Every time the queue changes, we save a copy of it in the database so the pending messages survive a restart.
+-- A background scheduler periodically goes through the queue and delivers the messages that are due.
+-- A message that couldn't be delivered stays in the queue, and is tried again a few times before the scheduler gives up on it.
+*/
+
+// Define the structure of the queue, the way it's saved in the database
+type scheduledQueue struct {
+	Messages []ScheduledMessage
+	LastId   int
+}
+
+var queue scheduledQueue
+var queueLock sync.Mutex                         // the scheduler runs in the background, so we need to guard the queue
+var deliveryLock sync.Mutex                      // so a scheduled message is never delivered twice, only one delivery runs at a time
+var scheduledCollectionName string = "scheduled" // name of the collection when storing in the db
+
+// How many times delivering a scheduled message is tried before giving up on it, and how long to wait before the first retry (it doubles every time)
+const maxDeliveryAttempts int = 3
+
+var deliveryRetryDelay time.Duration = time.Minute
+
+// Given a User, schedule a new message to the provided recipient, to be sent at the provided time
+func Schedule(u *user_service.User, recipientUserId, content, format string, sendAt time.Time) (int, error) {
+	timestamp := time.Now()
+
+	// Make sure that the scheduled message would be a valid message if it were sent now
+	recipient, err := validateScheduledMessage(u, recipientUserId, content, format, sendAt)
+	if err != nil {
+		return -1, err
+	}
+
+	queueLock.Lock()
+	defer queueLock.Unlock()
+
+	// Assign a new id to the scheduled message, the same way conversations assign ids to messages
+	var sm ScheduledMessage = ScheduledMessage{
+		Id:               queue.LastId + 1,
+		From:             u.UserId,
+		To:               recipient.UserId,
+		Content:          content,
+		Format:           format,
+		SendAt:           sendAt,
+		TimestampCreated: timestamp,
+		TimestampUpdated: timestamp,
+	}
+	queue.LastId++
+	queue.Messages = append(queue.Messages, sm)
+
+	err = saveQueue()
+	if err != nil {
+		return -1, err
+	}
+	return sm.Id, nil
+}
+
+// Given a User, get all the messages that it has scheduled and that haven't been sent yet
+func GetScheduledMessages(u *user_service.User) []ScheduledMessage {
+	queueLock.Lock()
+	defer queueLock.Unlock()
+
+	var messages []ScheduledMessage = []ScheduledMessage{}
+	for _, sm := range queue.Messages {
+		if sm.From == u.UserId {
+			messages = append(messages, sm)
+		}
+	}
+	return messages
+}
+
+// Given a User, edit the content and the send time of a message it has scheduled
+func Edit(u *user_service.User, scheduledMessageId int, newContent string, newSendAt time.Time) error {
+	queueLock.Lock()
+	defer queueLock.Unlock()
+
+	// Find the scheduled message, it should have been scheduled by the provided user
+	index := findScheduledMessage(scheduledMessageId, u.UserId)
+	if index < 0 {
+		return fmt.Errorf("No scheduled message found with id %d", scheduledMessageId)
+	}
+	sm := &queue.Messages[index]
+	if sm.Sending {
+		return fmt.Errorf("Scheduled message %d is being sent", scheduledMessageId)
+	}
+
+	// Make sure that the edited message would still be a valid message
+	_, err := validateScheduledMessage(u, sm.To, newContent, sm.Format, newSendAt)
+	if err != nil {
+		return err
+	}
+
+	sm.Content = newContent
+	sm.SendAt = newSendAt
+	sm.TimestampUpdated = time.Now()
+
+	// If delivering the message failed before, it starts over
+	sm.Attempts = 0
+	sm.LastError = ""
+	sm.RetryAt = nil
+	sm.Failed = false
+
+	return saveQueue()
+}
+
+// Given a User, cancel a message it has scheduled so it's never sent
+func Cancel(u *user_service.User, scheduledMessageId int) error {
+	queueLock.Lock()
+	defer queueLock.Unlock()
+
+	index := findScheduledMessage(scheduledMessageId, u.UserId)
+	if index < 0 {
+		return fmt.Errorf("No scheduled message found with id %d", scheduledMessageId)
+	}
+	if queue.Messages[index].Sending {
+		return fmt.Errorf("Scheduled message %d is being sent", scheduledMessageId)
+	}
+	queue.Messages = append(queue.Messages[0:index], queue.Messages[index+1:]...)
+
+	return saveQueue()
+}
+
+// Given a user id, cancels all the scheduled messages from or to that user, e.g. because the user deleted their account
+func CancelAll(userId string) error {
+	queueLock.Lock()
+	defer queueLock.Unlock()
+
+	var pending []ScheduledMessage = []ScheduledMessage{}
+	for _, sm := range queue.Messages {
+		if sm.From != userId && sm.To != userId {
+			pending = append(pending, sm)
+		}
+	}
+	if len(pending) == len(queue.Messages) {
+		return nil
+	}
+	queue.Messages = pending
+	return saveQueue()
+}
+
+// Given a user id, and the user id it was renamed to, moves all the scheduled messages from or to that user to the new user id
+func RenameUser(oldUserId, newUserId string) error {
+	queueLock.Lock()
+	defer queueLock.Unlock()
+
+	var renamed bool
+	for i := 0; i < len(queue.Messages); i++ {
+		if queue.Messages[i].From == oldUserId {
+			queue.Messages[i].From = newUserId
+			renamed = true
+		}
+		if queue.Messages[i].To == oldUserId {
+			queue.Messages[i].To = newUserId
+			renamed = true
+		}
+	}
+	if !renamed {
+		return nil
+	}
+	return saveQueue()
+}
+
+/**************************************************************************
+* S C H E D U L E R
+**************************************************************************/
+
+// Starts a background process that checks for due scheduled messages every interval, and delivers them
+func StartScheduler(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		for now := range ticker.C {
+			err := DeliverDueMessages(now)
+			if err != nil {
+				log.Println(err)
+			}
+		}
+	}()
+}
+
+// Delivers all the scheduled messages that are due by the provided time into their conversations
+// A message that cannot be delivered (e.g. the recipient blocked the sender) stays in the queue to be tried again later, until maxDeliveryAttempts.
+func DeliverDueMessages(now time.Time) error {
+	deliveryLock.Lock()
+	defer deliveryLock.Unlock()
+
+	// Sending a message waits for renames and account deletions (see user_rename.go), which change the queue,
+	// so the due messages are delivered without holding on to the queue, and only removed from it afterwards
+	due, err := markSending(now)
+	if err != nil {
+		return err
+	}
+
+	// Nothing changed, so there is nothing to save
+	if len(due) == 0 {
+		return nil
+	}
+
+	var failures map[int]error = make(map[int]error)
+	for _, sm := range due {
+		err := deliver(sm)
+		if err != nil {
+			log.Printf("Could not deliver scheduled message %d from %s to %s: %s", sm.Id, sm.From, sm.To, err)
+			failures[sm.Id] = err
+		}
+	}
+
+	queueLock.Lock()
+	defer queueLock.Unlock()
+
+	// Only the delivery that marked the messages can be sending them, so every message that is still marked was due
+	var pending []ScheduledMessage = []ScheduledMessage{}
+	for _, sm := range queue.Messages {
+		if !sm.Sending {
+			pending = append(pending, sm)
+			continue
+		}
+		err, failed := failures[sm.Id]
+		if !failed {
+			continue
+		}
+		sm.Sending = false
+		sm.fail(err.Error(), now)
+		pending = append(pending, sm)
+	}
+	queue.Messages = pending
+	return saveQueue()
+}
+
+// Upon start of the application, this function loads the scheduled messages queue into memory from the db
+func LoadScheduledMessagesToMemory() error {
+	queueLock.Lock()
+	defer queueLock.Unlock()
+
+	db := gofiledb.GetClient()
+	exists, err := db.GetStructIfExists(scheduledCollectionName, "scheduled_queue", &queue)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		queue = scheduledQueue{}
+	}
+
+	// The application stopped while these were being delivered, so they might have been sent already. Rather than risk sending them twice, let their senders decide.
+	for i := 0; i < len(queue.Messages); i++ {
+		sm := &queue.Messages[i]
+		if sm.Sending {
+			sm.Sending = false
+			sm.Attempts = maxDeliveryAttempts - 1
+			sm.fail("Delivery was interrupted, the message might have been sent already", time.Now())
+		}
+	}
+	return nil
+}
+
+/**************************************************************************
+* H E L P E R S
+**************************************************************************/
+
+// Marks the scheduled messages that are due by the provided time as being sent, and saves the queue, before they are delivered.
+// That way they can't be edited or cancelled while they are delivered, and a crash in the middle of a delivery doesn't send them again.
+func markSending(now time.Time) ([]ScheduledMessage, error) {
+	queueLock.Lock()
+	defer queueLock.Unlock()
+
+	var due []ScheduledMessage
+	for i := 0; i < len(queue.Messages); i++ {
+		if queue.Messages[i].isDue(now) {
+			queue.Messages[i].Sending = true
+			due = append(due, queue.Messages[i])
+		}
+	}
+	if len(due) == 0 {
+		return nil, nil
+	}
+
+	err := saveQueue()
+	if err != nil {
+		for i := 0; i < len(queue.Messages); i++ {
+			queue.Messages[i].Sending = false
+		}
+		return nil, err
+	}
+	return due, nil
+}
+
+// Given a scheduled message, tells whether it should be delivered by the provided time
+func (sm ScheduledMessage) isDue(now time.Time) bool {
+	if sm.Sending || sm.Failed {
+		return false
+	}
+	var at time.Time = sm.SendAt
+	if sm.RetryAt != nil {
+		at = *sm.RetryAt
+	}
+	return !at.After(now)
+}
+
+// Given a scheduled message that couldn't be delivered, records why, and when to try again. After maxDeliveryAttempts, it's not tried anymore.
+func (sm *ScheduledMessage) fail(reason string, now time.Time) {
+	sm.Attempts++
+	sm.LastError = reason
+	sm.RetryAt = nil
+	if sm.Attempts >= maxDeliveryAttempts {
+		sm.Failed = true
+		return
+	}
+	var retryAt time.Time = now.Add(deliveryRetryDelay << uint(sm.Attempts-1))
+	sm.RetryAt = &retryAt
+}
+
+// Sends a single scheduled message, the same way a user would send it right now
+func deliver(sm ScheduledMessage) error {
+	// Either user might have been renamed since the message was taken off the queue
+	u, err := user_service.GetUser(user_service.CurrentUserId(sm.From))
+	if err != nil {
+		return err
+	}
+	// Suspended users can't send messages, and that includes the ones they scheduled before (see moderation_service)
+	err = moderation_service.CheckNotSuspended(u.UserId, time.Now())
+	if err != nil {
+		return err
+	}
+	_, err = u.SendMessageWithFormat(user_service.CurrentUserId(sm.To), sm.Content, sm.Format)
+	return err
+}
+
+// Given the details of a scheduled message, makes sure that it's valid, and returns the recipient
+func validateScheduledMessage(u *user_service.User, recipientUserId, content, format string, sendAt time.Time) (*user_service.User, error) {
+	// A message cannot be scheduled to be sent in the past
+	if !sendAt.After(time.Now()) {
+		return nil, fmt.Errorf("Scheduled message validation failed: send time should be in the future")
+	}
+
+	// Messages can only be sent to registered users, so there's no point in scheduling one for anyone else
+	recipient, err := user_service.GetRegisteredUser(recipientUserId)
+	if err != nil {
+		return nil, err
+	}
+	if recipient.UserId == u.UserId {
+		return nil, fmt.Errorf("Cannot have a conversation with yourself")
+	}
+	err = u.CheckCanSendTo(recipient)
+	if err != nil {
+		return nil, err
+	}
+
+	// Run the same sanity checks that would run on the message when it's sent
+	var m message_service.Message = message_service.Message{Content: content, Format: format}
+	m.Sanitize()
+	err = m.Validate()
+	if err != nil {
+		return nil, err
+	}
+	return recipient, nil
+}
+
+// Finds the index of the scheduled message with the provided id, sent by the provided user. Returns -1 if not found.
+// The caller should be holding the queue lock.
+func findScheduledMessage(scheduledMessageId int, from string) int {
+	for i := 0; i < len(queue.Messages); i++ {
+		if queue.Messages[i].Id == scheduledMessageId && queue.Messages[i].From == from {
+			return i
+		}
+	}
+	return -1
+}
+
+// Saves the queue into the database so we don't lose it. The caller should be holding the queue lock.
+func saveQueue() error {
+	db := gofiledb.GetClient()
+	return db.SetStruct(scheduledCollectionName, "scheduled_queue", &queue)
+}
@@ -0,0 +1,355 @@
+package user_service
+
+import (
+	"../conversation_service"
+	"../message_service"
+	"github.com/teejays/gofiledb"
+	"sort"
+	"time"
+)
+
+/**************************************************************************
+* D A T A  E X P O R T
+**************************************************************************/
+
+/*
+Users can export all the data we have about them, and delete their account.
+
+DataExport: All the data of a user.
+-- Structure:
+-- -- UserId (string)
+-- -- Profile (Profile): the profile of the user, if they registered
+-- -- Buddies ([]string): the user ids of the users they have conversations with
+-- -- BlockedUserIds ([]string): the user ids of the users they have blocked
+-- -- ContactRequests ([]ContactRequest): the pending contact requests they sent or received
+-- -- Conversations ([]Conversation): every conversation they are a part of, including the ones hidden because of a block, and the channels they are a member of
+-- -- AuthoredMessages ([]AuthoredMessage): every message they sent, along with the conversation it was sent in
+-- -- TimestampExported (time): when the export was made
+*/
+
+// Define the structure for a DataExport
+type DataExport struct {
+	UserId            string
+	Profile           *Profile
+	Buddies           []string
+	BlockedUserIds    []string
+	ContactRequests   []ContactRequest
+	Conversations     []*conversation_service.Conversation
+	AuthoredMessages  []AuthoredMessage
+	TimestampExported time.Time
+}
+
+// AuthoredMessage: A message sent by a user, along with the conversation it was sent in
+type AuthoredMessage struct {
+	ConversationKey string
+	Message         message_service.Message
+}
+
+// Given a User, collects all the data we have about it
+func (u *User) ExportData() (*DataExport, error) {
+	var export DataExport = DataExport{
+		UserId:            u.UserId,
+		Buddies:           u.getBuddyIds(),
+		BlockedUserIds:    u.GetBlockedUserIds(),
+		ContactRequests:   u.GetContactRequests(),
+		Conversations:     []*conversation_service.Conversation{},
+		AuthoredMessages:  []AuthoredMessage{},
+		TimestampExported: time.Now(),
+	}
+	if IsRegistered(u.UserId) {
+		profile, err := u.GetProfile()
+		if err != nil {
+			return nil, err
+		}
+		export.Profile = profile
+	}
+
+	for _, bid := range export.Buddies {
+		conv, err := conversation_service.GetConversationByUserIds([]string{u.UserId, bid})
+		if err != nil {
+			return nil, err
+		}
+		export.Conversations = append(export.Conversations, conv)
+		for _, m := range conv.Messages {
+			if m.From == u.UserId {
+				export.AuthoredMessages = append(export.AuthoredMessages, AuthoredMessage{ConversationKey: conv.UniqueKey(), Message: m})
+			}
+		}
+	}
+
+	// Channels (see conversation_channel.go) aren't in the buddies map
+	channels, err := conversation_service.GetAllChannels()
+	if err != nil {
+		return nil, err
+	}
+	for _, channel := range channels {
+		if channel.IsMember(u.UserId) {
+			export.Conversations = append(export.Conversations, channel)
+		}
+		for _, m := range channel.Messages {
+			if m.From == u.UserId {
+				export.AuthoredMessages = append(export.AuthoredMessages, AuthoredMessage{ConversationKey: channel.UniqueKey(), Message: m})
+			}
+		}
+	}
+	return &export, nil
+}
+
+/**************************************************************************
+* A C C O U N T  D E L E T I O N
+**************************************************************************/
+
+/*
+When a user deletes their account:
+-- Every message they sent is attributed to conversation_service.DeletedUserId instead, in the conversations that someone else is still in.
+-- Conversations that nobody else is in anymore (the other user has deleted their account too) are erased. Users don't have to register
+-- to send messages, so a conversation with a user who never registered is only anonymized. The other user keeps the anonymized conversation
+-- until they delete their account too (see deletedBuddies).
+-- They leave the channels they are a member of, and the messages they sent in channels are attributed to conversation_service.DeletedUserId too.
+-- Messages forwarded from them, or from their conversations, into other conversations don't point back to them anymore.
+-- They are removed from the buddies map, the registry, and everything else that refers to them (presence, blocks, contact requests, inbox),
+-- including what other services keep about them (e.g. their scheduled messages, see OnDelete).
+-- The invites they created keep working, but are attributed to conversation_service.DeletedUserId.
+-- Their user id can never be registered again, so nobody can pick it up and be mistaken for them.
+*/
+
+// deletedUserIds maps the user id of every deleted account to when it was deleted
+var deletedUserIds map[string]time.Time
+
+// deletedBuddies maps the user id of every user who still has conversations with users who deleted their account, to the user ids of those users.
+// Deleted users aren't in the buddies map anymore, so this is how we find the conversations that nobody is left in once the user deletes their account too.
+var deletedBuddies map[string][]string
+
+// Services that keep user ids of their own, but that the user service can't call because they depend on it (e.g. the schedule service),
+// register a hook to forget the users who delete their account. Hooks run under the account lock, so they shouldn't wait for anything that waits for it.
+var deleteHooks []func(userId string) error
+
+// Given a function, calls it with the user id of every user who deletes their account, before anything else is erased
+func OnDelete(hook func(userId string) error) {
+	deleteHooks = append(deleteHooks, hook)
+}
+
+// Given a User, deletes its account, and erases what it leaves behind
+func (u *User) DeleteAccount() error {
+	accountLock.Lock()
+	defer accountLock.Unlock()
+
+	// 1. Let the other services forget the user first, e.g. so none of its scheduled messages gets sent afterwards
+	for _, hook := range deleteHooks {
+		err := hook(u.UserId)
+		if err != nil {
+			return err
+		}
+	}
+
+	// -- Anonymize the conversations of the user with the users who are still around, and erase the ones with users who deleted their account too
+	buddyIds := u.getBuddyIds()
+	for _, bid := range buddyIds {
+		conv, err := conversation_service.GetConversationByUserIds([]string{u.UserId, bid})
+		if err != nil {
+			return err
+		}
+		err = conv.AnonymizeSender(u.UserId)
+		if err != nil {
+			return err
+		}
+	}
+	for _, bid := range u.getDeletedBuddyIds() {
+		conv, err := conversation_service.GetConversationByUserIds([]string{u.UserId, bid})
+		if err != nil {
+			return err
+		}
+		err = conv.Erase()
+		if err != nil {
+			return err
+		}
+	}
+
+	// -- Channels (see conversation_channel.go) aren't in the buddies map, and the user might have sent messages in channels it has left since
+	channels, err := conversation_service.GetAllChannels()
+	if err != nil {
+		return err
+	}
+	for _, channel := range channels {
+		if channel.IsMember(u.UserId) {
+			err = channel.RemoveMember(u.UserId)
+			if err != nil {
+				return err
+			}
+		}
+		if channel.HasMessagesFrom(u.UserId) || channel.CreatedBy == u.UserId {
+			err = channel.AnonymizeSender(u.UserId)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	// -- Messages forwarded from the user, or from its conversations, can be in anybody's conversations (see conversation_forward.go)
+	convs, err := GetAllConversations()
+	if err != nil {
+		return err
+	}
+	for _, conv := range convs {
+		if !conv.HasForwardsFrom(u.UserId) {
+			continue
+		}
+		err = conv.AnonymizeSender(u.UserId)
+		if err != nil {
+			return err
+		}
+	}
+
+	// 2. Remove the user from the buddies map
+	buddiesLock.Lock()
+	for bid := range buddiesInfoMap[u.UserId] {
+		delete(buddiesInfoMap[bid], u.UserId)
+		if len(buddiesInfoMap[bid]) == 0 {
+			delete(buddiesInfoMap, bid)
+		}
+	}
+	delete(buddiesInfoMap, u.UserId)
+	db := gofiledb.GetClient()
+	err = db.SetStruct(buddiesCollectionName, "buddies_map", &buddiesInfoMap)
+	buddiesLock.Unlock()
+	if err != nil {
+		return err
+	}
+
+	// 3. Remove everything else that refers to the user
+	err = u.forgetBlocks()
+	if err != nil {
+		return err
+	}
+	err = u.forgetContactRequests()
+	if err != nil {
+		return err
+	}
+	err = u.forgetPresence()
+	if err != nil {
+		return err
+	}
+	err = conversation_service.ForgetInbox(u.UserId)
+	if err != nil {
+		return err
+	}
+	err = conversation_service.RenameInInvites(u.UserId, conversation_service.DeletedUserId)
+	if err != nil {
+		return err
+	}
+
+	// 4. Remove the user from the registry, and make sure nobody can take its user id
+	userRegistryLock.Lock()
+	defer userRegistryLock.Unlock()
+	delete(userRegistry, u.UserId)
+	err = saveUserRegistry()
+	if err != nil {
+		return err
+	}
+	deletedUserIds[u.UserId] = time.Now()
+	err = db.SetStruct(userRegistryCollectionName, "deleted_users", &deletedUserIds)
+	if err != nil {
+		return err
+	}
+
+	// -- The buddies of the user keep their conversations with it, until they delete their account too
+	for _, bid := range buddyIds {
+		deletedBuddies[bid] = append(deletedBuddies[bid], u.UserId)
+	}
+	delete(deletedBuddies, u.UserId)
+	return db.SetStruct(userRegistryCollectionName, "deleted_buddies", &deletedBuddies)
+}
+
+// Given a user id, tells whether it belonged to an account that was deleted. The caller should be holding the registry lock.
+func isDeletedUserId(userId string) bool {
+	_, exists := deletedUserIds[userId]
+	return exists
+}
+
+// Loads the user ids of the deleted accounts, and who still has conversations with them, into memory from the db. The caller should be holding the registry lock.
+func loadDeletedUserIds() error {
+	db := gofiledb.GetClient()
+	exists, err := db.GetStructIfExists(userRegistryCollectionName, "deleted_users", &deletedUserIds)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		deletedUserIds = make(map[string]time.Time)
+	}
+	exists, err = db.GetStructIfExists(userRegistryCollectionName, "deleted_buddies", &deletedBuddies)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		deletedBuddies = make(map[string][]string)
+	}
+	return nil
+}
+
+/**************************************************************************
+* H E L P E R S
+**************************************************************************/
+
+// Given a User, gets the user ids of all the users it has conversations with, sorted
+func (u *User) getBuddyIds() []string {
+	buddiesLock.RLock()
+	defer buddiesLock.RUnlock()
+
+	var buddyIds []string = []string{}
+	for bid, v := range buddiesInfoMap[u.UserId] {
+		if v {
+			buddyIds = append(buddyIds, bid)
+		}
+	}
+	sort.Strings(buddyIds)
+	return buddyIds
+}
+
+// Given a User, gets the user ids of the deleted users it still has conversations with, sorted
+func (u *User) getDeletedBuddyIds() []string {
+	userRegistryLock.Lock()
+	defer userRegistryLock.Unlock()
+
+	var buddyIds []string = append([]string{}, deletedBuddies[u.UserId]...)
+	sort.Strings(buddyIds)
+	return buddyIds
+}
+
+// Given a User, removes the users it blocked, and removes it from the users who blocked it
+func (u *User) forgetBlocks() error {
+	blocksLock.Lock()
+	defer blocksLock.Unlock()
+
+	delete(blocksMap, u.UserId)
+	for blocker, blocked := range blocksMap {
+		delete(blocked, u.UserId)
+		if len(blocked) == 0 {
+			delete(blocksMap, blocker)
+		}
+	}
+	return saveBlocks()
+}
+
+// Given a User, removes all the pending contact requests it sent or received
+func (u *User) forgetContactRequests() error {
+	contactRequestsLock.Lock()
+	defer contactRequestsLock.Unlock()
+
+	for key, cr := range contactRequests {
+		if cr.From == u.UserId || cr.To == u.UserId {
+			delete(contactRequests, key)
+		}
+	}
+	return saveContactRequests()
+}
+
+// Given a User, removes its last-seen time and presence settings
+func (u *User) forgetPresence() error {
+	presenceLock.Lock()
+	defer presenceLock.Unlock()
+
+	delete(presence.LastSeen, u.UserId)
+	delete(presence.Hidden, u.UserId)
+	delete(savedLastSeen, u.UserId)
+	return savePresence()
+}
@@ -0,0 +1,123 @@
+package user_service
+
+import (
+	"fmt"
+	"github.com/teejays/gofiledb"
+	"sort"
+	"sync"
+)
+
+/**************************************************************************
+* B L O C K I N G
+**************************************************************************/
+
+/*
+A user can block another user:
+-- The blocked user can't send messages (or typing indicators) to the blocker anymore. The blocker can't send messages to the blocked user either, until they unblock them.
+-- The blocker doesn't see the conversation with the blocked user in their conversations anymore. The conversation is not deleted, it comes back once the user is unblocked.
+-- The blocked user is not told about being blocked, other than not being able to send messages.
+
+Just like the buddies map, the blocks are kept in-memory (mapping a user id to the user ids it has blocked), with a copy saved in the database.
+*/
+
+var blocksMap map[string]map[string]bool
+var blocksLock sync.Mutex
+var blocksCollectionName string = "blocks" // name of the collection when storing in the db
+
+// Given a User, blocks the user with the provided user id
+func (u *User) Block(userId string) error {
+	blocked, err := GetRegisteredUser(userId)
+	if err != nil {
+		return err
+	}
+	if blocked.UserId == u.UserId {
+		return fmt.Errorf("Cannot block yourself")
+	}
+
+	blocksLock.Lock()
+	defer blocksLock.Unlock()
+
+	if _, exists := blocksMap[u.UserId]; !exists {
+		blocksMap[u.UserId] = make(map[string]bool)
+	}
+	blocksMap[u.UserId][blocked.UserId] = true
+	return saveBlocks()
+}
+
+// Given a User, unblocks the user with the provided user id
+func (u *User) Unblock(userId string) error {
+	blocked, err := GetUser(userId)
+	if err != nil {
+		return err
+	}
+
+	blocksLock.Lock()
+	defer blocksLock.Unlock()
+
+	if !blocksMap[u.UserId][blocked.UserId] {
+		return fmt.Errorf("User %s is not blocked", blocked.UserId)
+	}
+	delete(blocksMap[u.UserId], blocked.UserId)
+	if len(blocksMap[u.UserId]) == 0 {
+		delete(blocksMap, u.UserId)
+	}
+	return saveBlocks()
+}
+
+// Given a User, get the user ids of all the users it has blocked, sorted
+func (u *User) GetBlockedUserIds() []string {
+	blocksLock.Lock()
+	defer blocksLock.Unlock()
+
+	var userIds []string = []string{}
+	for userId := range blocksMap[u.UserId] {
+		userIds = append(userIds, userId)
+	}
+	sort.Strings(userIds)
+	return userIds
+}
+
+// Given a User, tells whether it has blocked the provided user
+func (u *User) HasBlocked(other *User) bool {
+	blocksLock.Lock()
+	defer blocksLock.Unlock()
+
+	return blocksMap[u.UserId][other.UserId]
+}
+
+// Given a User, makes sure that it can send things (messages, typing indicators) to the provided recipient, i.e. neither of them has blocked the other
+func (u *User) CheckCanSendTo(recipient *User) error {
+	if u.HasBlocked(recipient) {
+		return fmt.Errorf("You have blocked %s, unblock them first", recipient.UserId)
+	}
+	if recipient.HasBlocked(u) {
+		return fmt.Errorf("Cannot send to user %s", recipient.UserId)
+	}
+	return nil
+}
+
+// Upon start of the application, this function loads the blocks map into memory from the db
+func LoadBlocksToMemory() error {
+	blocksLock.Lock()
+	defer blocksLock.Unlock()
+
+	db := gofiledb.GetClient()
+	exists, err := db.GetStructIfExists(blocksCollectionName, "blocks_map", &blocksMap)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		blocksMap = make(map[string]map[string]bool)
+	}
+	return nil
+}
+
+/**************************************************************************
+* H E L P E R S
+**************************************************************************/
+
+// Saves the blocks map into the database so we don't lose it. The caller should be holding the blocks lock.
+func saveBlocks() error {
+	db := gofiledb.GetClient()
+	return db.SetStruct(blocksCollectionName, "blocks_map", &blocksMap)
+}
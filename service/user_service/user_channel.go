@@ -0,0 +1,163 @@
+package user_service
+
+import (
+	"../conversation_service"
+	"../message_service"
+	"fmt"
+	"time"
+)
+
+/**************************************************************************
+* C H A N N E L S
+**************************************************************************/
+
+/*
+Channels are named conversations that users can find, join and leave by themselves (see conversation_channel.go), or join with an invite (see user_invite.go).
+Anybody can read a public channel, but only its members can send messages in it. Private channels can only be read by their members.
+Channels show up in the inbox of their members, along with their other conversations, but they aren't buddies of each other.
+*/
+
+// Given a User, creates a new channel with the provided name and topic, which can be private. The user becomes its first member, and its owner.
+func (u *User) CreateChannel(name, topic string, private bool) error {
+	accountLock.RLock()
+	defer accountLock.RUnlock()
+
+	_, err := conversation_service.CreateChannel(name, topic, u.UserId, private)
+	return err
+}
+
+// Given a User, get the channel with the provided name, with all of its messages
+func (u *User) GetChannel(name string) (*conversation_service.Conversation, error) {
+	channel, err := conversation_service.GetChannel(name)
+	if err != nil {
+		return nil, err
+	}
+	// Private channels are only known to their members
+	if channel.Private && !channel.IsMember(u.UserId) {
+		return nil, fmt.Errorf("No channel found with name %s", channel.ChannelName)
+	}
+	return channel, nil
+}
+
+// Given a User, makes it a member of the channel with the provided name
+func (u *User) JoinChannel(name string) error {
+	accountLock.RLock()
+	defer accountLock.RUnlock()
+
+	channel, err := conversation_service.GetChannel(name)
+	if err != nil {
+		return err
+	}
+	return channel.Join(u.UserId)
+}
+
+// Given a User, removes it from the members of the channel with the provided name
+func (u *User) LeaveChannel(name string) error {
+	accountLock.RLock()
+	defer accountLock.RUnlock()
+
+	channel, err := conversation_service.GetChannel(name)
+	if err != nil {
+		return err
+	}
+	return channel.Leave(u.UserId)
+}
+
+// Given a User, sets the topic of the channel with the provided name. Only its owner and admins can.
+func (u *User) SetChannelTopic(name, topic string) error {
+	accountLock.RLock()
+	defer accountLock.RUnlock()
+
+	channel, err := conversation_service.GetChannel(name)
+	if err != nil {
+		return err
+	}
+	return channel.SetTopic(u.UserId, topic)
+}
+
+// Given a User, send a new message with the provided format (e.g. plain, markdown) to the channel with the provided name
+func (u *User) SendChannelMessage(name, content, format string) (int, error) {
+	accountLock.RLock()
+	defer accountLock.RUnlock()
+
+	channel, err := conversation_service.GetChannel(name)
+	if err != nil {
+		return -1, err
+	}
+
+	// Whether the user is a member is checked along with adding the message, so it's up to date
+	timestamp := time.Now()
+	var newMessage message_service.Message = message_service.Message{
+		Content:          content,
+		From:             u.UserId,
+		Format:           format,
+		TimestampCreated: timestamp,
+		TimestampUpdated: timestamp,
+	}
+	return channel.AddMessage(newMessage)
+}
+
+// Given a User, edits the content of a message it sent to the channel with the provided name
+func (u *User) EditChannelMessage(name string, messageId int, newContent string) error {
+	accountLock.RLock()
+	defer accountLock.RUnlock()
+
+	channel, err := conversation_service.GetChannel(name)
+	if err != nil {
+		return err
+	}
+	return channel.EditMessage(messageId, newContent, u.UserId)
+}
+
+// Given a User, deletes a message from the channel with the provided name: one it sent, or anyone's if it's an owner or admin of the channel
+func (u *User) DeleteChannelMessage(name string, messageId int) error {
+	accountLock.RLock()
+	defer accountLock.RUnlock()
+
+	channel, err := conversation_service.GetChannel(name)
+	if err != nil {
+		return err
+	}
+	return channel.DeleteMessage(messageId, u.UserId)
+}
+
+// Given a User, adds the provided user to the members of the channel with the provided name. Only its owner and admins can.
+func (u *User) AddChannelMember(name, memberUserId string) error {
+	accountLock.RLock()
+	defer accountLock.RUnlock()
+
+	member, err := GetRegisteredUser(memberUserId)
+	if err != nil {
+		return err
+	}
+	channel, err := conversation_service.GetChannel(name)
+	if err != nil {
+		return err
+	}
+	return channel.AddMember(u.UserId, member.UserId)
+}
+
+// Given a User, removes the provided member from the channel with the provided name. Only its owner and admins can.
+func (u *User) RemoveChannelMember(name, memberUserId string) error {
+	accountLock.RLock()
+	defer accountLock.RUnlock()
+
+	member, err := GetUser(memberUserId)
+	if err != nil {
+		return err
+	}
+	channel, err := conversation_service.GetChannel(name)
+	if err != nil {
+		return err
+	}
+	return channel.KickMember(u.UserId, member.UserId)
+}
+
+// Given a User, marks the messages in the channel with the provided name as read, up to the provided message id. A message id of 0 marks all of them as read.
+func (u *User) MarkChannelRead(name string, messageId int) error {
+	channel, err := conversation_service.GetChannel(name)
+	if err != nil {
+		return err
+	}
+	return channel.MarkRead(u.UserId, messageId)
+}
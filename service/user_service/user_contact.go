@@ -0,0 +1,226 @@
+package user_service
+
+import (
+	"../../config"
+	"../message_service"
+	"fmt"
+	"github.com/teejays/gofiledb"
+	"sort"
+	"sync"
+	"time"
+)
+
+/**************************************************************************
+* C O N T A C T  R E Q U E S T S
+**************************************************************************/
+
+/*
+By default, any user can message any other user, and the first message makes them buddies.
+When RequireContactRequests is turned on in the config, messaging a user who isn't a buddy yet creates a contact request instead:
+-- The messages are held in the contact request, they don't go into a conversation yet.
+-- The recipient can accept the request: the two users become buddies, and the held messages are delivered into their conversation.
+-- Or the recipient can reject the request: the held messages are thrown away.
+-- If the recipient messages the sender back, that counts as accepting the request.
+
+ContactRequest: A pending request, from one user to another, to become buddies.
+-- Structure:
+-- -- From (string): the user id of the user who sent the request
+-- -- To (string): the user id of the user who needs to accept or reject the request
+-- -- HeldMessages ([]Message): the messages sent with the request, waiting to be delivered
+-- -- TimestampCreated (time): when the request was sent
+
+Just like the buddies map, the pending contact requests are kept in-memory, with a copy saved in the database.
+*/
+
+// Define the structure for a ContactRequest
+type ContactRequest struct {
+	From             string
+	To               string
+	HeldMessages     []message_service.Message
+	TimestampCreated time.Time
+}
+
+// The message id returned for a message that is held in a contact request, since it doesn't have a real id until it's delivered
+const HeldMessageId int = 0
+
+// How many messages can be held in a single contact request, so a request can't be used to spam a user
+const maxHeldMessages int = 10
+
+// contactRequests maps a contact request key (see contactRequestKey) to the pending contact request
+var contactRequests map[string]*ContactRequest
+var contactRequestsLock sync.Mutex
+var contactsCollectionName string = "contacts" // name of the collection when storing in the db
+
+// Given a User, get all its pending contact requests, both the ones it sent and the ones it received, oldest first
+func (u *User) GetContactRequests() []ContactRequest {
+	contactRequestsLock.Lock()
+	defer contactRequestsLock.Unlock()
+
+	var requests []ContactRequest = []ContactRequest{}
+	for _, cr := range contactRequests {
+		if cr.From == u.UserId || cr.To == u.UserId {
+			requests = append(requests, *cr)
+		}
+	}
+	sort.Slice(requests, func(i, j int) bool { return requests[i].TimestampCreated.Before(requests[j].TimestampCreated) })
+	return requests
+}
+
+// Given a User, accepts the contact request that the provided user sent to it. The held messages are delivered into their conversation.
+func (u *User) AcceptContactRequest(fromUserId string) error {
+	accountLock.RLock()
+	defer accountLock.RUnlock()
+
+	from, err := GetUser(fromUserId)
+	if err != nil {
+		return err
+	}
+	return u.acceptContactRequest(from)
+}
+
+// Given a User, accepts the contact request that the provided user sent to it. The caller should be holding the account lock for reading.
+func (u *User) acceptContactRequest(from *User) error {
+	cr, err := removeContactRequest(from, u)
+	if err != nil {
+		return err
+	}
+
+	// The two users are buddies now
+	err = u.SaveBuddyInfo(from)
+	if err != nil {
+		return restoreContactRequest(from, u, cr, cr.HeldMessages, err)
+	}
+
+	// Deliver the held messages, in the order they were sent. The ones that couldn't be delivered go back into the request, so they are not lost.
+	conv, err := u.GetConversation(from)
+	if err != nil {
+		return restoreContactRequest(from, u, cr, cr.HeldMessages, err)
+	}
+	for i, m := range cr.HeldMessages {
+		_, err = conv.AddMessage(m)
+		if err != nil {
+			return restoreContactRequest(from, u, cr, cr.HeldMessages[i:], err)
+		}
+	}
+	return nil
+}
+
+// Given a User, rejects the contact request that the provided user sent to it. The held messages are thrown away.
+func (u *User) RejectContactRequest(fromUserId string) error {
+	from, err := GetUser(fromUserId)
+	if err != nil {
+		return err
+	}
+	_, err = removeContactRequest(from, u)
+	return err
+}
+
+// Upon start of the application, this function loads the pending contact requests into memory from the db
+func LoadContactRequestsToMemory() error {
+	contactRequestsLock.Lock()
+	defer contactRequestsLock.Unlock()
+
+	db := gofiledb.GetClient()
+	exists, err := db.GetStructIfExists(contactsCollectionName, "contact_requests", &contactRequests)
+	if err != nil {
+		return err
+	}
+	if !exists {
+		contactRequests = make(map[string]*ContactRequest)
+	}
+	return nil
+}
+
+/**************************************************************************
+* H E L P E R S
+**************************************************************************/
+
+// Given a User, and a recipient, tells whether a message from the user to the recipient should be held in a contact request
+func (u *User) needsContactRequest(buddy *User) bool {
+	if !config.GetConfig().RequireContactRequests {
+		return false
+	}
+	return !hasBuddy(u.UserId, buddy.UserId)
+}
+
+// Given a User, holds a message to the provided recipient in a contact request, creating the request if there isn't one yet
+func (u *User) holdMessage(buddy *User, m message_service.Message) error {
+	// Make sure the message is valid now, so accepting the request doesn't fail later
+	m.Sanitize()
+	err := m.Validate()
+	if err != nil {
+		return err
+	}
+
+	contactRequestsLock.Lock()
+	defer contactRequestsLock.Unlock()
+
+	key := contactRequestKey(u, buddy)
+	cr, exists := contactRequests[key]
+	if !exists {
+		cr = &ContactRequest{From: u.UserId, To: buddy.UserId, TimestampCreated: m.TimestampCreated}
+		contactRequests[key] = cr
+	}
+	if len(cr.HeldMessages) >= maxHeldMessages {
+		return fmt.Errorf("Cannot send more than %d messages to %s until they accept your contact request", maxHeldMessages, buddy.UserId)
+	}
+	cr.HeldMessages = append(cr.HeldMessages, m)
+	return saveContactRequests()
+}
+
+// Given a user, and a recipient, tells whether there is a pending contact request from the user to the recipient
+func hasContactRequest(from, to *User) bool {
+	contactRequestsLock.Lock()
+	defer contactRequestsLock.Unlock()
+
+	_, exists := contactRequests[contactRequestKey(from, to)]
+	return exists
+}
+
+// Given a user, and a recipient, removes the pending contact request from the user to the recipient, and returns it
+func removeContactRequest(from, to *User) (*ContactRequest, error) {
+	contactRequestsLock.Lock()
+	defer contactRequestsLock.Unlock()
+
+	key := contactRequestKey(from, to)
+	cr, exists := contactRequests[key]
+	if !exists {
+		return nil, fmt.Errorf("No contact request found from %s", from.UserId)
+	}
+	delete(contactRequests, key)
+	err := saveContactRequests()
+	if err != nil {
+		return nil, err
+	}
+	return cr, nil
+}
+
+// Given a contact request that was removed to be accepted, puts the messages that couldn't be delivered back into it, and returns the error that stopped the delivery.
+// If the sender held more messages in the meantime, the undelivered ones go before them.
+func restoreContactRequest(from, to *User, cr *ContactRequest, undelivered []message_service.Message, cause error) error {
+	contactRequestsLock.Lock()
+	defer contactRequestsLock.Unlock()
+
+	key := contactRequestKey(from, to)
+	if pending, exists := contactRequests[key]; exists {
+		pending.HeldMessages = append(append([]message_service.Message{}, undelivered...), pending.HeldMessages...)
+	} else {
+		contactRequests[key] = &ContactRequest{From: cr.From, To: cr.To, HeldMessages: undelivered, TimestampCreated: cr.TimestampCreated}
+	}
+	err := saveContactRequests()
+	if err != nil {
+		return err
+	}
+	return cause
+}
+
+// Given a user, and a recipient, returns the key of the contact request between them in the contactRequests map. User ids can't contain '>'.
+func contactRequestKey(from, to *User) string {
+	return from.UserId + ">" + to.UserId
+}
+
+// Saves the pending contact requests into the database so we don't lose them. The caller should be holding the contact requests lock.
+func saveContactRequests() error {
+	db := gofiledb.GetClient()
+	return db.SetStruct(contactsCollectionName, "contact_requests", &contactRequests)
+}
@@ -0,0 +1,57 @@
+package user_service
+
+import (
+	"fmt"
+	"time"
+)
+
+/**************************************************************************
+* F O R W A R D I N G
+**************************************************************************/
+
+// Given a User, forwards a message from its conversation with one user into its conversation with another user (see conversation_forward.go).
+// It returns the id of the forwarded message in the conversation it was forwarded into.
+func (u *User) ForwardMessage(fromUserId string, messageId int, toUserId string) (int, error) {
+	// Make sure neither user is renamed while the message is being forwarded (see user_rename.go)
+	accountLock.RLock()
+	defer accountLock.RUnlock()
+
+	// The user should be able to see the original: it's in one of its conversations, and that conversation isn't hidden because of a block
+	source, err := GetUser(fromUserId)
+	if err != nil {
+		return -1, err
+	}
+	if u.HasBlocked(source) {
+		return -1, fmt.Errorf("You have blocked %s, unblock them first", source.UserId)
+	}
+	sourceConv, err := u.GetConversation(source)
+	if err != nil {
+		return -1, err
+	}
+
+	// The message can only be forwarded into another existing conversation of the user, with someone it can still send messages to
+	buddy, err := GetRegisteredUser(toUserId)
+	if err != nil {
+		return -1, err
+	}
+	if buddy.UserId == source.UserId {
+		return -1, fmt.Errorf("Cannot forward a message into the conversation it's from")
+	}
+	if !hasBuddy(u.UserId, buddy.UserId) {
+		return -1, fmt.Errorf("No conversation found with %s", buddy.UserId)
+	}
+	err = u.CheckCanSendTo(buddy)
+	if err != nil {
+		return -1, err
+	}
+
+	m, err := sourceConv.ForwardMessage(messageId, u.UserId, time.Now())
+	if err != nil {
+		return -1, err
+	}
+	conv, err := u.GetConversation(buddy)
+	if err != nil {
+		return -1, err
+	}
+	return conv.AddMessage(m)
+}
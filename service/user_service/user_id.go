@@ -0,0 +1,224 @@
+package user_service
+
+import (
+	"fmt"
+	"golang.org/x/text/unicode/norm"
+	"sort"
+	"strings"
+	"unicode"
+)
+
+/**************************************************************************
+* U S E R  I D
+**************************************************************************/
+
+/*
+User ids are embedded in storage keys (e.g. conversation_<userid>_<userid>) and shown to other users, so they are held to strict rules:
+-- Normalization: ids are normalized with Unicode NFKC (so e.g. full-width letters become plain letters), lowercased and trimmed.
+-- Charset: after normalization, an id can only contain lowercase letters (a-z), digits (0-9), dots and hyphens,
+-- and it should start and end with a letter or a digit. Underscores are not allowed since they separate the ids in storage keys.
+-- Length: between minUserIdLength and maxUserIdLength characters.
+-- Reserved names: ids like 'admin' or 'system' can't be registered, since other users could mistake them for the application itself.
+-- Confusables: an id can't be registered if it looks like an already registered id (e.g. 'paypa1' when 'paypal' exists),
+-- and ids written with look-alike letters from other scripts (e.g. a Cyrillic 'а') are rejected with a hint of what they imitate.
+
+Ids that were created before these rules existed (legacy ids) keep working, but they should be migrated. GetUserIdMigrationReport lists them.
+*/
+
+// Limits on the length of a user id
+const (
+	minUserIdLength int = 3
+	maxUserIdLength int = 32
+)
+
+// Names that no user can register, since they could be mistaken for the application, its staff or a group of users
+var reservedUserIds map[string]bool = map[string]bool{
+	"admin":         true,
+	"administrator": true,
+	"all":           true,
+	"deleted-user":  true, // what the messages of deleted accounts are attributed to (see conversation_service.DeletedUserId)
+	"api":           true,
+	"everyone":      true,
+	"help":          true,
+	"here":          true,
+	"moderator":     true,
+	"null":          true,
+	"root":          true,
+	"security":      true,
+	"support":       true,
+	"system":        true,
+	"undefined":     true,
+}
+
+// Letters from other scripts that look like a Latin letter, mapped to that letter
+var confusableRunes map[rune]rune = map[rune]rune{
+	// Cyrillic
+	'а': 'a', 'в': 'b', 'с': 'c', 'е': 'e', 'һ': 'h', 'і': 'i', 'ј': 'j', 'к': 'k', 'м': 'm',
+	'о': 'o', 'р': 'p', 'ԛ': 'q', 'ѕ': 's', 'т': 't', 'ԝ': 'w', 'х': 'x', 'у': 'y',
+	// Greek
+	'α': 'a', 'β': 'b', 'ε': 'e', 'η': 'n', 'ι': 'i', 'κ': 'k', 'ν': 'v', 'ο': 'o', 'ρ': 'p', 'τ': 't', 'υ': 'u', 'χ': 'x',
+}
+
+// Sequences within the allowed charset that look alike, mapped to a single representative (used to compare ids)
+var confusableSequences *strings.Replacer = strings.NewReplacer("rn", "m", "vv", "w", "0", "o", "1", "l")
+
+// UserIdReport: An existing user id that doesn't follow the user id rules
+type UserIdReport struct {
+	UserId     string
+	Problem    string
+	Suggestion string // a conforming id the user could be migrated to, if we could come up with one
+}
+
+// Goes through all the user ids we know about (registered users and users with conversations),
+// and reports the ones that don't follow the user id rules, sorted by user id.
+func GetUserIdMigrationReport() []UserIdReport {
+	var userIds map[string]bool = make(map[string]bool)
+	buddiesLock.RLock()
+	for userId := range buddiesInfoMap {
+		userIds[userId] = true
+	}
+	buddiesLock.RUnlock()
+	userRegistryLock.Lock()
+	for userId := range userRegistry {
+		userIds[userId] = true
+	}
+	userRegistryLock.Unlock()
+
+	var report []UserIdReport = []UserIdReport{}
+	for userId := range userIds {
+		err := validateNewUserId(userId)
+		if err == nil {
+			continue
+		}
+		report = append(report, UserIdReport{
+			UserId:     userId,
+			Problem:    err.Error(),
+			Suggestion: suggestUserId(userId, userIds),
+		})
+	}
+	sort.Slice(report, func(i, j int) bool { return report[i].UserId < report[j].UserId })
+	return report
+}
+
+/**************************************************************************
+* H E L P E R S
+**************************************************************************/
+
+// Given a (processed) user id, ensures that it follows the charset and length rules
+func validateUserIdCharset(userId string) error {
+	if len(userId) < minUserIdLength || len(userId) > maxUserIdLength {
+		return fmt.Errorf("User Id validation failed: user id should be between %d and %d characters", minUserIdLength, maxUserIdLength)
+	}
+	for i, r := range userId {
+		if r > unicode.MaxASCII {
+			if latin, exists := confusableRunes[r]; exists {
+				return fmt.Errorf("User Id validation failed: '%c' looks like the letter '%c' but is not a Latin letter", r, latin)
+			}
+			return fmt.Errorf("User Id validation failed: '%c' is not allowed, only letters (a-z), digits, dots and hyphens are", r)
+		}
+		if !isUserIdAlphanumeric(r) && r != '.' && r != '-' {
+			return fmt.Errorf("User Id validation failed: '%c' is not allowed, only letters (a-z), digits, dots and hyphens are", r)
+		}
+		if (i == 0 || i == len(userId)-1) && !isUserIdAlphanumeric(r) {
+			return fmt.Errorf("User Id validation failed: user id should start and end with a letter or a digit")
+		}
+	}
+	return nil
+}
+
+// Given a (processed) user id, ensures that it can be used by a new user: it follows the charset rules and isn't reserved
+func validateNewUserId(userId string) error {
+	err := validateUserIdCharset(userId)
+	if err != nil {
+		return err
+	}
+	if reservedUserIds[userId] {
+		return fmt.Errorf("User Id validation failed: %s is a reserved name", userId)
+	}
+	return nil
+}
+
+// Given a (processed) user id, returns a registered user id that looks like it, if there is one. The caller should be holding the registry lock.
+func findConfusableUserId(userId string) (string, bool) {
+	skeleton := getUserIdSkeleton(userId)
+	for existingUserId := range userRegistry {
+		if existingUserId != userId && getUserIdSkeleton(existingUserId) == skeleton {
+			return existingUserId, true
+		}
+	}
+	return "", false
+}
+
+// Given a user id, returns its 'skeleton': two ids that look alike have the same skeleton
+func getUserIdSkeleton(userId string) string {
+	var b strings.Builder
+	for _, r := range userId {
+		if latin, exists := confusableRunes[r]; exists {
+			r = latin
+		}
+		// Dots and hyphens are easy to miss, so they don't make two ids look different
+		if r == '.' || r == '-' {
+			continue
+		}
+		b.WriteRune(r)
+	}
+	return confusableSequences.Replace(b.String())
+}
+
+// Given a non-conforming user id, comes up with a conforming id that isn't taken yet, or returns an empty string
+func suggestUserId(userId string, taken map[string]bool) string {
+	var b strings.Builder
+	for _, r := range userId {
+		if latin, exists := confusableRunes[r]; exists {
+			r = latin
+		}
+		switch {
+		case isUserIdAlphanumeric(r) || r == '.' || r == '-':
+			b.WriteRune(r)
+		case r == '_' || unicode.IsSpace(r) || r == '/':
+			b.WriteRune('-')
+		}
+	}
+	suggestion := strings.Trim(b.String(), ".-")
+	if len(suggestion) > maxUserIdLength {
+		suggestion = strings.Trim(suggestion[:maxUserIdLength], ".-")
+	}
+	for len(suggestion) < minUserIdLength && suggestion != "" {
+		suggestion += "0"
+	}
+	if reservedUserIds[suggestion] {
+		suggestion = "user-" + suggestion
+	}
+	if validateNewUserId(suggestion) != nil || taken[suggestion] {
+		return ""
+	}
+	return suggestion
+}
+
+// Tells whether the rune is a lowercase Latin letter or a digit
+func isUserIdAlphanumeric(r rune) bool {
+	return (r >= 'a' && r <= 'z') || (r >= '0' && r <= '9')
+}
+
+// Given a user id, tells whether it was already in use before the user id rules existed (a legacy id)
+func isLegacyUserId(userId string) bool {
+	if hasBuddies(userId) {
+		return true
+	}
+	userRegistryLock.Lock()
+	defer userRegistryLock.Unlock()
+	_, exists := userRegistry[userId]
+	return exists
+}
+
+// Given a user id, normalizes it the way user ids used to be normalized (lowercased and trimmed), to find legacy ids
+func processLegacyUserId(userId string) string {
+	userId = strings.ToLower(userId)
+	userId = strings.Trim(userId, " ")
+	return userId
+}
+
+// Given a user id, normalizes it with Unicode NFKC, so characters that are just a different form of another character (e.g. full-width letters) become that character
+func normalizeUserId(userId string) string {
+	return norm.NFKC.String(userId)
+}
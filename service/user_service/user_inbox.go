@@ -0,0 +1,96 @@
+package user_service
+
+import (
+	"../conversation_service"
+	"sort"
+	"time"
+)
+
+/**************************************************************************
+* I N B O X
+**************************************************************************/
+
+/*
+The inbox of a user is a lightweight listing of its conversations: one summary per conversation, with a preview of the last message
+and how many messages the user hasn't read yet, most recently active first. It's read from an index (see conversation_inbox.go),
+so listing it doesn't load any conversation.
+*/
+
+// Given a User, get the summaries of all the conversations it is a part of, except the ones with users it has blocked, and the ones it has archived.
+// The conversations it has pinned come first (see user_settings.go).
+func (u *User) GetInbox() []conversation_service.InboxEntry {
+	return u.getInbox(false)
+}
+
+// Given a User, get the summaries of the conversations it has archived, except the ones with users it has blocked
+func (u *User) GetArchivedInbox() []conversation_service.InboxEntry {
+	return u.getInbox(true)
+}
+
+// Given a User, marks the messages in its conversation with the provided user as read, up to the provided message id. A message id of 0 marks all of them as read.
+func (u *User) MarkRead(buddyUserId string, messageId int) error {
+	buddy, err := GetUser(buddyUserId)
+	if err != nil {
+		return err
+	}
+	conv, err := u.GetConversation(buddy)
+	if err != nil {
+		return err
+	}
+	return conv.MarkRead(u.UserId, messageId)
+}
+
+// Upon start of the application, this function loads the inbox index into memory from the db.
+// The first time, the index doesn't exist yet, so it's built from all the existing conversations.
+func LoadInboxToMemory() error {
+	exists, err := conversation_service.LoadInboxToMemory()
+	if err != nil || exists {
+		return err
+	}
+	convs, err := GetAllConversations()
+	if err != nil {
+		return err
+	}
+	for _, conv := range convs {
+		err = conv.UpdateInbox()
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/**************************************************************************
+* H E L P E R S
+**************************************************************************/
+
+// Given a User, get the summaries of either its archived conversations or the other ones, pinned ones first
+func (u *User) getInbox(archived bool) []conversation_service.InboxEntry {
+	now := time.Now()
+
+	var inbox []conversation_service.InboxEntry = []conversation_service.InboxEntry{}
+	for _, entry := range conversation_service.GetInbox(u.UserId) {
+		// Channels are public, so they stay listed even if the user has blocked some of their members
+		blocked := entry.ChannelName == "" && u.hasBlockedAnyOf(entry.UserIds)
+		if blocked || entry.Settings.Archived != archived {
+			continue
+		}
+		// A mute that is over doesn't show up anymore
+		if !entry.Settings.IsMuted(now) {
+			entry.Settings.MutedUntil = nil
+		}
+		inbox = append(inbox, entry)
+	}
+	sort.SliceStable(inbox, func(i, j int) bool { return inbox[i].Settings.Pinned && !inbox[j].Settings.Pinned })
+	return inbox
+}
+
+// Given a User, tells whether it has blocked any of the provided users
+func (u *User) hasBlockedAnyOf(userIds []string) bool {
+	for _, userId := range userIds {
+		if userId != u.UserId && u.HasBlocked(&User{UserId: userId}) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,58 @@
+package user_service
+
+import (
+	"../conversation_service"
+	"time"
+)
+
+/**************************************************************************
+* I N V I T E S
+**************************************************************************/
+
+// Given a User, creates an invite into the channel with the provided name (see conversation_invite.go). Only the owner and admins of the channel can.
+func (u *User) CreateInvite(channelName string, expiresAt *time.Time, maxUses int) (*conversation_service.Invite, error) {
+	// Make sure the user isn't renamed while the invite is created (see user_rename.go)
+	accountLock.RLock()
+	defer accountLock.RUnlock()
+
+	channel, err := conversation_service.GetChannel(channelName)
+	if err != nil {
+		return nil, err
+	}
+	return channel.CreateInvite(u.UserId, expiresAt, maxUses)
+}
+
+// Given a User, get the invites into the channel with the provided name. Only the owner and admins of the channel can.
+func (u *User) GetInvites(channelName string) ([]conversation_service.Invite, error) {
+	// Make sure the user isn't renamed meanwhile, since the invites name who created them (see user_rename.go)
+	accountLock.RLock()
+	defer accountLock.RUnlock()
+
+	channel, err := conversation_service.GetChannel(channelName)
+	if err != nil {
+		return nil, err
+	}
+	return channel.GetInvites(u.UserId)
+}
+
+// Given a User, revokes the invite with the provided token into the channel with the provided name. Only the owner and admins of the channel can.
+func (u *User) RevokeInvite(channelName, token string) error {
+	// Make sure the user isn't renamed while the invite is revoked (see user_rename.go)
+	accountLock.RLock()
+	defer accountLock.RUnlock()
+
+	channel, err := conversation_service.GetChannel(channelName)
+	if err != nil {
+		return err
+	}
+	return channel.RevokeInvite(u.UserId, token)
+}
+
+// Given a User, makes it a member of the channel that the invite with the provided token is for
+func (u *User) JoinWithInvite(token string) error {
+	accountLock.RLock()
+	defer accountLock.RUnlock()
+
+	_, err := conversation_service.JoinWithInvite(token, u.UserId)
+	return err
+}
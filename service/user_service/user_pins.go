@@ -0,0 +1,55 @@
+package user_service
+
+import (
+	"../message_service"
+)
+
+/**************************************************************************
+* P I N N E D  M E S S A G E S
+**************************************************************************/
+
+// Given a User, pins a message in its conversation with the provided user (see conversation_pins.go)
+func (u *User) PinMessage(buddyUserId string, messageId int) error {
+	// Make sure neither user is renamed while the conversation changes (see user_rename.go)
+	accountLock.RLock()
+	defer accountLock.RUnlock()
+
+	buddy, err := GetUser(buddyUserId)
+	if err != nil {
+		return err
+	}
+	conv, err := u.GetConversation(buddy)
+	if err != nil {
+		return err
+	}
+	return conv.PinMessage(messageId, u.UserId)
+}
+
+// Given a User, unpins a message in its conversation with the provided user. Any member can unpin any pinned message.
+func (u *User) UnpinMessage(buddyUserId string, messageId int) error {
+	accountLock.RLock()
+	defer accountLock.RUnlock()
+
+	buddy, err := GetUser(buddyUserId)
+	if err != nil {
+		return err
+	}
+	conv, err := u.GetConversation(buddy)
+	if err != nil {
+		return err
+	}
+	return conv.UnpinMessage(messageId)
+}
+
+// Given a User, get the pinned messages of its conversation with the provided user, in the order they were pinned
+func (u *User) GetPinnedMessages(buddyUserId string) ([]message_service.Message, error) {
+	buddy, err := GetUser(buddyUserId)
+	if err != nil {
+		return nil, err
+	}
+	conv, err := u.GetConversation(buddy)
+	if err != nil {
+		return nil, err
+	}
+	return conv.GetPinnedMessages(), nil
+}
@@ -0,0 +1,213 @@
+package user_service
+
+import (
+	"../realtime_service"
+	"github.com/teejays/gofiledb"
+	"sync"
+	"time"
+)
+
+/**************************************************************************
+* P R E S E N C E
+**************************************************************************/
+
+/*
+Presence tells the buddies of a user whether the user is around:
+-- Online: the user has a real-time connection open (see realtime_service)
+-- Away: the user has no connection open, but has used the API in the last awayTimeout
+-- Offline: anything else
+
+Presence: What the buddies of a user see about the user's presence.
+-- Structure:
+-- -- Status (string): "online", "away" or "offline"
+-- -- LastSeen (time): the last time the user used the API or had a connection open
+
+Users can hide their presence. Their buddies then always see them as offline, without a last-seen time.
+
+Last-seen times change on every request, so they are kept in-memory, and only saved in the database when they
+have moved by more than lastSeenSaveInterval. After a restart, a last-seen time can be off by at most that much.
+*/
+
+// Presence statuses
+const (
+	PresenceOnline  string = "online"
+	PresenceAway    string = "away"
+	PresenceOffline string = "offline"
+)
+
+// The type of the real-time events sent to the buddies of a user when the user comes online or goes offline
+const EventTypePresence string = "presence"
+
+// Define the structure for a Presence
+type Presence struct {
+	UserId   string
+	Status   string
+	LastSeen *time.Time `json:",omitempty"`
+}
+
+// Define the structure of the presence information, the way it's saved in the database
+type presenceInfo struct {
+	LastSeen map[string]time.Time
+	Hidden   map[string]bool
+}
+
+var awayTimeout time.Duration = 5 * time.Minute
+var lastSeenSaveInterval time.Duration = time.Minute
+
+var presence presenceInfo
+var savedLastSeen map[string]time.Time // the last-seen times, the way they were last saved in the database
+var presenceLock sync.Mutex
+var presenceCollectionName string = "presence" // name of the collection when storing in the db
+
+// Given a User, records that the user was active at the provided time (e.g. it made a request)
+func (u *User) Touch(now time.Time) error {
+	presenceLock.Lock()
+	defer presenceLock.Unlock()
+
+	if now.Before(presence.LastSeen[u.UserId]) {
+		return nil
+	}
+	presence.LastSeen[u.UserId] = now
+
+	// Don't hit the database on every request, only once the saved time is too far behind
+	if now.Sub(savedLastSeen[u.UserId]) < lastSeenSaveInterval {
+		return nil
+	}
+	return savePresence()
+}
+
+// Given a User, get the presence of that user as the user itself sees it, at the provided time
+func (u *User) GetPresence(now time.Time) Presence {
+	presenceLock.Lock()
+	defer presenceLock.Unlock()
+
+	var p Presence = Presence{UserId: u.UserId, Status: PresenceOffline}
+	lastSeen, seen := presence.LastSeen[u.UserId]
+	if seen {
+		p.LastSeen = &lastSeen
+	}
+	switch {
+	case realtime_service.CountConnections(u.UserId) > 0:
+		p.Status = PresenceOnline
+	case seen && now.Sub(lastSeen) < awayTimeout:
+		p.Status = PresenceAway
+	}
+	return p
+}
+
+// Given a User, get the presence of that user as other users see it, at the provided time. Hidden presence always looks offline.
+func (u *User) GetVisiblePresence(now time.Time) Presence {
+	if u.IsPresenceHidden() {
+		return Presence{UserId: u.UserId, Status: PresenceOffline}
+	}
+	return u.GetPresence(now)
+}
+
+// Given a User, tells whether it has hidden its presence from other users
+func (u *User) IsPresenceHidden() bool {
+	presenceLock.Lock()
+	defer presenceLock.Unlock()
+
+	return presence.Hidden[u.UserId]
+}
+
+// Given a User, hides (or shows again) its presence from other users
+func (u *User) SetPresenceHidden(hidden bool) error {
+	presenceLock.Lock()
+	if hidden {
+		presence.Hidden[u.UserId] = true
+	} else {
+		delete(presence.Hidden, u.UserId)
+	}
+	err := savePresence()
+	presenceLock.Unlock()
+	if err != nil {
+		return err
+	}
+
+	// Let the buddies know right away, as if the user went offline (or came back)
+	if realtime_service.CountConnections(u.UserId) > 0 {
+		return u.publishPresence(time.Now())
+	}
+	return nil
+}
+
+// Given a User, opens a real-time connection for it. It returns the channel where the events for the user arrive, and a function
+// that closes the connection. The buddies of the user are told when it comes online with its first connection, and when it goes offline.
+func (u *User) Connect() (<-chan realtime_service.Event, func(), error) {
+	err := u.Touch(time.Now())
+	if err != nil {
+		return nil, nil, err
+	}
+	events, unsubscribe := realtime_service.Subscribe(u.UserId)
+	if realtime_service.CountConnections(u.UserId) == 1 {
+		err = u.publishPresence(time.Now())
+		if err != nil {
+			unsubscribe()
+			return nil, nil, err
+		}
+	}
+
+	disconnect := func() {
+		unsubscribe()
+		// Being connected counts as being active, so the user was last seen when the connection closed
+		u.Touch(time.Now())
+		if realtime_service.CountConnections(u.UserId) == 0 {
+			u.publishPresence(time.Now())
+		}
+	}
+	return events, disconnect, nil
+}
+
+// Upon start of the application, this function loads the presence information (last-seen times and hidden presence) into memory from the db
+func LoadPresenceToMemory() error {
+	presenceLock.Lock()
+	defer presenceLock.Unlock()
+
+	db := gofiledb.GetClient()
+	exists, err := db.GetStructIfExists(presenceCollectionName, "presence_map", &presence)
+	if err != nil {
+		return err
+	}
+	if !exists || presence.LastSeen == nil {
+		presence.LastSeen = make(map[string]time.Time)
+	}
+	if !exists || presence.Hidden == nil {
+		presence.Hidden = make(map[string]bool)
+	}
+	savedLastSeen = make(map[string]time.Time)
+	for userId, lastSeen := range presence.LastSeen {
+		savedLastSeen[userId] = lastSeen
+	}
+	return nil
+}
+
+/**************************************************************************
+* H E L P E R S
+**************************************************************************/
+
+// Given a User, sends its current (visible) presence to all of its buddies over the real-time channel
+func (u *User) publishPresence(now time.Time) error {
+	buddies, err := u.GetBuddies()
+	if err != nil {
+		return err
+	}
+	var e realtime_service.Event = realtime_service.Event{Type: EventTypePresence, Data: u.GetVisiblePresence(now), Timestamp: now}
+	for _, buddy := range buddies {
+		realtime_service.Publish(buddy.UserId, e)
+	}
+	return nil
+}
+
+// Saves the presence information into the database so we don't lose it. The caller should be holding the presence lock.
+func savePresence() error {
+	db := gofiledb.GetClient()
+	err := db.SetStruct(presenceCollectionName, "presence_map", &presence)
+	if err != nil {
+		return err
+	}
+	for userId, lastSeen := range presence.LastSeen {
+		savedLastSeen[userId] = lastSeen
+	}
+	return nil
+}
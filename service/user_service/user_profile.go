@@ -0,0 +1,242 @@
+package user_service
+
+import (
+	"fmt"
+	"github.com/teejays/gofiledb"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+/**************************************************************************
+* U S E R  R E G I S T R Y
+**************************************************************************/
+
+/*
+GetUser accepts any valid user id, so on its own, a typo in a recipient's user id would start a conversation with a user that doesn't exist.
+To prevent that, users register themselves first, and messages can only be sent to registered users.
+
+Profile: The public information of a registered user.
+-- Structure:
+-- -- UserId (string)
+-- -- DisplayName (string): the name shown to other users
+-- -- AvatarRef (string): a reference (e.g. a URL) to the user's avatar image
+-- -- StatusText (string): a short status message
+-- -- TimestampCreated (time): when the user registered
+-- -- TimestampUpdated (time): when the profile was last updated
+
+Just like the buddies map, the registry is kept in-memory, with a copy saved in the database.
+*/
+
+// Define the structure for a Profile
+type Profile struct {
+	UserId           string
+	DisplayName      string
+	AvatarRef        string
+	StatusText       string
+	TimestampCreated time.Time
+	TimestampUpdated time.Time
+}
+
+// Limits on the length of the profile fields
+const (
+	maxDisplayNameLength int = 64
+	maxAvatarRefLength   int = 512
+	maxStatusTextLength  int = 140
+)
+
+// userRegistry maps the user id of every registered user to its profile
+var userRegistry map[string]*Profile
+var userRegistryLock sync.Mutex
+var userRegistryCollectionName string = "users" // name of the collection when storing in the db
+
+// Register a new user with the provided user id and profile information
+func RegisterUser(userId, displayName, avatarRef, statusText string) (*Profile, error) {
+	u, err := GetUser(userId)
+	if err != nil {
+		return nil, err
+	}
+
+	timestamp := time.Now()
+	var p Profile = Profile{
+		UserId:           u.UserId,
+		DisplayName:      displayName,
+		AvatarRef:        avatarRef,
+		StatusText:       statusText,
+		TimestampCreated: timestamp,
+		TimestampUpdated: timestamp,
+	}
+	// If no display name is provided, the user id is the next best thing
+	if strings.TrimSpace(p.DisplayName) == "" {
+		p.DisplayName = u.UserId
+	}
+	err = p.validate()
+	if err != nil {
+		return nil, err
+	}
+
+	userRegistryLock.Lock()
+	defer userRegistryLock.Unlock()
+
+	if _, exists := userRegistry[u.UserId]; exists {
+		return nil, fmt.Errorf("User %s is already registered", u.UserId)
+	}
+	// New users are held to all the user id rules (see user_id.go)
+	err = validateNewUserId(u.UserId)
+	if err != nil {
+		return nil, err
+	}
+	if existingUserId, exists := findConfusableUserId(u.UserId); exists {
+		return nil, fmt.Errorf("User Id validation failed: %s looks too much like the existing user %s", u.UserId, existingUserId)
+	}
+	userRegistry[u.UserId] = &p
+
+	err = saveUserRegistry()
+	if err != nil {
+		return nil, err
+	}
+	return &p, nil
+}
+
+// Given a user id, tells whether there is a registered user with that id
+func IsRegistered(userId string) bool {
+	userRegistryLock.Lock()
+	defer userRegistryLock.Unlock()
+
+	_, exists := userRegistry[processUserId(userId)]
+	return exists
+}
+
+// Given a user id, get the User object of a registered user. Unlike GetUser, this fails if the user hasn't registered.
+func GetRegisteredUser(userId string) (*User, error) {
+	u, err := GetUser(userId)
+	if err != nil {
+		return nil, err
+	}
+	if !IsRegistered(u.UserId) {
+		return nil, fmt.Errorf("User %s does not exist", u.UserId)
+	}
+	return u, nil
+}
+
+// Given a User, get its profile
+func (u *User) GetProfile() (*Profile, error) {
+	userRegistryLock.Lock()
+	defer userRegistryLock.Unlock()
+
+	p, exists := userRegistry[u.UserId]
+	if !exists {
+		return nil, fmt.Errorf("User %s does not exist", u.UserId)
+	}
+	// Return a copy, so the caller can't change the registry behind our back
+	var profile Profile = *p
+	return &profile, nil
+}
+
+// Get the profiles of all the registered users, sorted by user id
+func GetAllProfiles() []Profile {
+	userRegistryLock.Lock()
+	defer userRegistryLock.Unlock()
+
+	var profiles []Profile = []Profile{}
+	for _, p := range userRegistry {
+		profiles = append(profiles, *p)
+	}
+	sort.Slice(profiles, func(i, j int) bool {
+		return profiles[i].UserId < profiles[j].UserId
+	})
+	return profiles
+}
+
+// Given a User, update its profile information
+func (u *User) UpdateProfile(displayName, avatarRef, statusText string) error {
+	userRegistryLock.Lock()
+	defer userRegistryLock.Unlock()
+
+	p, exists := userRegistry[u.UserId]
+	if !exists {
+		return fmt.Errorf("User %s does not exist", u.UserId)
+	}
+
+	// Make the changes on a copy, so an invalid update doesn't leave the registry half changed
+	var updated Profile = *p
+	updated.DisplayName = displayName
+	updated.AvatarRef = avatarRef
+	updated.StatusText = statusText
+	updated.TimestampUpdated = time.Now()
+	if strings.TrimSpace(updated.DisplayName) == "" {
+		updated.DisplayName = u.UserId
+	}
+	err := updated.validate()
+	if err != nil {
+		return err
+	}
+
+	userRegistry[u.UserId] = &updated
+	return saveUserRegistry()
+}
+
+// Upon start of the application, this function loads the user registry into memory from the db.
+// It should be called after LoadBuddiesInfoToMemory: the first time it runs, there is no registry yet,
+// so all the users who already have conversations are registered, so they can keep receiving messages.
+func LoadUserRegistryToMemory() error {
+	userRegistryLock.Lock()
+	defer userRegistryLock.Unlock()
+
+	err := loadDeletedUserIds()
+	if err != nil {
+		return err
+	}
+
+	db := gofiledb.GetClient()
+	exists, err := db.GetStructIfExists(userRegistryCollectionName, "users_map", &userRegistry)
+	if err != nil {
+		return err
+	}
+	if exists {
+		return nil
+	}
+
+	userRegistry = make(map[string]*Profile)
+	timestamp := time.Now()
+	buddiesLock.RLock()
+	for userId := range buddiesInfoMap {
+		userRegistry[userId] = &Profile{
+			UserId:           userId,
+			DisplayName:      userId,
+			TimestampCreated: timestamp,
+			TimestampUpdated: timestamp,
+		}
+	}
+	buddiesLock.RUnlock()
+	return saveUserRegistry()
+}
+
+/**************************************************************************
+* H E L P E R S
+**************************************************************************/
+
+// Given a profile, cleans up its fields and makes sure they are valid
+func (p *Profile) validate() error {
+	p.DisplayName = strings.TrimSpace(p.DisplayName)
+	p.AvatarRef = strings.TrimSpace(p.AvatarRef)
+	p.StatusText = strings.TrimSpace(p.StatusText)
+
+	if len(p.DisplayName) > maxDisplayNameLength {
+		return fmt.Errorf("Profile validation failed: display name should be at most %d characters", maxDisplayNameLength)
+	}
+	if len(p.AvatarRef) > maxAvatarRefLength {
+		return fmt.Errorf("Profile validation failed: avatar reference should be at most %d characters", maxAvatarRefLength)
+	}
+	if len(p.StatusText) > maxStatusTextLength {
+		return fmt.Errorf("Profile validation failed: status text should be at most %d characters", maxStatusTextLength)
+	}
+	return nil
+}
+
+// Saves the user registry into the database so we don't lose it. The caller should be holding the registry lock.
+func saveUserRegistry() error {
+	db := gofiledb.GetClient()
+	return db.SetStruct(userRegistryCollectionName, "users_map", &userRegistry)
+}
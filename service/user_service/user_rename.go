@@ -0,0 +1,398 @@
+package user_service
+
+import (
+	"../conversation_service"
+	"fmt"
+	"github.com/teejays/gofiledb"
+	"sync"
+	"time"
+)
+
+/**************************************************************************
+* R E N A M E
+**************************************************************************/
+
+/*
+The user id of a user is everywhere: in the keys of their conversations, in the sender of their messages, in the buddies map, etc.
+Renaming a user rewrites all of them, in three steps, so that a crash half way never loses anything:
+-- 1. Copy: every conversation of the user is copied (along with its message log) under the new user id. The originals are left as is.
+-- 2. Switch: the buddies map, the registry, and everything else that refers to the user are switched to the new user id.
+-- 3. Clean up: the original conversations are erased.
+Each step can safely be run again. Before the first step, the rename is recorded in the rename history, and it's marked as completed after the last one.
+If the app stops in the middle of a rename, ResumeRenames finishes it when the app starts again.
+
+While a rename is running, no messages can be sent, edited or deleted (accountLock), so nothing is written to a conversation that's being copied.
+The old user id can't be used again, so nobody can pick it up and be mistaken for the user.
+
+Rename: A record of a user changing its user id.
+-- Structure:
+-- -- OldUserId (string)
+-- -- NewUserId (string)
+-- -- TimestampRenamed (time): when the rename started
+-- -- Completed (bool): whether all the steps of the rename are done
+*/
+
+// Define the structure for a Rename
+type Rename struct {
+	OldUserId        string
+	NewUserId        string
+	TimestampRenamed time.Time
+	Completed        bool
+}
+
+var renames []Rename
+var renamesLock sync.Mutex
+
+// Operations that change conversations hold this lock for reading, so they never run at the same time as a rename (or account deletion), which holds it for writing
+var accountLock sync.RWMutex
+
+// Given a function that changes conversations outside of the user service (e.g. the retention job), runs it under the account lock,
+// so no user is renamed or deleted while it runs
+func WithAccountLock(f func() error) error {
+	accountLock.RLock()
+	defer accountLock.RUnlock()
+	return f()
+}
+
+// Services that keep user ids of their own, but that the user service can't call because they depend on it (e.g. the schedule service),
+// register a hook to follow the renames. Hooks run under the account lock as part of the rename, so they should be safe to run again.
+var renameHooks []func(oldUserId, newUserId string) error
+
+// Given a function, calls it with the old and the new user id of every user who is renamed, as part of the rename. It should be called before ResumeRenames.
+func OnRename(hook func(oldUserId, newUserId string) error) {
+	renameHooks = append(renameHooks, hook)
+}
+
+// Given a User, changes its user id to the provided one. It returns the User object with the new user id.
+func (u *User) Rename(newUserId string) (*User, error) {
+	accountLock.Lock()
+	defer accountLock.Unlock()
+
+	if !IsRegistered(u.UserId) {
+		return nil, fmt.Errorf("User %s does not exist", u.UserId)
+	}
+	newUserId = processUserId(newUserId)
+	err := u.validateRename(newUserId)
+	if err != nil {
+		return nil, err
+	}
+
+	// Record the rename before anything changes, so it can be finished if the app stops half way
+	renamesLock.Lock()
+	renames = append(renames, Rename{OldUserId: u.UserId, NewUserId: newUserId, TimestampRenamed: time.Now()})
+	err = saveRenames()
+	renamesLock.Unlock()
+	if err != nil {
+		return nil, err
+	}
+
+	err = runRename(u.UserId, newUserId)
+	if err != nil {
+		return nil, err
+	}
+	return &User{UserId: newUserId}, nil
+}
+
+// Given a user id, get the user id that the user is known as now, following all of its renames
+func CurrentUserId(userId string) string {
+	for {
+		newUserId, renamed := renamedTo(userId)
+		if !renamed {
+			return userId
+		}
+		userId = newUserId
+	}
+}
+
+// Get the history of all the renames, oldest first
+func GetRenameHistory() []Rename {
+	renamesLock.Lock()
+	defer renamesLock.Unlock()
+
+	var history []Rename = make([]Rename, len(renames))
+	copy(history, renames)
+	return history
+}
+
+// Upon start of the application, this function loads the rename history into memory from the db, and finishes the renames that didn't complete.
+// It should be called after everything else of the user service has been loaded.
+func ResumeRenames() error {
+	accountLock.Lock()
+	defer accountLock.Unlock()
+
+	renamesLock.Lock()
+	db := gofiledb.GetClient()
+	exists, err := db.GetStructIfExists(userRegistryCollectionName, "renames", &renames)
+	if !exists {
+		renames = []Rename{}
+	}
+	var pending []Rename
+	for _, r := range renames {
+		if !r.Completed {
+			pending = append(pending, r)
+		}
+	}
+	renamesLock.Unlock()
+	if err != nil {
+		return err
+	}
+
+	for _, r := range pending {
+		err = runRename(r.OldUserId, r.NewUserId)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+/**************************************************************************
+* H E L P E R S
+**************************************************************************/
+
+// Given a User, makes sure that it can be renamed to the provided (processed) user id
+func (u *User) validateRename(newUserId string) error {
+	if newUserId == u.UserId {
+		return fmt.Errorf("User %s already has that user id", u.UserId)
+	}
+	err := validateNewUserId(newUserId)
+	if err != nil {
+		return err
+	}
+	if hasBuddies(newUserId) {
+		return fmt.Errorf("User Id %s is already taken", newUserId)
+	}
+	if _, renamed := renamedTo(newUserId); renamed {
+		return fmt.Errorf("User Id %s is already taken", newUserId)
+	}
+
+	userRegistryLock.Lock()
+	defer userRegistryLock.Unlock()
+	if _, exists := userRegistry[newUserId]; exists || isDeletedUserId(newUserId) {
+		return fmt.Errorf("User Id %s is already taken", newUserId)
+	}
+	// A user can rename itself to something that looks like its own user id, just not like anybody else's
+	if existingUserId, exists := findConfusableUserId(newUserId); exists && existingUserId != u.UserId {
+		return fmt.Errorf("User Id validation failed: %s looks too much like the existing user %s", newUserId, existingUserId)
+	}
+	return nil
+}
+
+// Runs all the steps of a rename. Every step can be run again safely, so this also finishes a rename that stopped half way.
+// The caller should be holding the account lock.
+func runRename(oldUserId, newUserId string) error {
+	oldUser, newUser := &User{UserId: oldUserId}, &User{UserId: newUserId}
+
+	// 1. Copy the conversations under the new user id, including the ones with users who deleted their account. Once the buddies map has switched, this was already done.
+	for _, bid := range append(oldUser.getBuddyIds(), oldUser.getDeletedBuddyIds()...) {
+		conv, err := conversation_service.GetConversationByUserIds([]string{oldUserId, bid})
+		if err != nil {
+			return err
+		}
+		_, err = conv.CopyWithRenamedMember(oldUserId, newUserId)
+		if err != nil {
+			return err
+		}
+	}
+
+	// 2. Switch everything else to the new user id
+	err := renameInBuddies(oldUserId, newUserId)
+	if err != nil {
+		return err
+	}
+	err = renameInRegistry(oldUserId, newUserId)
+	if err != nil {
+		return err
+	}
+	err = renameInBlocks(oldUserId, newUserId)
+	if err != nil {
+		return err
+	}
+	err = renameInContactRequests(oldUserId, newUserId)
+	if err != nil {
+		return err
+	}
+	err = renameInPresence(oldUserId, newUserId)
+	if err != nil {
+		return err
+	}
+	err = renameInChannels(oldUserId, newUserId)
+	if err != nil {
+		return err
+	}
+	for _, hook := range renameHooks {
+		err = hook(oldUserId, newUserId)
+		if err != nil {
+			return err
+		}
+	}
+
+	// 3. Erase the original conversations
+	for _, bid := range append(newUser.getBuddyIds(), newUser.getDeletedBuddyIds()...) {
+		conv, err := conversation_service.GetConversationByUserIds([]string{oldUserId, bid})
+		if err != nil {
+			return err
+		}
+		err = conv.Erase()
+		if err != nil {
+			return err
+		}
+	}
+
+	// Done, the rename doesn't need to be resumed anymore
+	renamesLock.Lock()
+	defer renamesLock.Unlock()
+	for i := 0; i < len(renames); i++ {
+		if renames[i].OldUserId == oldUserId && renames[i].NewUserId == newUserId {
+			renames[i].Completed = true
+		}
+	}
+	return saveRenames()
+}
+
+// Given a user id, tells which user id it was renamed to, if it was
+func renamedTo(userId string) (string, bool) {
+	renamesLock.Lock()
+	defer renamesLock.Unlock()
+
+	for _, r := range renames {
+		if r.OldUserId == userId {
+			return r.NewUserId, true
+		}
+	}
+	return "", false
+}
+
+// Switches a user id in the channels it is a member of, or has sent messages in, and in the invites it created. Channels don't move, they are rewritten in place (see conversation_rename.go).
+func renameInChannels(oldUserId, newUserId string) error {
+	channels, err := conversation_service.GetAllChannels()
+	if err != nil {
+		return err
+	}
+	for _, channel := range channels {
+		if !channel.IsMember(oldUserId) && !channel.HasMessagesFrom(oldUserId) && channel.CreatedBy != oldUserId {
+			continue
+		}
+		err = channel.RenameMember(oldUserId, newUserId)
+		if err != nil {
+			return err
+		}
+	}
+	return conversation_service.RenameInInvites(oldUserId, newUserId)
+}
+
+// Switches a user id in the buddies map, on both sides of every buddy pair
+func renameInBuddies(oldUserId, newUserId string) error {
+	buddiesLock.Lock()
+	defer buddiesLock.Unlock()
+
+	buddies, exists := buddiesInfoMap[oldUserId]
+	if !exists {
+		return nil
+	}
+	for bid := range buddies {
+		buddiesInfoMap[bid][newUserId] = buddiesInfoMap[bid][oldUserId]
+		delete(buddiesInfoMap[bid], oldUserId)
+	}
+	buddiesInfoMap[newUserId] = buddies
+	delete(buddiesInfoMap, oldUserId)
+
+	db := gofiledb.GetClient()
+	return db.SetStruct(buddiesCollectionName, "buddies_map", &buddiesInfoMap)
+}
+
+// Switches a user id in the registry, keeping its profile
+func renameInRegistry(oldUserId, newUserId string) error {
+	userRegistryLock.Lock()
+	defer userRegistryLock.Unlock()
+
+	// The conversations with users who deleted their account are kept for the new user id (see deletedBuddies)
+	if buddyIds, exists := deletedBuddies[oldUserId]; exists {
+		deletedBuddies[newUserId] = buddyIds
+		delete(deletedBuddies, oldUserId)
+		db := gofiledb.GetClient()
+		err := db.SetStruct(userRegistryCollectionName, "deleted_buddies", &deletedBuddies)
+		if err != nil {
+			return err
+		}
+	}
+
+	p, exists := userRegistry[oldUserId]
+	if !exists {
+		return nil
+	}
+	p.UserId = newUserId
+	// If the user never picked a display name, it was its user id, so it should follow the rename
+	if p.DisplayName == oldUserId {
+		p.DisplayName = newUserId
+	}
+	p.TimestampUpdated = time.Now()
+	userRegistry[newUserId] = p
+	delete(userRegistry, oldUserId)
+	return saveUserRegistry()
+}
+
+// Switches a user id in the blocks map, both for the users it blocked and the users who blocked it
+func renameInBlocks(oldUserId, newUserId string) error {
+	blocksLock.Lock()
+	defer blocksLock.Unlock()
+
+	if blocked, exists := blocksMap[oldUserId]; exists {
+		blocksMap[newUserId] = blocked
+		delete(blocksMap, oldUserId)
+	}
+	for _, blocked := range blocksMap {
+		if blocked[oldUserId] {
+			blocked[newUserId] = true
+			delete(blocked, oldUserId)
+		}
+	}
+	return saveBlocks()
+}
+
+// Switches a user id in the pending contact requests, including the sender of the messages they hold
+func renameInContactRequests(oldUserId, newUserId string) error {
+	contactRequestsLock.Lock()
+	defer contactRequestsLock.Unlock()
+
+	for key, cr := range contactRequests {
+		if cr.From != oldUserId && cr.To != oldUserId {
+			continue
+		}
+		if cr.From == oldUserId {
+			cr.From = newUserId
+			for i := 0; i < len(cr.HeldMessages); i++ {
+				cr.HeldMessages[i].From = newUserId
+			}
+		}
+		if cr.To == oldUserId {
+			cr.To = newUserId
+		}
+		delete(contactRequests, key)
+		contactRequests[contactRequestKey(&User{UserId: cr.From}, &User{UserId: cr.To})] = cr
+	}
+	return saveContactRequests()
+}
+
+// Switches a user id in the presence information
+func renameInPresence(oldUserId, newUserId string) error {
+	presenceLock.Lock()
+	defer presenceLock.Unlock()
+
+	if lastSeen, exists := presence.LastSeen[oldUserId]; exists {
+		presence.LastSeen[newUserId] = lastSeen
+		delete(presence.LastSeen, oldUserId)
+		delete(savedLastSeen, oldUserId)
+	}
+	if presence.Hidden[oldUserId] {
+		presence.Hidden[newUserId] = true
+		delete(presence.Hidden, oldUserId)
+	}
+	return savePresence()
+}
+
+// Saves the rename history into the database so we don't lose it. The caller should be holding the renames lock.
+func saveRenames() error {
+	db := gofiledb.GetClient()
+	return db.SetStruct(userRegistryCollectionName, "renames", &renames)
+}
@@ -0,0 +1,39 @@
+package user_service
+
+import (
+	"../conversation_service"
+)
+
+/**************************************************************************
+* R O L E S
+**************************************************************************/
+
+// Given a User, get the role of each member of the channel with the provided name (see conversation_roles.go)
+func (u *User) GetChannelRoles(name string) (map[string]conversation_service.Role, error) {
+	channel, err := u.GetChannel(name)
+	if err != nil {
+		return nil, err
+	}
+	return channel.GetRoles(), nil
+}
+
+// Given a User, changes the role of a member of the channel with the provided name. Making a member the owner transfers the ownership to them.
+// The change is announced in the channel.
+func (u *User) SetChannelRole(name, memberUserId string, role conversation_service.Role) error {
+	// Make sure neither user is renamed while the channel changes (see user_rename.go)
+	accountLock.RLock()
+	defer accountLock.RUnlock()
+
+	member, err := GetUser(memberUserId)
+	if err != nil {
+		return err
+	}
+	channel, err := conversation_service.GetChannel(name)
+	if err != nil {
+		return err
+	}
+	if role == conversation_service.RoleOwner {
+		return channel.TransferOwnership(u.UserId, member.UserId)
+	}
+	return channel.SetRole(u.UserId, member.UserId, role)
+}
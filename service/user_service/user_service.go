@@ -1,11 +1,15 @@
 package user_service
 
 import (
+	"../../config"
 	"../conversation_service"
 	"../message_service"
 	"fmt"
 	"github.com/teejays/gofiledb"
+	"log"
+	"sort"
 	"strings"
+	"sync"
 	"time"
 )
 
@@ -21,43 +25,95 @@ Field UserId of a user is defined a string so we can potentially treat it as uni
 User: Represents a user.
 -- Structure:
 -- -- UserId (string)
+-- -- Presence (Presence): whether the user is online, away or offline, only filled in when the user is listed as a buddy (see user_presence.go)
 -- Buddy: a user that another user is interacts with.
 */
 
 // Define what a user object would look like
 type User struct {
-	UserId string
+	UserId   string
+	Presence *Presence `json:",omitempty"`
 }
 
 // Given a user id, get a User Object
-// This just validates and cleans the user id, and returns a new User object with the provided user id.
+// This just cleans and validates the user id (see user_id.go), and returns a new User object with the provided user id.
 func GetUser(userId string) (*User, error) {
+	// Users that existed before the user id rules might have ids that normalization changes, so look them up the old way first
+	if legacyUserId := processLegacyUserId(userId); isLegacyUserId(legacyUserId) {
+		userId = legacyUserId
+	} else {
+		userId = processUserId(userId)
+	}
 	err := validateUserId(userId)
 	if err != nil {
 		return nil, err
 	}
-	userId = processUserId(userId)
+	// Deleted accounts are gone for good, and their user ids can't be used again, so nobody can be mistaken for the user who deleted it
+	userRegistryLock.Lock()
+	deleted := isDeletedUserId(userId)
+	userRegistryLock.Unlock()
+	if deleted {
+		return nil, fmt.Errorf("User %s has deleted their account", userId)
+	}
+	// Same for user ids that were renamed (see user_rename.go), but we can tell who the user is now
+	if newUserId, renamed := renamedTo(userId); renamed {
+		return nil, fmt.Errorf("User %s is now known as %s", userId, newUserId)
+	}
 
 	var u User = User{UserId: userId}
 
 	return &u, nil
 }
 
-// Given a User, get all the conversations that user has been a part of
+// Given a User, tells whether it's an admin. Admins are configured in the config, per workspace (see config.Admins).
+func (u *User) IsAdmin() bool {
+	for _, adminUserId := range config.GetConfig().Admins() {
+		if processUserId(adminUserId) == u.UserId {
+			return true
+		}
+	}
+	return false
+}
+
+// Given a User, get all the conversations that user has been a part of, except the ones with users it has blocked, and the ones it has archived.
+// The conversations it has pinned come first (see user_settings.go).
 func (u *User) GetConversations() ([]*conversation_service.Conversation, error) {
+	return u.getConversations(false)
+}
+
+// Given a User, get the conversations that user has archived, except the ones with users it has blocked
+func (u *User) GetArchivedConversations() ([]*conversation_service.Conversation, error) {
+	return u.getConversations(true)
+}
+
+// Given a User, get either its archived conversations or the other ones, along with its settings for each of them, pinned ones first
+func (u *User) getConversations(archived bool) ([]*conversation_service.Conversation, error) {
+	now := time.Now()
+
 	buddies, err := u.GetBuddies()
 	if err != nil {
 		return nil, err
 	}
 
-	var data []*conversation_service.Conversation = make([]*conversation_service.Conversation, len(buddies))
+	var data []*conversation_service.Conversation = []*conversation_service.Conversation{}
 
-	for i, buddy := range buddies {
-		data[i], err = u.GetConversation(buddy)
+	for _, buddy := range buddies {
+		// Conversations with users that the user has blocked are hidden, until they are unblocked
+		if u.HasBlocked(buddy) {
+			continue
+		}
+		conv, err := u.GetConversation(buddy)
 		if err != nil {
 			return nil, err
 		}
+		settings := conv.GetMemberSettings(u.UserId, now)
+		if settings.Archived != archived {
+			continue
+		}
+		conv.Settings = &settings
+		data = append(data, conv)
 	}
+	sort.SliceStable(data, func(i, j int) bool { return data[i].Settings.Pinned && !data[j].Settings.Pinned })
 	return data, nil
 }
 
@@ -74,19 +130,28 @@ func (u *User) GetConversation(buddy *User) (*conversation_service.Conversation,
 	return conversation_service.GetConversationByUserIds(userIds)
 }
 
-// Given a User, send a new message to the provided recipient
+// Given a User, send a new plain text message to the provided recipient
 func (u *User) SendMessage(recipientUserId, content string) (int, error) {
+	return u.SendMessageWithFormat(recipientUserId, content, message_service.FormatPlain)
+}
+
+// Given a User, send a new message with the provided format (e.g. plain, markdown) to the provided recipient
+func (u *User) SendMessageWithFormat(recipientUserId, content, format string) (int, error) {
+	// Make sure neither user is renamed while the message is being sent (see user_rename.go)
+	accountLock.RLock()
+	defer accountLock.RUnlock()
+
 	// Record the timestamp so we know when the message was sent
 	timestamp := time.Now()
 
-	// Get the User object representation of the recipient, since most functions like dealing with User objects instead of user ids
-	buddy, err := GetUser(recipientUserId)
+	// Get the User object representation of the recipient, since most functions like dealing with User objects instead of user ids.
+	// The recipient has to be a registered user, otherwise a typo in the user id would start a conversation with nobody.
+	buddy, err := GetRegisteredUser(recipientUserId)
 	if err != nil {
 		return -1, err
 	}
-
-	// Get the existing conversation between the two users so we can add a new message
-	conv, err := u.GetConversation(buddy)
+	// Users can't send messages to users who blocked them (or whom they blocked)
+	err = u.CheckCanSendTo(buddy)
 	if err != nil {
 		return -1, err
 	}
@@ -95,10 +160,33 @@ func (u *User) SendMessage(recipientUserId, content string) (int, error) {
 	var newMessage message_service.Message = message_service.Message{
 		Content:          content,
 		From:             u.UserId,
+		Format:           format,
 		TimestampCreated: timestamp,
 		TimestampUpdated: timestamp,
 	}
 
+	// If contact requests are required (see user_contact.go), messages to a user who isn't a buddy yet wait until the user accepts.
+	// Messaging back a user who sent a contact request accepts the request.
+	if hasContactRequest(buddy, u) {
+		err = u.acceptContactRequest(buddy)
+		if err != nil {
+			return -1, err
+		}
+	} else if u.needsContactRequest(buddy) {
+		err = u.holdMessage(buddy, newMessage)
+		if err != nil {
+			return -1, err
+		}
+		u.stopTyping(buddy)
+		return HeldMessageId, nil
+	}
+
+	// Get the existing conversation between the two users so we can add a new message
+	conv, err := u.GetConversation(buddy)
+	if err != nil {
+		return -1, err
+	}
+
 	// Add the newly created message into the conversation
 	messageId, err := conv.AddMessage(newMessage)
 	if err != nil {
@@ -112,12 +200,17 @@ func (u *User) SendMessage(recipientUserId, content string) (int, error) {
 		return -1, err
 	}
 
+	// The message is out, so the user isn't typing anymore
+	u.stopTyping(buddy)
+
 	return messageId, nil
 
 }
 
 // Given a User, edits a message that has been sent by that user previously.
 func (u *User) EditMessage(recipientUserId string, messageId int, newContent string) error {
+	accountLock.RLock()
+	defer accountLock.RUnlock()
 
 	// Get the User object representation of the recipient, since most functions like dealing with User objects instead of user ids
 	buddy, err := GetUser(recipientUserId)
@@ -142,6 +235,8 @@ func (u *User) EditMessage(recipientUserId string, messageId int, newContent str
 }
 
 func (u *User) DeleteMessage(recipientUserId string, messageId int) error {
+	accountLock.RLock()
+	defer accountLock.RUnlock()
 
 	// Get the User object representation of the recipient, since most functions like dealing with User objects instead of user ids
 	buddy, err := GetUser(recipientUserId)
@@ -165,6 +260,55 @@ func (u *User) DeleteMessage(recipientUserId string, messageId int) error {
 
 }
 
+// Given a User, set the time-to-live of the messages in its conversation with the provided recipient
+// A ttl of 0 means that the messages never disappear
+func (u *User) SetMessageTtl(recipientUserId string, ttlSeconds int) error {
+	accountLock.RLock()
+	defer accountLock.RUnlock()
+
+	// Get the User object representation of the recipient, since most functions like dealing with User objects instead of user ids
+	buddy, err := GetUser(recipientUserId)
+	if err != nil {
+		return err
+	}
+
+	// Get the existing conversation between the two users so we can update it
+	conv, err := u.GetConversation(buddy)
+	if err != nil {
+		return err
+	}
+
+	return conv.SetMessageTtl(ttlSeconds)
+}
+
+// Given a User, set the title, description and avatar of its conversation with the provided recipient. Only the provided info is changed, and the changes are announced in the conversation.
+func (u *User) UpdateConversationInfo(recipientUserId string, title, description, avatarRef *string) error {
+	accountLock.RLock()
+	defer accountLock.RUnlock()
+
+	// Get the User object representation of the recipient, since most functions like dealing with User objects instead of user ids
+	buddy, err := GetUser(recipientUserId)
+	if err != nil {
+		return err
+	}
+	// The changes are announced with messages, so the user should be able to send messages to the recipient, in a conversation they already have
+	if !hasBuddy(u.UserId, buddy.UserId) {
+		return fmt.Errorf("No conversation found with %s", buddy.UserId)
+	}
+	err = u.CheckCanSendTo(buddy)
+	if err != nil {
+		return err
+	}
+
+	// Get the existing conversation between the two users so we can update it
+	conv, err := u.GetConversation(buddy)
+	if err != nil {
+		return err
+	}
+
+	return conv.UpdateInfo(u.UserId, title, description, avatarRef)
+}
+
 /**************************************************************************
 * B U D D I E S
 **************************************************************************/
@@ -172,18 +316,23 @@ func (u *User) DeleteMessage(recipientUserId string, messageId int) error {
 /* In order to help other functions quickly get a list of all the users that a given user has conversed with,
 we maintain a map mapping user ids to all the other user ids they have conversed with.
 We store this in-memory but also save a copy in the database.
+Messages are sent (and buddies added) at the same time as the map is read, e.g. by the retention job, so it's guarded by buddiesLock.
 */
 
 // BuddiesMap is like a cache, to quickly look up who has an existing conversation with whom
 var buddiesInfoMap map[string]map[string]bool
+var buddiesLock sync.RWMutex
 var buddiesCollectionName string = "buddies" // name of the collection when storing in the db
 
-// Given a user, get all the users that it has conversed with.
+// Given a user, get all the users that it has conversed with, along with their presence (as they let other users see it).
 func (u *User) GetBuddies() ([]*User, error) {
+	now := time.Now()
 
 	// If the user doesn't exist in the buddies map, this means it has never talked to anyone
 	// Therefore, return an empty array
-	_buddies, exists := buddiesInfoMap[u.UserId]
+	buddiesLock.RLock()
+	_, exists := buddiesInfoMap[u.UserId]
+	buddiesLock.RUnlock()
 	if !exists {
 		return []*User{}, nil
 	}
@@ -191,14 +340,14 @@ func (u *User) GetBuddies() ([]*User, error) {
 	// We need to return an array of User object but buddies map stores user ids
 	// Loop through all the buddies to create a User object for each, and return the array
 	var buddies []*User
-	for bid, v := range _buddies {
-		if v {
-			buddy, err := GetUser(bid)
-			if err != nil {
-				return nil, err
-			}
-			buddies = append(buddies, buddy)
+	for _, bid := range u.getBuddyIds() {
+		buddy, err := GetUser(bid)
+		if err != nil {
+			return nil, err
 		}
+		presence := buddy.GetVisiblePresence(now)
+		buddy.Presence = &presence
+		buddies = append(buddies, buddy)
 	}
 	return buddies, nil
 }
@@ -207,8 +356,12 @@ func (u *User) GetBuddies() ([]*User, error) {
 func (u *User) SaveBuddyInfo(buddy *User) error {
 	// Sanity Check: make sure we're not adding a user as it's own buddy because that's weird
 	if u.UserId == buddy.UserId {
-		fmt.Errorf("Cannot save oneself as it's own buddy")
+		return fmt.Errorf("Cannot save oneself as it's own buddy")
 	}
+
+	buddiesLock.Lock()
+	defer buddiesLock.Unlock()
+
 	// If the user is new in buddies map, we'll have to initialize it's data structure (a go thing)
 	if _, exists := buddiesInfoMap[u.UserId]; !exists {
 		buddiesInfoMap[u.UserId] = make(map[string]bool)
@@ -235,8 +388,66 @@ func (u *User) SaveBuddyInfo(buddy *User) error {
 	return nil
 }
 
+// Given two user ids, tells whether the users have a conversation with each other
+func hasBuddy(userId, buddyId string) bool {
+	buddiesLock.RLock()
+	defer buddiesLock.RUnlock()
+	return buddiesInfoMap[userId][buddyId]
+}
+
+// Given a user id, tells whether the user is in the buddies map, i.e. whether it has ever had a conversation
+func hasBuddies(userId string) bool {
+	buddiesLock.RLock()
+	defer buddiesLock.RUnlock()
+	_, exists := buddiesInfoMap[userId]
+	return exists
+}
+
+// Get all the conversations between all the users, and all the channels. Since every other conversation is between two buddies,
+// we can find all of them by going through the buddies map, looking at each pair of buddies only once.
+func GetAllConversations() ([]*conversation_service.Conversation, error) {
+	// Find the pairs of buddies first, so the buddies map isn't held on to while the conversations load
+	var pairs [][]string
+	buddiesLock.RLock()
+	for uid, buddies := range buddiesInfoMap {
+		for bid, v := range buddies {
+			// Only look at the pair once, from the side of the smaller user id
+			if v && uid < bid {
+				pairs = append(pairs, []string{uid, bid})
+			}
+		}
+	}
+	buddiesLock.RUnlock()
+
+	// Sort the pairs so the conversations are always returned in the same order
+	sort.Slice(pairs, func(i, j int) bool {
+		if pairs[i][0] == pairs[j][0] {
+			return pairs[i][1] < pairs[j][1]
+		}
+		return pairs[i][0] < pairs[j][0]
+	})
+
+	var data []*conversation_service.Conversation = []*conversation_service.Conversation{}
+	for _, pair := range pairs {
+		conv, err := conversation_service.GetConversationByUserIds(pair)
+		if err != nil {
+			return nil, err
+		}
+		data = append(data, conv)
+	}
+
+	// Channels are listed in their own index (see conversation_channel.go)
+	channels, err := conversation_service.GetAllChannels()
+	if err != nil {
+		return nil, err
+	}
+	return append(data, channels...), nil
+}
+
 // Upon start of the application, this function loads the buddies map into memory from the db
 func LoadBuddiesInfoToMemory() error {
+	buddiesLock.Lock()
+	defer buddiesLock.Unlock()
 
 	db := gofiledb.GetClient()
 	exists, err := db.GetStructIfExists(buddiesCollectionName, "buddies_map", &buddiesInfoMap)
@@ -249,23 +460,102 @@ func LoadBuddiesInfoToMemory() error {
 	return nil
 }
 
+/**************************************************************************
+* R E B U I L D
+**************************************************************************/
+
+// Rebuilds the conversation snapshots and the buddies map from the event logs of the conversations (see conversation_log.go).
+// This is useful after a snapshot or the buddies map gets corrupted, or after their structure changes. It returns the number of rebuilt conversations.
+func RebuildFromEventLog() (int, error) {
+
+	// The inbox index (see user_inbox.go) is updated along with the snapshots, keeping what the users have already read
+	_, err := conversation_service.LoadInboxToMemory()
+	if err != nil {
+		log.Printf("Could not load the inbox index, it will be rebuilt without what the users have already read: %s", err)
+	}
+	// The channel index (see conversation_channel.go) is updated along with the snapshots of the channels
+	err = conversation_service.LoadChannelsToMemory()
+	if err != nil {
+		log.Printf("Could not load the channel index, it will be rebuilt: %s", err)
+	}
+
+	// Conversations saved before the event log existed only have a snapshot, so they need to be recorded in the log first.
+	// We can only find them through the buddies map, so if it (or a snapshot) can't be read, we move on with what's already in the log.
+	err = LoadBuddiesInfoToMemory()
+	if err != nil {
+		log.Printf("Could not load the buddies map, only the conversations already in the event log will be rebuilt: %s", err)
+		buddiesLock.Lock()
+		buddiesInfoMap = make(map[string]map[string]bool)
+		buddiesLock.Unlock()
+	}
+	convs, err := GetAllConversations()
+	if err != nil {
+		log.Printf("Could not load all the conversations, only the conversations already in the event log will be rebuilt: %s", err)
+	}
+	for _, conv := range convs {
+		err = conv.EnsureInLog()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	// Replay every log from scratch, and save a fresh snapshot for each conversation
+	rebuilt, err := conversation_service.RebuildSnapshots()
+	if err != nil {
+		return 0, err
+	}
+
+	// Two users are buddies if a message has ever been sent in a conversation between them
+	buddiesLock.Lock()
+	defer buddiesLock.Unlock()
+	buddiesInfoMap = make(map[string]map[string]bool)
+	for _, conv := range rebuilt {
+		// Members of a channel aren't buddies just because they are in the same channel
+		if conv.LastMessageId == 0 || conv.ChannelName != "" {
+			continue
+		}
+		for _, uid := range conv.UserIds {
+			for _, bid := range conv.UserIds {
+				if uid == bid {
+					continue
+				}
+				if _, exists := buddiesInfoMap[uid]; !exists {
+					buddiesInfoMap[uid] = make(map[string]bool)
+				}
+				buddiesInfoMap[uid][bid] = true
+			}
+		}
+	}
+
+	db := gofiledb.GetClient()
+	err = db.SetStruct(buddiesCollectionName, "buddies_map", &buddiesInfoMap)
+	if err != nil {
+		return 0, err
+	}
+	return len(rebuilt), nil
+}
+
 /**************************************************************************
 * H E L P E R
 **************************************************************************/
 
-// Given a user id, it ensures that the user id is valid
+// Given a (processed) user id, it ensures that the user id is valid
 func validateUserId(userId string) error {
-	// To do: Ensure that there no special characters
-
-	if strings.Trim(userId, " ") == "" {
+	if userId == "" {
 		return fmt.Errorf("User Id validation failed: empty user id")
 	}
+	// Legacy ids, created before the user id rules existed, keep working until they are migrated
+	err := validateUserIdCharset(userId)
+	if err != nil && !isLegacyUserId(userId) {
+		return err
+	}
 	return nil
 }
 
 // Given a user id, this standardizes the id by cleaning it up
 func processUserId(userId string) string {
+	userId = normalizeUserId(userId)
 	userId = strings.ToLower(userId)
-	userId = strings.Trim(userId, " ")
+	userId = strings.TrimSpace(userId)
 	return userId
 }
@@ -0,0 +1,99 @@
+package user_service
+
+import (
+	"../conversation_service"
+	"fmt"
+	"time"
+)
+
+/**************************************************************************
+* C O N V E R S A T I O N  S E T T I N G S
+**************************************************************************/
+
+/*
+Every user can set up each of its conversations for itself, without the other members knowing:
+-- Mute: stop being notified about the conversation until a given time.
+-- Archive: move the conversation out of its main list of conversations (and its inbox). Archived conversations are listed separately.
+-- Pin: keep the conversation at the top of its list of conversations (and its inbox).
+The settings are stored per user, along with the inbox of the user (see conversation_inbox.go), and are applied by GetConversations and GetInbox.
+*/
+
+// Given a User, mutes its conversation with the provided user until the provided time. A time that has passed (e.g. the zero time) unmutes it.
+func (u *User) MuteConversation(buddyUserId string, until time.Time) error {
+	return u.updateConversationSettings(buddyUserId, func(s *conversation_service.MemberSettings) {
+		muteUntil(s, until)
+	})
+}
+
+// Given a User, archives (or unarchives) its conversation with the provided user
+func (u *User) ArchiveConversation(buddyUserId string, archived bool) error {
+	return u.updateConversationSettings(buddyUserId, func(s *conversation_service.MemberSettings) {
+		s.Archived = archived
+	})
+}
+
+// Given a User, pins (or unpins) its conversation with the provided user
+func (u *User) PinConversation(buddyUserId string, pinned bool) error {
+	return u.updateConversationSettings(buddyUserId, func(s *conversation_service.MemberSettings) {
+		s.Pinned = pinned
+	})
+}
+
+// Given a User, changes several of its settings for its conversation with the provided user at once. Only the provided (non-nil) settings are changed.
+func (u *User) UpdateConversationSettings(buddyUserId string, mutedUntil *time.Time, archived, pinned *bool) error {
+	if mutedUntil == nil && archived == nil && pinned == nil {
+		return fmt.Errorf("No conversation settings provided")
+	}
+	return u.updateConversationSettings(buddyUserId, func(s *conversation_service.MemberSettings) {
+		if mutedUntil != nil {
+			muteUntil(s, *mutedUntil)
+		}
+		if archived != nil {
+			s.Archived = *archived
+		}
+		if pinned != nil {
+			s.Pinned = *pinned
+		}
+	})
+}
+
+// Given a User, get its settings for its conversation with the provided user
+func (u *User) GetConversationSettings(buddyUserId string) (conversation_service.MemberSettings, error) {
+	buddy, err := GetUser(buddyUserId)
+	if err != nil {
+		return conversation_service.MemberSettings{}, err
+	}
+	conv, err := u.GetConversation(buddy)
+	if err != nil {
+		return conversation_service.MemberSettings{}, err
+	}
+	return conv.GetMemberSettings(u.UserId, time.Now()), nil
+}
+
+/**************************************************************************
+* H E L P E R S
+**************************************************************************/
+
+// Given the settings of a member, mutes the conversation until the provided time. A time that has passed unmutes it.
+func muteUntil(s *conversation_service.MemberSettings, until time.Time) {
+	if until.After(time.Now()) {
+		s.MutedUntil = &until
+	} else {
+		s.MutedUntil = nil
+	}
+}
+
+// Given a User, applies a change to its settings for its conversation with the provided user
+func (u *User) updateConversationSettings(buddyUserId string, update func(s *conversation_service.MemberSettings)) error {
+	buddy, err := GetUser(buddyUserId)
+	if err != nil {
+		return err
+	}
+	conv, err := u.GetConversation(buddy)
+	if err != nil {
+		return err
+	}
+	settings := conv.GetMemberSettings(u.UserId, time.Now())
+	update(&settings)
+	return conv.SetMemberSettings(u.UserId, settings)
+}
@@ -0,0 +1,33 @@
+package user_service
+
+import (
+	"../conversation_service"
+	"log"
+	"time"
+)
+
+/**************************************************************************
+* D I S A P P E A R I N G  M E S S A G E S
+**************************************************************************/
+
+// Starts a background process that removes the expired messages from conversations every interval (see conversation_ttl.go)
+func StartMessageReaper(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		for now := range ticker.C {
+			err := ExpireMessages(now)
+			if err != nil {
+				log.Println(err)
+			}
+		}
+	}()
+}
+
+// Removes the messages that have expired by the provided time from all the conversations that have a message TTL
+func ExpireMessages(now time.Time) error {
+	// Make sure no member is renamed while its conversations change (see user_rename.go)
+	accountLock.RLock()
+	defer accountLock.RUnlock()
+
+	return conversation_service.ExpireMessages(now)
+}
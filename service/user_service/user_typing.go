@@ -0,0 +1,139 @@
+package user_service
+
+import (
+	"../realtime_service"
+	"fmt"
+	"sync"
+	"time"
+)
+
+/**************************************************************************
+* T Y P I N G  I N D I C A T O R S
+**************************************************************************/
+
+/*
+While a user is typing a message, the other members of the conversation are told about it over the real-time channel (see realtime_service).
+
+TypingIndicator: Tells that a user started or stopped typing in a conversation.
+-- Structure:
+-- -- UserId (string): the user who is typing
+-- -- UserIds ([]string): the members of the conversation the user is typing in
+-- -- Typing (bool): whether the user is typing, or stopped
+-- -- TimestampExpires (time): when the indicator goes away on its own, if the user is typing
+
+Typing indicators are ephemeral: they are only kept in-memory, never saved in the database.
+A client should keep signaling every few seconds while the user types. If it stops doing so (e.g. the user left),
+the indicator expires after typingTimeout, and the other members are told that the user stopped typing.
+Sending a message to the conversation also stops the indicator.
+*/
+
+// The type of the real-time events sent when a user starts or stops typing
+const EventTypeTyping string = "typing"
+
+// Define the structure for a TypingIndicator
+type TypingIndicator struct {
+	UserId           string
+	UserIds          []string
+	Typing           bool
+	TimestampExpires *time.Time `json:",omitempty"`
+}
+
+var typingTimeout time.Duration = 6 * time.Second
+
+// typingIndicators maps a typing user and the user they are typing to (see typingKey), to the indicator
+var typingIndicators map[string]TypingIndicator = make(map[string]TypingIndicator)
+var typingLock sync.Mutex
+
+// Given a User, signals to the provided recipient that the user started (or stopped) typing in their conversation
+func (u *User) SetTyping(recipientUserId string, typing bool) error {
+	// Only registered users can get messages, so there's nobody to tell if the recipient isn't one
+	buddy, err := GetRegisteredUser(recipientUserId)
+	if err != nil {
+		return err
+	}
+	if buddy.UserId == u.UserId {
+		return fmt.Errorf("Cannot have a conversation with yourself")
+	}
+	err = u.CheckCanSendTo(buddy)
+	if err != nil {
+		return err
+	}
+	if !typing {
+		u.stopTyping(buddy)
+		return nil
+	}
+
+	expires := time.Now().Add(typingTimeout)
+	var indicator TypingIndicator = TypingIndicator{
+		UserId:           u.UserId,
+		UserIds:          []string{u.UserId, buddy.UserId},
+		Typing:           true,
+		TimestampExpires: &expires,
+	}
+
+	typingLock.Lock()
+	typingIndicators[typingKey(u, buddy)] = indicator
+	typingLock.Unlock()
+
+	realtime_service.Publish(buddy.UserId, realtime_service.Event{Type: EventTypeTyping, Data: indicator})
+	return nil
+}
+
+// Starts a background process that expires the typing indicators every interval
+func StartTypingReaper(interval time.Duration) {
+	go func() {
+		ticker := time.NewTicker(interval)
+		for now := range ticker.C {
+			ExpireTypingIndicators(now)
+		}
+	}()
+}
+
+// Removes all the typing indicators that have expired at the provided time, and tells the recipients that the users stopped typing
+func ExpireTypingIndicators(now time.Time) {
+	typingLock.Lock()
+	var expired []TypingIndicator
+	for key, indicator := range typingIndicators {
+		if !now.Before(*indicator.TimestampExpires) {
+			expired = append(expired, indicator)
+			delete(typingIndicators, key)
+		}
+	}
+	typingLock.Unlock()
+
+	for _, indicator := range expired {
+		publishStoppedTyping(indicator.UserIds[0], indicator.UserIds[1])
+	}
+}
+
+/**************************************************************************
+* H E L P E R S
+**************************************************************************/
+
+// Given a User, removes its typing indicator for the provided recipient, and tells the recipient, if the user was typing
+func (u *User) stopTyping(buddy *User) {
+	typingLock.Lock()
+	key := typingKey(u, buddy)
+	_, wasTyping := typingIndicators[key]
+	delete(typingIndicators, key)
+	typingLock.Unlock()
+
+	if wasTyping {
+		publishStoppedTyping(u.UserId, buddy.UserId)
+	}
+}
+
+// Tells the recipient that the user stopped typing
+func publishStoppedTyping(userId, recipientUserId string) {
+	var indicator TypingIndicator = TypingIndicator{
+		UserId:  userId,
+		UserIds: []string{userId, recipientUserId},
+		Typing:  false,
+	}
+	realtime_service.Publish(recipientUserId, realtime_service.Event{Type: EventTypeTyping, Data: indicator})
+}
+
+// Given a user and a recipient, returns the key of the typing indicator in the typingIndicators map. User ids can't contain '>'.
+func typingKey(u, buddy *User) string {
+	return u.UserId + ">" + buddy.UserId
+}
@@ -0,0 +1,143 @@
+package tests
+
+import (
+	"../config"
+	"../service/user_service"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+/**************************************************************************
+* T E S T S
+**************************************************************************/
+
+func TestStorageRoot(t *testing.T) {
+	// 1. Without a workspace, the data should live in the folder of the default workspace, next to the other workspaces
+	var c config.Config = config.Config{GoFiledbRoot: "/data/restfulchat"}
+	if root := c.StorageRoot(); root != filepath.Join("/data/restfulchat", "workspaces", "default") {
+		t.Errorf("Unexpected storage root without a workspace, got %s", root)
+	}
+
+	// 2. Every workspace should have its own folder inside the GoFiledbRoot
+	c.Workspace = "design"
+	if root := c.StorageRoot(); root != filepath.Join("/data/restfulchat", "workspaces", "design") {
+		t.Errorf("Unexpected storage root for a workspace, got %s", root)
+	}
+}
+
+func TestWorkspaceIsolation(t *testing.T) {
+	dir, err := ioutil.TempDir("", "workspaces")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	// 1. Save a record in the storage of every workspace, the default one included
+	workspaces := []string{"", "design", "sales"}
+	for _, name := range workspaces {
+		var c config.Config = config.Config{GoFiledbRoot: dir, Workspace: name}
+		err = os.MkdirAll(filepath.Join(c.StorageRoot(), "users"), 0755)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = ioutil.WriteFile(filepath.Join(c.StorageRoot(), "users", "user_"+name), []byte("{}"), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// 2. Every workspace should only find its own record in its storage
+	for _, name := range workspaces {
+		var c config.Config = config.Config{GoFiledbRoot: dir, Workspace: name}
+		var found []string
+		err = filepath.Walk(c.StorageRoot(), func(path string, info os.FileInfo, err error) error {
+			if err == nil && !info.IsDir() {
+				found = append(found, info.Name())
+			}
+			return err
+		})
+		if err != nil {
+			t.Error(err)
+		}
+		if len(found) != 1 || found[0] != "user_"+name {
+			t.Errorf("Workspace %q sees data that isn't its own: %v", name, found)
+		}
+	}
+}
+
+func TestWorkspaceAdmins(t *testing.T) {
+	// 1. The admins of the default workspace are AdminUserIds, and the other workspaces have their own
+	var c config.Config = config.Config{
+		AdminUserIds: []string{"admin1"},
+		Workspaces:   map[string]config.WorkspaceConfig{"design": {AdminUserIds: []string{"admin2"}}},
+	}
+	if admins := c.Admins(); len(admins) != 1 || admins[0] != "admin1" {
+		t.Errorf("Unexpected admins of the default workspace: %v", admins)
+	}
+	c.Workspace = "design"
+	if admins := c.Admins(); len(admins) != 1 || admins[0] != "admin2" {
+		t.Errorf("Unexpected admins of a workspace: %v", admins)
+	}
+	c.Workspace = "sales"
+	if admins := c.Admins(); len(admins) != 0 {
+		t.Errorf("Admins of another workspace are admins of a workspace without its own: %v", admins)
+	}
+
+	// 2. An admin of the default workspace should not be an admin of the server of another workspace
+	original := config.GetConfig().Workspace
+	defer config.SetWorkspace(original)
+	u, err := user_service.GetUser("adminuser1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !u.IsAdmin() {
+		t.Errorf("Admin of the default workspace is not an admin")
+	}
+	err = config.SetWorkspace("design")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if u.IsAdmin() {
+		t.Errorf("Admin of the default workspace is an admin of another workspace")
+	}
+}
+
+func TestSetWorkspace(t *testing.T) {
+	// The tests run in a workspace of their own, so it needs to be put back afterwards
+	original := config.GetConfig().Workspace
+	defer config.SetWorkspace(original)
+
+	// 1. Names that are not folder names inside the workspaces folder should be rejected, and leave the workspace as it was
+	for _, name := range []string{"a", "Design", "-design", "../design", "design/team", ".", strings.Repeat("a", 51)} {
+		if err := config.SetWorkspace(name); err == nil {
+			t.Errorf("SetWorkspace() allowed an invalid workspace name: %q", name)
+		}
+		if config.GetConfig().Workspace != original {
+			t.Errorf("SetWorkspace() changed the workspace to an invalid name: %q", name)
+		}
+	}
+
+	// 2. Valid names should be accepted, and so should no workspace at all
+	for _, name := range []string{"design", "team-2", "0_ops", strings.Repeat("a", 50), ""} {
+		if err := config.SetWorkspace(name); err != nil {
+			t.Errorf("SetWorkspace() rejected a valid workspace name %q: %s", name, err)
+		}
+	}
+}
+
+func TestSetHttpServerPort(t *testing.T) {
+	original := config.GetConfig().HttpServerPort
+	defer config.SetHttpServerPort(original)
+
+	for _, port := range []int{-1, 0, 65536} {
+		if err := config.SetHttpServerPort(port); err == nil {
+			t.Errorf("SetHttpServerPort() allowed an invalid port: %d", port)
+		}
+	}
+	if err := config.SetHttpServerPort(8081); err != nil || config.GetConfig().HttpServerPort != 8081 {
+		t.Errorf("SetHttpServerPort() did not set a valid port")
+	}
+}
@@ -1,9 +1,16 @@
 package tests
 
 import (
+	"../config"
 	"../service/conversation_service"
 	"../service/message_service"
+	"../service/user_service"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 )
 
 /**************************************************************************
@@ -114,3 +121,514 @@ func TestGetConversationByUserIds(t *testing.T) {
 		t.Errorf("Invalid length of messages, expected %d, got %d", 2, len(conv.Messages))
 	}
 }
+
+func TestMessageTtl(t *testing.T) {
+	// Create a conversation with an old message and a new message
+	conv, err := conversation_service.GetConversationByUserIds([]string{"ttluser1", "ttluser2"})
+	if err != nil {
+		t.Error(err)
+	}
+	old := MockMessages["ok_1"]
+	old.TimestampCreated = time.Now().Add(-2 * time.Hour)
+	_, err = conv.AddMessage(old)
+	if err != nil {
+		t.Error(err)
+	}
+	_, err = conv.AddMessage(MockMessages["ok_2"])
+	if err != nil {
+		t.Error(err)
+	}
+
+	// 1. A negative TTL should not be allowed
+	err = conv.SetMessageTtl(-1)
+	if err == nil {
+		t.Errorf("SetMessageTtl() allowed a negative TTL")
+	}
+
+	// 2. Setting a TTL of an hour should remove the old message right away, and set the expiry of the new one
+	err = conv.SetMessageTtl(3600)
+	if err != nil {
+		t.Error(err)
+	}
+	conv, err = conversation_service.GetConversationByUserIds([]string{"ttluser1", "ttluser2"})
+	if err != nil {
+		t.Error(err)
+	}
+	if len(conv.Messages) != 1 {
+		t.Fatalf("Invalid length of messages after setting a TTL, expected %d, got %d", 1, len(conv.Messages))
+	}
+	if conv.Messages[0].TimestampExpires == nil {
+		t.Errorf("Message in a conversation with a TTL has no expiry time")
+	}
+
+	// 3. Once the reaper runs after the remaining message expires, it should be removed from the database
+	err = user_service.ExpireMessages(time.Now().Add(2 * time.Hour))
+	if err != nil {
+		t.Error(err)
+	}
+	conv, err = conversation_service.GetConversationByUserIds([]string{"ttluser1", "ttluser2"})
+	if err != nil {
+		t.Error(err)
+	}
+	if len(conv.Messages) != 0 || conv.LastMessageId != 2 {
+		t.Errorf("Expired messages were not removed by the reaper")
+	}
+
+	// 4. The content of the expired messages should not be kept in the event log either
+	b, err := ioutil.ReadFile(filepath.Join(config.GetConfig().StorageRoot(), "conversation_log", conv.UniqueKey()+".log"))
+	if err != nil {
+		t.Error(err)
+	}
+	if strings.Contains(string(b), MockMessages["ok_1"].Content) || strings.Contains(string(b), MockMessages["ok_2"].Content) {
+		t.Errorf("Content of expired messages was not redacted from the event log")
+	}
+}
+
+func TestMessageLog(t *testing.T) {
+	userIds := []string{"loguser1", "loguser2"}
+	conv, err := conversation_service.GetConversationByUserIds(userIds)
+	if err != nil {
+		t.Error(err)
+	}
+
+	// Add a few messages, edit one, and delete another, so the log has all kinds of events
+	for _, key := range []string{"ok_1", "ok_2", "ok_3"} {
+		_, err = conv.AddMessage(MockMessages[key])
+		if err != nil {
+			t.Error(err)
+		}
+	}
+	err = conv.EditMessage(2, "edited message", MockMessages["ok_2"].From)
+	if err != nil {
+		t.Error(err)
+	}
+	err = conv.DeleteMessage(1, MockMessages["ok_1"].From)
+	if err != nil {
+		t.Error(err)
+	}
+
+	// 1. Loading the conversation again should replay the log on top of the snapshot
+	conv, err = conversation_service.GetConversationByUserIds(userIds)
+	if err != nil {
+		t.Error(err)
+	}
+	if len(conv.Messages) != 2 || conv.Messages[0].Content != "edited message" || conv.LastMessageId != 3 {
+		t.Errorf("Replaying the message log did not give the expected conversation")
+	}
+
+	// 2. A partial line left behind by a crash should not break the log
+	file, err := os.OpenFile(filepath.Join(config.GetConfig().StorageRoot(), "conversation_log", conv.UniqueKey()+".log"), os.O_APPEND|os.O_WRONLY, 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	file.Write([]byte(`{"Sequence": 99, "Type": "ad`))
+	file.Close()
+
+	_, err = conv.AddMessage(MockMessages["ok_1"])
+	if err != nil {
+		t.Error(err)
+	}
+	conv, err = conversation_service.GetConversationByUserIds(userIds)
+	if err != nil {
+		t.Error(err)
+	}
+	if len(conv.Messages) != 3 || conv.LastMessageId != 4 {
+		t.Errorf("Message log did not recover from a partial line, expected %d messages, got %d", 3, len(conv.Messages))
+	}
+
+	// 3. Saving a snapshot should keep all the messages
+	err = conv.Save()
+	if err != nil {
+		t.Error(err)
+	}
+	conv, err = conversation_service.GetConversationByUserIds(userIds)
+	if err != nil {
+		t.Error(err)
+	}
+	if len(conv.Messages) != 3 {
+		t.Errorf("Invalid length of messages after compaction, expected %d, got %d", 3, len(conv.Messages))
+	}
+	b, err := ioutil.ReadFile(filepath.Join(config.GetConfig().StorageRoot(), "conversation_log", conv.UniqueKey()+".log"))
+	if err != nil {
+		t.Error(err)
+	}
+	if lines := strings.Count(string(b), "\n"); lines != 1 {
+		t.Errorf("Saving a snapshot did not compact the log into a single event, got %d events", lines)
+	}
+
+	// 4. A change made on an old copy of the conversation should be retried on the latest state, so no message id is given out twice
+	old, err := conversation_service.GetConversationByUserIds(userIds)
+	if err != nil {
+		t.Error(err)
+	}
+	newId, err := conv.AddMessage(MockMessages["ok_2"])
+	if err != nil {
+		t.Error(err)
+	}
+	oldId, err := old.AddMessage(MockMessages["ok_3"])
+	if err != nil {
+		t.Error(err)
+	}
+	if oldId != newId+1 || len(old.Messages) != 5 {
+		t.Errorf("Change on an old copy was not retried on the latest state, expected message id %d, got %d", newId+1, oldId)
+	}
+}
+
+func TestConversationCache(t *testing.T) {
+	// The cache is off for the other tests, since they change the database behind its back. Turn it on just for this test.
+	config.GetConfig().ConversationCacheSize = 2
+	defer func() {
+		config.GetConfig().ConversationCacheSize = 0
+		conversation_service.PurgeCache()
+	}()
+	userIds := []string{"cacheuser1", "cacheuser2"}
+
+	// 1. The first load should be a miss, the second a hit
+	stats := conversation_service.GetCacheStats()
+	conv, err := conversation_service.GetConversationByUserIds(userIds)
+	if err != nil {
+		t.Error(err)
+	}
+	conv, err = conversation_service.GetConversationByUserIds(userIds)
+	if err != nil {
+		t.Error(err)
+	}
+	newStats := conversation_service.GetCacheStats()
+	if newStats.Misses != stats.Misses+1 || newStats.Hits != stats.Hits+1 {
+		t.Errorf("Unexpected cache metrics, expected %d misses and %d hits, got %d and %d", stats.Misses+1, stats.Hits+1, newStats.Misses, newStats.Hits)
+	}
+
+	// 2. Changes to the conversation should be written through to the cache, and changes to a copy should not leak into it
+	_, err = conv.AddMessage(MockMessages["ok_1"])
+	if err != nil {
+		t.Error(err)
+	}
+	conv.Messages[0].Content = "changed without saving"
+	conv, err = conversation_service.GetConversationByUserIds(userIds)
+	if err != nil {
+		t.Error(err)
+	}
+	if len(conv.Messages) != 1 || conv.Messages[0].Content != MockMessages["ok_1"].Content {
+		t.Errorf("Cache did not return the latest state of the conversation")
+	}
+
+	// 3. A change made on an old copy of the conversation should be retried on the latest state, and the next load should see both changes
+	old, err := conversation_service.GetConversationByUserIds(userIds)
+	if err != nil {
+		t.Error(err)
+	}
+	_, err = conv.AddMessage(MockMessages["ok_2"])
+	if err != nil {
+		t.Error(err)
+	}
+	oldId, err := old.AddMessage(MockMessages["ok_3"])
+	if err != nil {
+		t.Error(err)
+	}
+	if oldId != 3 {
+		t.Errorf("Change on an old copy was not retried on the latest state, expected message id %d, got %d", 3, oldId)
+	}
+	conv, err = conversation_service.GetConversationByUserIds(userIds)
+	if err != nil {
+		t.Error(err)
+	}
+	if len(conv.Messages) != 3 {
+		t.Errorf("Cache served an old state of the conversation, expected %d messages, got %d", 3, len(conv.Messages))
+	}
+	var messageIds map[int]bool = make(map[int]bool)
+	for _, m := range conv.Messages {
+		if messageIds[m.Id] {
+			t.Errorf("Message id %d was given to more than one message", m.Id)
+		}
+		messageIds[m.Id] = true
+	}
+
+	// 4. Changes to the expiry times, roles or settings of a copy should not leak into the cache either
+	err = conv.SetMessageTtl(3600)
+	if err != nil {
+		t.Error(err)
+	}
+	conv, err = conversation_service.GetConversationByUserIds(userIds)
+	if err != nil {
+		t.Error(err)
+	}
+	if conv.Messages[0].TimestampExpires == nil {
+		t.Fatalf("Message of a conversation with a TTL has no expiry time")
+	}
+	*conv.Messages[0].TimestampExpires = time.Time{}
+	conv.Settings = &conversation_service.MemberSettings{Pinned: true}
+	conv, err = conversation_service.GetConversationByUserIds(userIds)
+	if err != nil {
+		t.Error(err)
+	}
+	if conv.Messages[0].TimestampExpires.IsZero() || conv.Settings != nil {
+		t.Errorf("Changes to a copy of the conversation leaked into the cache")
+	}
+	err = conv.SetMessageTtl(0)
+	if err != nil {
+		t.Error(err)
+	}
+	channel, err := conversation_service.CreateChannel("cache-club", "", "cacheuser1", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = channel.Join("cacheuser2")
+	if err != nil {
+		t.Error(err)
+	}
+	err = channel.SetRole("cacheuser1", "cacheuser2", conversation_service.RoleAdmin)
+	if err != nil {
+		t.Error(err)
+	}
+	channel.Roles["cacheuser2"] = conversation_service.RoleMember
+	if channel, err = conversation_service.GetChannel("cache-club"); err != nil || channel.Roles["cacheuser2"] != conversation_service.RoleAdmin {
+		t.Errorf("Changes to the roles of a copy of the channel leaked into the cache")
+	}
+
+	// 5. Going over the size limit should evict the least recently used conversation
+	for _, other := range [][]string{{"cacheuser1", "cacheuser3"}, {"cacheuser1", "cacheuser4"}} {
+		_, err = conversation_service.GetConversationByUserIds(other)
+		if err != nil {
+			t.Error(err)
+		}
+	}
+	newStats = conversation_service.GetCacheStats()
+	if newStats.Entries != 2 || newStats.Evictions == 0 {
+		t.Errorf("Cache did not evict conversations when over its size limit, got %d entries and %d evictions", newStats.Entries, newStats.Evictions)
+	}
+}
+
+func TestPinnedMessages(t *testing.T) {
+	userIds := []string{"pinuser1", "pinuser2"}
+	conv, err := conversation_service.GetConversationByUserIds(userIds)
+	if err != nil {
+		t.Error(err)
+	}
+	for _, key := range []string{"ok_1", "ok_2", "ok_3"} {
+		_, err = conv.AddMessage(MockMessages[key])
+		if err != nil {
+			t.Error(err)
+		}
+	}
+
+	// 1. Pinning should only work for existing messages that aren't pinned yet, up to the maximum
+	config.GetConfig().MaxPinnedMessages = 2
+	defer func() { config.GetConfig().MaxPinnedMessages = 0 }()
+	for _, messageId := range []int{3, 1} {
+		err = conv.PinMessage(messageId, "pinuser1")
+		if err != nil {
+			t.Error(err)
+		}
+	}
+	if err = conv.PinMessage(1, "pinuser1"); err == nil {
+		t.Errorf("PinMessage() allowed a message to be pinned twice")
+	}
+	if err = conv.PinMessage(99, "pinuser1"); err == nil {
+		t.Errorf("PinMessage() allowed a message that doesn't exist to be pinned")
+	}
+	if err = conv.PinMessage(2, "pinuser1"); err == nil {
+		t.Errorf("PinMessage() allowed more pins than the maximum")
+	}
+
+	// 2. The pins should be replayed from the log, in the order they were pinned
+	conversation_service.PurgeCache()
+	conv, err = conversation_service.GetConversationByUserIds(userIds)
+	if err != nil {
+		t.Error(err)
+	}
+	pinned := conv.GetPinnedMessages()
+	if len(pinned) != 2 || pinned[0].Id != 3 || pinned[1].Id != 1 || conv.PinnedMessages[0].PinnedBy != "pinuser1" {
+		t.Errorf("Unexpected pinned messages after replaying the log: %+v", conv.PinnedMessages)
+	}
+
+	// 3. Deleting a pinned message, or unpinning it, should remove its pin
+	err = conv.DeleteMessage(3, MockMessages["ok_3"].From)
+	if err != nil {
+		t.Error(err)
+	}
+	err = conv.UnpinMessage(1)
+	if err != nil {
+		t.Error(err)
+	}
+	if err = conv.UnpinMessage(1); err == nil {
+		t.Errorf("UnpinMessage() allowed a message that isn't pinned to be unpinned")
+	}
+	conversation_service.PurgeCache()
+	conv, err = conversation_service.GetConversationByUserIds(userIds)
+	if err != nil {
+		t.Error(err)
+	}
+	if len(conv.PinnedMessages) != 0 {
+		t.Errorf("Expected no pinned messages, got %d", len(conv.PinnedMessages))
+	}
+}
+
+func TestConversationInfo(t *testing.T) {
+	userIds := []string{"infouser1", "infouser2"}
+	conv, err := conversation_service.GetConversationByUserIds(userIds)
+	if err != nil {
+		t.Error(err)
+	}
+	first := MockMessages["ok_1"]
+	first.From = "infouser2"
+	_, err = conv.AddMessage(first)
+	if err != nil {
+		t.Error(err)
+	}
+	if conv.CreatedBy != "infouser2" || !conv.TimestampCreated.Equal(first.TimestampCreated) {
+		t.Errorf("Conversation was not created by the sender of its first message")
+	}
+
+	// 1. Every change to the info should be announced with a system message from the user who made it
+	err = conv.UpdateInfo("infouser2", stringRef("Weekend trip"), stringRef("Plans for the weekend"), nil)
+	if err != nil {
+		t.Error(err)
+	}
+	if conv.Title != "Weekend trip" || conv.Description != "Plans for the weekend" || len(conv.Messages) != 3 {
+		t.Fatalf("Unexpected conversation after updating its info: %d messages", len(conv.Messages))
+	}
+	announcement := conv.Messages[1]
+	if !announcement.System || announcement.From != "infouser2" || announcement.Content != `changed the title to "Weekend trip"` {
+		t.Errorf("Unexpected system message: %+v", announcement)
+	}
+	if err = conv.EditMessage(announcement.Id, "something else", "infouser2"); err == nil {
+		t.Errorf("EditMessage() allowed a system message to be edited")
+	}
+	if err = conv.DeleteMessage(announcement.Id, "infouser2"); err == nil {
+		t.Errorf("DeleteMessage() allowed a system message to be deleted")
+	}
+
+	// 2. Nothing should be announced when nothing changed, and invalid info should be rejected
+	err = conv.UpdateInfo("infouser2", stringRef(" Weekend trip "), stringRef("Plans for the weekend"), nil)
+	if err != nil {
+		t.Error(err)
+	}
+	if len(conv.Messages) != 3 {
+		t.Errorf("Unchanged info was announced")
+	}
+	if err = conv.UpdateInfo("infouser2", stringRef(strings.Repeat("a", 101)), nil, nil); err == nil {
+		t.Errorf("UpdateInfo() allowed a title that is too long")
+	}
+	if err = conv.UpdateInfo("infouser3", stringRef("Something else"), nil, nil); err == nil {
+		t.Errorf("UpdateInfo() allowed a user who isn't a member to change the info")
+	}
+
+	// 3. Only the provided info should change
+	err = conv.UpdateInfo("infouser2", nil, nil, stringRef("avatars/trip.png"))
+	if err != nil {
+		t.Error(err)
+	}
+	if conv.Title != "Weekend trip" || conv.Description != "Plans for the weekend" || conv.AvatarRef != "avatars/trip.png" || len(conv.Messages) != 4 {
+		t.Errorf("Updating only the avatar changed the rest of the info")
+	}
+
+	// 4. The info should be replayed from the log
+	conversation_service.PurgeCache()
+	conv, err = conversation_service.GetConversationByUserIds(userIds)
+	if err != nil {
+		t.Error(err)
+	}
+	if conv.Title != "Weekend trip" || conv.Description != "Plans for the weekend" || conv.CreatedBy != "infouser2" {
+		t.Errorf("Replaying the message log did not give the expected info")
+	}
+}
+
+func TestConversationRoles(t *testing.T) {
+	// 1. Conversations that aren't channels don't have roles, so only the sender of a message can delete it
+	conv, err := conversation_service.GetConversationByUserIds([]string{"roleuser1", "roleuser2"})
+	if err != nil {
+		t.Error(err)
+	}
+	for _, from := range []string{"roleuser1", "roleuser2"} {
+		m := MockMessages["ok_1"]
+		m.From = from
+		_, err = conv.AddMessage(m)
+		if err != nil {
+			t.Error(err)
+		}
+	}
+	roles := conv.GetRoles()
+	if roles["roleuser1"] != conversation_service.RoleMember || roles["roleuser2"] != conversation_service.RoleMember {
+		t.Errorf("Unexpected roles in a conversation that isn't a channel: %+v", roles)
+	}
+	if err = conv.DeleteMessage(2, "roleuser1"); err == nil {
+		t.Errorf("DeleteMessage() allowed the creator of a conversation to delete the message of the other member")
+	}
+	if err = conv.SetRole("roleuser1", "roleuser2", conversation_service.RoleAdmin); err == nil {
+		t.Errorf("SetRole() allowed a role to be set in a conversation that isn't a channel")
+	}
+
+	// 2. The creator of a channel should be its owner, and only the owner and admins should be able to delete others' messages
+	channel, err := conversation_service.CreateChannel("roles", "", "roleuser1", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = channel.Join("roleuser2")
+	if err != nil {
+		t.Error(err)
+	}
+	var messageIds []int
+	for _, from := range []string{"roleuser1", "roleuser2", "roleuser2"} {
+		m := MockMessages["ok_1"]
+		m.From = from
+		messageId, err := channel.AddMessage(m)
+		if err != nil {
+			t.Error(err)
+		}
+		messageIds = append(messageIds, messageId)
+	}
+	roles = channel.GetRoles()
+	if roles["roleuser1"] != conversation_service.RoleOwner || roles["roleuser2"] != conversation_service.RoleMember {
+		t.Errorf("Unexpected roles: %+v", roles)
+	}
+	if err = channel.DeleteMessage(messageIds[0], "roleuser2"); err == nil {
+		t.Errorf("DeleteMessage() allowed a member to delete the message of another member")
+	}
+	if err = channel.EditMessage(messageIds[1], "edited", "roleuser1"); err == nil {
+		t.Errorf("EditMessage() allowed the owner to edit the message of another member")
+	}
+	err = channel.DeleteMessage(messageIds[1], "roleuser1")
+	if err != nil {
+		t.Error(err)
+	}
+	if err = channel.SetRole("roleuser2", "roleuser2", conversation_service.RoleAdmin); err == nil {
+		t.Errorf("SetRole() allowed a member to make themselves an admin")
+	}
+
+	// 3. Transferring the ownership should keep the previous owner on as an admin, and be announced
+	err = channel.TransferOwnership("roleuser1", "roleuser2")
+	if err != nil {
+		t.Error(err)
+	}
+	last := channel.Messages[len(channel.Messages)-1]
+	if !last.System || last.From != "roleuser1" || last.Content != "transferred the ownership to roleuser2" {
+		t.Errorf("Unexpected system message: %+v", last)
+	}
+	if err = channel.TransferOwnership("roleuser1", "roleuser1"); err == nil {
+		t.Errorf("TransferOwnership() allowed a former owner to transfer the ownership")
+	}
+	err = channel.SetRole("roleuser2", "roleuser1", conversation_service.RoleMember)
+	if err != nil {
+		t.Error(err)
+	}
+
+	// 4. The roles should be replayed from the log
+	conversation_service.PurgeCache()
+	channel, err = conversation_service.GetChannel("roles")
+	if err != nil {
+		t.Fatal(err)
+	}
+	roles = channel.GetRoles()
+	if roles["roleuser1"] != conversation_service.RoleMember || roles["roleuser2"] != conversation_service.RoleOwner {
+		t.Errorf("Unexpected roles after replaying the log: %+v", roles)
+	}
+}
+
+/**************************************************************************
+* H E L P E R S
+**************************************************************************/
+
+// Given a string, get a pointer to a copy of it, for the info and settings that are only changed when they are provided
+func stringRef(s string) *string {
+	return &s
+}
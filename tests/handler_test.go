@@ -2,6 +2,9 @@ package tests
 
 import (
 	"../handler"
+	"../service/conversation_service"
+	"../service/user_service"
+	"archive/zip"
 	"bytes"
 	"encoding/json"
 	"github.com/julienschmidt/httprouter"
@@ -247,3 +250,104 @@ func TestDeleteChatHandler(t *testing.T) {
 	}
 
 }
+
+func TestGetExportHandler(t *testing.T) {
+	req := httptest.NewRequest("GET", "/v1/export/someuser1", nil)
+	rr := httptest.NewRecorder()
+	router := httprouter.New()
+	router.GET("/v1/export/:userid", handler.GetExportHandler)
+	router.ServeHTTP(rr, req)
+
+	// Check the status code and the type of the response
+	if status := rr.Code; status != http.StatusOK {
+		t.Fatalf("handler returned wrong status code: got %v want %v", status, http.StatusOK)
+	}
+	if contentType := rr.Header().Get("Content-Type"); contentType != "application/zip" {
+		t.Errorf("Get /v1/export endpoint sent an unexpected content type: %s", contentType)
+	}
+
+	// The archive should have the profile, and the conversation with someuser2
+	archive, err := zip.NewReader(bytes.NewReader(rr.Body.Bytes()), int64(rr.Body.Len()))
+	if err != nil {
+		t.Fatal(err)
+	}
+	var found map[string]bool = make(map[string]bool)
+	for _, f := range archive.File {
+		found[f.Name] = true
+	}
+	for _, name := range []string{"profile.json", "authored_messages.json", "conversations/conversation_someuser1_someuser2.json"} {
+		if !found[name] {
+			t.Errorf("Get /v1/export endpoint sent an archive without %s", name)
+		}
+	}
+}
+
+func TestChannelHandlers(t *testing.T) {
+	for _, userId := range []string{"chanowner1", "chanmember1", "chanmember2"} {
+		_, err := user_service.RegisterUser(userId, "", "", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	router := httprouter.New()
+	router.POST("/v1/channels/:userid", handler.PostChannelsHandler)
+	router.POST("/v1/membership/:userid", handler.PostMembershipHandler)
+	router.DELETE("/v1/membership/:userid", handler.DeleteMembershipHandler)
+	router.POST("/v1/channel/:userid", handler.PostChannelHandler)
+	router.PUT("/v1/channel/:userid", handler.PutChannelHandler)
+	router.DELETE("/v1/channel/:userid", handler.DeleteChannelHandler)
+	router.PUT("/v1/roles/:userid", handler.PutRoleHandler)
+
+	// Sends a request as the provided user, and checks that it got the expected status code
+	request := func(method, path, userId string, params interface{}, expectedStatus int) {
+		body, err := json.Marshal(params)
+		if err != nil {
+			t.Fatal(err)
+		}
+		req := httptest.NewRequest(method, path+userId, bytes.NewBuffer(body))
+		rr := httptest.NewRecorder()
+		router.ServeHTTP(rr, req)
+		if rr.Code != expectedStatus {
+			t.Errorf("%s %s by %s returned wrong status code: got %v want %v (%s)", method, path, userId, rr.Code, expectedStatus, rr.Body.String())
+		}
+	}
+
+	// 1. The owner of a channel should be able to add members to it, but a plain member should not
+	request("POST", "/v1/channels/", "chanowner1", handler.ChannelBodyParams{Channel: "handlers"}, http.StatusOK)
+	request("POST", "/v1/membership/", "chanowner1", handler.ChannelBodyParams{Channel: "handlers", UserId: "chanmember1"}, http.StatusOK)
+	request("POST", "/v1/membership/", "chanmember1", handler.ChannelBodyParams{Channel: "handlers", UserId: "chanmember2"}, http.StatusBadRequest)
+	request("POST", "/v1/membership/", "chanowner1", handler.ChannelBodyParams{Channel: "handlers", UserId: "chanmember2"}, http.StatusOK)
+
+	// 2. Members should be able to edit and delete their own messages, but not the messages of other members
+	channel, err := conversation_service.GetChannel("handlers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	request("POST", "/v1/channel/", "chanmember1", handler.ChannelBodyParams{Channel: "handlers", Content: MockContent["ok_1"]}, http.StatusOK)
+	request("POST", "/v1/channel/", "chanmember1", handler.ChannelBodyParams{Channel: "handlers", Content: MockContent["ok_2"]}, http.StatusOK)
+	first := channel.LastMessageId + 1
+	request("PUT", "/v1/channel/", "chanmember1", handler.ChannelBodyParams{Channel: "handlers", MessageId: first, Content: "edited"}, http.StatusOK)
+	request("PUT", "/v1/channel/", "chanmember2", handler.ChannelBodyParams{Channel: "handlers", MessageId: first, Content: "edited again"}, http.StatusBadRequest)
+	request("DELETE", "/v1/channel/", "chanmember2", handler.ChannelBodyParams{Channel: "handlers", MessageId: first}, http.StatusBadRequest)
+	request("DELETE", "/v1/channel/", "chanmember1", handler.ChannelBodyParams{Channel: "handlers", MessageId: first}, http.StatusOK)
+
+	// 3. Admins should be able to delete the messages of other members, and remove plain members, but not the owner
+	request("DELETE", "/v1/membership/", "chanmember2", handler.ChannelBodyParams{Channel: "handlers", UserId: "chanmember1"}, http.StatusBadRequest)
+	request("PUT", "/v1/roles/", "chanowner1", handler.RoleBodyParams{Channel: "handlers", UserId: "chanmember2", Role: conversation_service.RoleAdmin}, http.StatusOK)
+	request("DELETE", "/v1/channel/", "chanmember2", handler.ChannelBodyParams{Channel: "handlers", MessageId: first + 1}, http.StatusOK)
+	request("DELETE", "/v1/membership/", "chanmember2", handler.ChannelBodyParams{Channel: "handlers", UserId: "chanowner1"}, http.StatusBadRequest)
+	request("DELETE", "/v1/membership/", "chanmember2", handler.ChannelBodyParams{Channel: "handlers", UserId: "chanmember1"}, http.StatusOK)
+
+	channel, err = conversation_service.GetChannel("handlers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if channel.IsMember("chanmember1") || len(channel.UserIds) != 2 {
+		t.Errorf("Removed member is still in the channel: %v", channel.UserIds)
+	}
+	for _, m := range channel.Messages {
+		if !m.System {
+			t.Errorf("Deleted message is still in the channel: %+v", m)
+		}
+	}
+}
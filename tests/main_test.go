@@ -2,6 +2,10 @@ package tests
 
 import (
 	"../config"
+	"../service/conversation_service"
+	"../service/moderation_service"
+	"../service/retention_service"
+	"../service/schedule_service"
 	"../service/user_service"
 	"github.com/teejays/gofiledb"
 	"log"
@@ -15,7 +19,7 @@ import (
 func init() {
 	config.InitConfig("settings_test.json")
 	// Test DB: For testing, we use a different DB location since we do not want to interfare with the actual database
-	gofiledb.InitClient(config.GetConfig().GoFiledbRoot)
+	gofiledb.InitClient(config.GetConfig().StorageRoot())
 
 	// Since the Test DB might have data from the last test, we should flush the DB
 	db := gofiledb.GetClient()
@@ -26,6 +30,86 @@ func init() {
 	if err != nil {
 		log.Fatal(err)
 	}
+
+	// (Just like actual app) Load the registry of users, and register all the users that tests send messages to
+	err = user_service.LoadUserRegistryToMemory()
+	if err != nil {
+		log.Fatal(err)
+	}
+	for _, userId := range []string{"testuser1", "testuser2", "testuser3", "someuser1", "someuser2", "scheduser2", "scheduser3", "retuser2", "rebuilduser2"} {
+		_, err = user_service.RegisterUser(userId, "", "", "")
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	// (Just like actual app) Load the presence information of the users
+	err = user_service.LoadPresenceToMemory()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// (Just like actual app) Load the users that users have blocked
+	err = user_service.LoadBlocksToMemory()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// (Just like actual app) Load the pending contact requests
+	err = user_service.LoadContactRequestsToMemory()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// (Just like actual app) Load the channel index
+	err = conversation_service.LoadChannelsToMemory()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// (Just like actual app) Load the suspended users, and the moderation log
+	err = moderation_service.LoadModerationToMemory()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// (Just like actual app) Load the invites into channels
+	err = conversation_service.LoadInvitesToMemory()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// (Just like actual app) Load the inbox index
+	err = user_service.LoadInboxToMemory()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// (Just like actual app) Load the queue of scheduled messages, which follows renames and account deletions. We don't start the scheduler, tests deliver messages themselves
+	err = schedule_service.LoadScheduledMessagesToMemory()
+	if err != nil {
+		log.Fatal(err)
+	}
+	user_service.OnRename(schedule_service.RenameUser)
+	user_service.OnDelete(schedule_service.CancelAll)
+
+	// (Just like actual app) Finish the interrupted user id renames
+	err = user_service.ResumeRenames()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// (Just like actual app) Load the index of conversations with disappearing messages. Tests run the reaper themselves
+	err = conversation_service.LoadTtlIndexToMemory()
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	// (Just like actual app) Load the audit log of the retention policies. Tests run the retention job themselves
+	err = retention_service.LoadAuditLogToMemory()
+	if err != nil {
+		log.Fatal(err)
+	}
 }
 
 /**************************************************************************
@@ -39,6 +39,22 @@ var MockMessages map[string]message_service.Message = map[string]message_service
 		TimestampUpdated: time.Now(),
 		From:             "someuser2",
 	},
+	"markdown_1": message_service.Message{
+		Id:               5,
+		Content:          "**Hello** <script>alert(1)</script> [site](https://example.com) [bad](javascript:alert) `a*b*c`",
+		TimestampCreated: time.Now(),
+		TimestampUpdated: time.Now(),
+		From:             "someuser1",
+		Format:           message_service.FormatMarkdown,
+	},
+	"bad_format_1": message_service.Message{
+		Id:               6,
+		Content:          "Hello world 6",
+		TimestampCreated: time.Now(),
+		TimestampUpdated: time.Now(),
+		From:             "someuser1",
+		Format:           "html",
+	},
 }
 
 /**************************************************************************
@@ -61,3 +77,52 @@ func TestValidate(t *testing.T) {
 	}
 
 }
+
+func TestSanitize(t *testing.T) {
+	// 1. A message without a format should become plain, and lose its control characters
+	m := message_service.Message{Content: "Hello\x00 World\nBye"}
+	m.Sanitize()
+	if m.Format != message_service.FormatPlain {
+		t.Errorf("Expected empty format to default to %s, got %s", message_service.FormatPlain, m.Format)
+	}
+	if m.Content != "Hello World\nBye" {
+		t.Errorf("Control characters were not removed from the content, got %q", m.Content)
+	}
+
+	// 2. A message with an unsupported format should not be validated
+	_m := MockMessages["bad_format_1"]
+	err := _m.Validate()
+	if err == nil {
+		t.Errorf("A message with an unsupported format was validated")
+	}
+}
+
+func TestRenderHtml(t *testing.T) {
+	// 1. Plain messages should be escaped, and not formatted
+	m := message_service.Message{Content: "<b>**hi**</b>", Format: message_service.FormatPlain}
+	expected := "&lt;b&gt;**hi**&lt;/b&gt;"
+	if got := m.RenderHtml(); got != expected {
+		t.Errorf("Unexpected plain rendering, expected %s, got %s", expected, got)
+	}
+
+	// 2. Markdown messages should be formatted, but never include raw HTML or unsafe links
+	m = MockMessages["markdown_1"]
+	expected = `<p><strong>Hello</strong> &lt;script&gt;alert(1)&lt;/script&gt; <a href="https://example.com" rel="nofollow noopener" target="_blank">site</a> bad <code>a*b*c</code></p>`
+	if got := m.RenderHtml(); got != expected {
+		t.Errorf("Unexpected markdown rendering, expected %s, got %s", expected, got)
+	}
+
+	// 3. Lists and code blocks should be rendered as blocks
+	m = message_service.Message{Content: "- one\n- _two_\n\n```\n<x>\n```", Format: message_service.FormatMarkdown}
+	expected = "<ul><li>one</li><li><em>two</em></li></ul><pre><code>&lt;x&gt;</code></pre>"
+	if got := m.RenderHtml(); got != expected {
+		t.Errorf("Unexpected markdown rendering, expected %s, got %s", expected, got)
+	}
+
+	// 4. Urls should be left alone by the formatting, only the text of the links is formatted
+	m = message_service.Message{Content: "See [the *docs*](https://x/a_b_c~~d~~*e*) and _this_", Format: message_service.FormatMarkdown}
+	expected = `<p>See <a href="https://x/a_b_c~~d~~*e*" rel="nofollow noopener" target="_blank">the <em>docs</em></a> and <em>this</em></p>`
+	if got := m.RenderHtml(); got != expected {
+		t.Errorf("Unexpected markdown rendering, expected %s, got %s", expected, got)
+	}
+}
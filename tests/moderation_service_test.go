@@ -0,0 +1,117 @@
+package tests
+
+import (
+	"../handler"
+	"../service/moderation_service"
+	"../service/user_service"
+	"github.com/julienschmidt/httprouter"
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+/**************************************************************************
+* T E S T S
+**************************************************************************/
+
+func TestModeration(t *testing.T) {
+	for _, userId := range []string{"moduser1", "moduser2", "adminuser1"} {
+		_, err := user_service.RegisterUser(userId, "", "", "")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	u, err := user_service.GetUser("moduser1")
+	if err != nil {
+		t.Error(err)
+	}
+	messageId, err := u.SendMessage("moduser2", MockContent["ok_1"])
+	if err != nil {
+		t.Error(err)
+	}
+	moderationLogLength := len(moderation_service.GetModerationLog())
+
+	// 1. Admins should be able to read and delete the messages of any conversation, and both should be recorded
+	conv, err := moderation_service.ViewConversation("adminuser1", []string{"ModUser1", "moduser2"}, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(conv.Messages) != 1 {
+		t.Errorf("Expected 1 message in the conversation, got %d", len(conv.Messages))
+	}
+	err = moderation_service.DeleteMessage("adminuser1", []string{"moduser1", "moduser2"}, "", messageId, "Spam")
+	if err != nil {
+		t.Error(err)
+	}
+	if conv, _ = moderation_service.ViewConversation("adminuser1", []string{"moduser1", "moduser2"}, ""); len(conv.Messages) != 0 {
+		t.Errorf("Message was not deleted")
+	}
+	moderationLog := moderation_service.GetModerationLog()
+	if len(moderationLog) != moderationLogLength+3 {
+		t.Fatalf("Invalid length of moderation log, expected %d, got %d", moderationLogLength+3, len(moderationLog))
+	}
+	deletion := moderationLog[moderationLogLength+1]
+	if deletion.Action != moderation_service.ActionDeleteMessage || deletion.MessageId != messageId || deletion.MessageFrom != "moduser1" || deletion.Reason != "Spam" {
+		t.Errorf("Unexpected entry in the moderation log: %+v", deletion)
+	}
+
+	// 2. Suspensions should end in the future, and admins can't be suspended
+	past := time.Now().Add(-time.Hour)
+	if err = moderation_service.Suspend("adminuser1", "moduser1", &past, ""); err == nil {
+		t.Errorf("Suspend() allowed a suspension that has already ended")
+	}
+	if err = moderation_service.Suspend("adminuser1", "adminuser1", nil, ""); err == nil {
+		t.Errorf("Suspend() allowed an admin to be banned")
+	}
+
+	// 3. A suspended user should be rejected until the suspension ends
+	until := time.Now().Add(time.Hour)
+	err = moderation_service.Suspend("adminuser1", "moduser1", &until, "Cool off")
+	if err != nil {
+		t.Error(err)
+	}
+	if err = moderation_service.CheckNotSuspended("moduser1", time.Now()); err == nil {
+		t.Errorf("CheckNotSuspended() allowed a suspended user")
+	}
+	if err = moderation_service.CheckNotSuspended("moduser1", until.Add(time.Second)); err != nil {
+		t.Errorf("CheckNotSuspended() rejected a user whose suspension has ended: %s", err)
+	}
+	req := httptest.NewRequest("GET", "/v1/chat/moduser1", nil)
+	rr := httptest.NewRecorder()
+	router := httprouter.New()
+	router.GET("/v1/chat/:userid", handler.GetChatHandler)
+	router.ServeHTTP(rr, req)
+	if rr.Code != http.StatusBadRequest {
+		t.Errorf("Suspended user was not rejected: got status %v", rr.Code)
+	}
+
+	// 4. A ban should never end, until the user is reinstated
+	err = moderation_service.Suspend("adminuser1", "moduser1", nil, "")
+	if err != nil {
+		t.Error(err)
+	}
+	if err = moderation_service.CheckNotSuspended("moduser1", time.Now().AddDate(10, 0, 0)); err == nil {
+		t.Errorf("CheckNotSuspended() allowed a banned user")
+	}
+	users := moderation_service.ListUsers()
+	var listed bool
+	for _, user := range users {
+		if user.UserId == "moduser1" {
+			listed = user.Suspension != nil && user.Suspension.Until == nil
+		}
+	}
+	if !listed {
+		t.Errorf("Banned user was not listed with their ban")
+	}
+	err = moderation_service.Reinstate("adminuser1", "moduser1")
+	if err != nil {
+		t.Error(err)
+	}
+	if err = moderation_service.CheckNotSuspended("moduser1", time.Now()); err != nil {
+		t.Errorf("CheckNotSuspended() rejected a reinstated user: %s", err)
+	}
+	if moderationLog = moderation_service.GetModerationLog(); len(moderationLog) != moderationLogLength+6 {
+		t.Errorf("Invalid length of moderation log, expected %d, got %d", moderationLogLength+6, len(moderationLog))
+	}
+}
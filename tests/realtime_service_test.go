@@ -0,0 +1,49 @@
+package tests
+
+import (
+	"../service/realtime_service"
+	"testing"
+)
+
+/**************************************************************************
+* T E S T S
+**************************************************************************/
+
+func TestPublish(t *testing.T) {
+	// 1. Every connection of the user should get the event
+	events1, unsubscribe1 := realtime_service.Subscribe("rtuser1")
+	events2, unsubscribe2 := realtime_service.Subscribe("rtuser1")
+	if n := realtime_service.CountConnections("rtuser1"); n != 2 {
+		t.Errorf("Unexpected number of connections, expected %d, got %d", 2, n)
+	}
+	realtime_service.Publish("rtuser1", realtime_service.Event{Type: "test", Data: "hello"})
+	for _, events := range []<-chan realtime_service.Event{events1, events2} {
+		select {
+		case e := <-events:
+			if e.Type != "test" || e.Data != "hello" || e.Timestamp.IsZero() {
+				t.Errorf("Unexpected event received: %+v", e)
+			}
+		default:
+			t.Errorf("Event was not received by a connection")
+		}
+	}
+
+	// 2. Publishing to a user with no connections, or to a slow connection, should never block
+	realtime_service.Publish("rtuser2", realtime_service.Event{Type: "test"})
+	for i := 0; i < 100; i++ {
+		realtime_service.Publish("rtuser1", realtime_service.Event{Type: "test"})
+	}
+
+	// 3. Closing a connection should close its channel, and only that connection
+	unsubscribe1()
+	unsubscribe1()
+	if n := realtime_service.CountConnections("rtuser1"); n != 1 {
+		t.Errorf("Unexpected number of connections, expected %d, got %d", 1, n)
+	}
+	for range events1 {
+	}
+	unsubscribe2()
+	if n := realtime_service.CountConnections("rtuser1"); n != 0 {
+		t.Errorf("Unexpected number of connections, expected %d, got %d", 0, n)
+	}
+}
@@ -0,0 +1,72 @@
+package tests
+
+import (
+	"../service/retention_service"
+	"../service/user_service"
+	"testing"
+	"time"
+)
+
+/**************************************************************************
+* T E S T S
+**************************************************************************/
+
+func TestEnforceRetention(t *testing.T) {
+	// Create a conversation with three messages
+	u, err := user_service.GetUser("retuser1")
+	if err != nil {
+		t.Error(err)
+	}
+	for _, content := range []string{MockContent["ok_1"], MockContent["ok_2"], MockContent["ok_3"]} {
+		_, err = u.SendMessage("retuser2", content)
+		if err != nil {
+			t.Error(err)
+		}
+	}
+
+	// 1. Negative limits should not be allowed
+	err = retention_service.SetConversationRetention([]string{"retuser1", "retuser2"}, -1, 0)
+	if err == nil {
+		t.Errorf("SetConversationRetention() allowed a negative limit")
+	}
+
+	// 2. Keeping only the last message should prune the first two, and record them in the audit log
+	err = retention_service.SetConversationRetention([]string{"RetUser1", "retuser2"}, 0, 1)
+	if err != nil {
+		t.Error(err)
+	}
+	auditLogLength := len(retention_service.GetAuditLog())
+	err = retention_service.EnforceRetention(time.Now())
+	if err != nil {
+		t.Error(err)
+	}
+
+	buddy, err := user_service.GetUser("retuser2")
+	if err != nil {
+		t.Error(err)
+	}
+	conv, err := u.GetConversation(buddy)
+	if err != nil {
+		t.Error(err)
+	}
+	if len(conv.Messages) != 1 || conv.Messages[0].Content != MockContent["ok_3"] {
+		t.Errorf("Retention policy did not keep only the most recent message")
+	}
+
+	auditLog := retention_service.GetAuditLog()
+	if len(auditLog) != auditLogLength+1 {
+		t.Fatalf("Invalid length of audit log, expected %d, got %d", auditLogLength+1, len(auditLog))
+	}
+	if len(auditLog[len(auditLog)-1].PrunedMessages) != 2 {
+		t.Errorf("Invalid number of pruned messages in the audit log, expected %d, got %d", 2, len(auditLog[len(auditLog)-1].PrunedMessages))
+	}
+
+	// 3. Running the job again should not prune anything more
+	err = retention_service.EnforceRetention(time.Now())
+	if err != nil {
+		t.Error(err)
+	}
+	if len(retention_service.GetAuditLog()) != auditLogLength+1 {
+		t.Errorf("Retention job recorded an entry even though nothing was pruned")
+	}
+}
@@ -0,0 +1,237 @@
+package tests
+
+import (
+	"../service/conversation_service"
+	"../service/moderation_service"
+	"../service/schedule_service"
+	"../service/user_service"
+	"testing"
+	"time"
+)
+
+/**************************************************************************
+* T E S T S
+**************************************************************************/
+
+func TestSchedule(t *testing.T) {
+	u, err := user_service.GetUser("scheduser1")
+	if err != nil {
+		t.Error(err)
+	}
+
+	// 1. Scheduling a message in the future should work
+	smId, err := schedule_service.Schedule(u, "scheduser2", MockContent["ok_1"], "", time.Now().Add(time.Hour))
+	if err != nil {
+		t.Error(err)
+	}
+	if smId < 1 {
+		t.Errorf("Invalid scheduled message id returned")
+	}
+
+	// 2. Scheduling a message in the past should not work
+	_, err = schedule_service.Schedule(u, "scheduser2", MockContent["ok_1"], "", time.Now().Add(-time.Hour))
+	if err == nil {
+		t.Errorf("Schedule() allowed a message to be scheduled in the past")
+	}
+
+	// 3. Scheduling an empty message should not work
+	_, err = schedule_service.Schedule(u, "scheduser2", MockContent["empty_1"], "", time.Now().Add(time.Hour))
+	if err == nil {
+		t.Errorf("Schedule() allowed an empty message to be scheduled")
+	}
+
+	// 4. The scheduled message should be listed for the user who scheduled it, but not for the recipient
+	scheduled := schedule_service.GetScheduledMessages(u)
+	if len(scheduled) != 1 {
+		t.Errorf("Invalid number of scheduled messages, expected %d, got %d", 1, len(scheduled))
+	}
+	buddy, err := user_service.GetUser("scheduser2")
+	if err != nil {
+		t.Error(err)
+	}
+	if len(schedule_service.GetScheduledMessages(buddy)) != 0 {
+		t.Errorf("Scheduled messages of a user were listed for another user")
+	}
+}
+
+func TestEditAndCancelScheduled(t *testing.T) {
+	u, err := user_service.GetUser("scheduser1")
+	if err != nil {
+		t.Error(err)
+	}
+	smId, err := schedule_service.Schedule(u, "scheduser3", MockContent["ok_2"], "", time.Now().Add(time.Hour))
+	if err != nil {
+		t.Error(err)
+	}
+
+	// 1. Editing a scheduled message should work
+	err = schedule_service.Edit(u, smId, MockContent["ok_3"], time.Now().Add(2*time.Hour))
+	if err != nil {
+		t.Error(err)
+	}
+
+	// 2. Another user should not be able to cancel the message
+	buddy, err := user_service.GetUser("scheduser3")
+	if err != nil {
+		t.Error(err)
+	}
+	err = schedule_service.Cancel(buddy, smId)
+	if err == nil {
+		t.Errorf("Cancel() allowed a user to cancel a message scheduled by someone else")
+	}
+
+	// 3. Cancelling the message should remove it from the list
+	err = schedule_service.Cancel(u, smId)
+	if err != nil {
+		t.Error(err)
+	}
+	for _, sm := range schedule_service.GetScheduledMessages(u) {
+		if sm.Id == smId {
+			t.Errorf("Cancelled scheduled message is still pending")
+		}
+	}
+}
+
+func TestDeliverDueMessages(t *testing.T) {
+	u, err := user_service.GetUser("scheduser1")
+	if err != nil {
+		t.Error(err)
+	}
+
+	// 1. Delivering the messages due in two hours should deliver the one scheduled above
+	err = schedule_service.DeliverDueMessages(time.Now().Add(2 * time.Hour))
+	if err != nil {
+		t.Error(err)
+	}
+	if len(schedule_service.GetScheduledMessages(u)) != 0 {
+		t.Errorf("Due scheduled messages were not removed from the queue after delivery")
+	}
+
+	// 2. The message should now be in the conversation
+	buddy, err := user_service.GetUser("scheduser2")
+	if err != nil {
+		t.Error(err)
+	}
+	conv, err := u.GetConversation(buddy)
+	if err != nil {
+		t.Error(err)
+	}
+	if len(conv.Messages) != 1 || conv.Messages[0].Content != MockContent["ok_1"] {
+		t.Errorf("Scheduled message was not delivered into the conversation")
+	}
+}
+
+func TestScheduledMessagesOfDeletedUser(t *testing.T) {
+	_, err := user_service.RegisterUser("scheduser4", "", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := user_service.GetUser("scheduser4")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = schedule_service.Schedule(u, "scheduser2", MockContent["ok_1"], "", time.Now().Add(time.Hour))
+	if err != nil {
+		t.Error(err)
+	}
+
+	// 1. Deleting the account should cancel the messages the user scheduled, so none of them gets sent afterwards
+	err = u.DeleteAccount()
+	if err != nil {
+		t.Error(err)
+	}
+	if messages := schedule_service.GetScheduledMessages(u); len(messages) != 0 {
+		t.Errorf("Scheduled messages of a deleted user were not cancelled: %+v", messages)
+	}
+}
+
+func TestScheduledMessagesOfRenamedUser(t *testing.T) {
+	_, err := user_service.RegisterUser("scheduser5", "", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	u, err := user_service.GetUser("scheduser5")
+	if err != nil {
+		t.Fatal(err)
+	}
+	_, err = schedule_service.Schedule(u, "scheduser2", MockContent["ok_1"], "", time.Now().Add(time.Hour))
+	if err != nil {
+		t.Error(err)
+	}
+
+	// 1. Renaming the user should move the messages it scheduled along, as part of the rename
+	renamed, err := u.Rename("scheduser6")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if messages := schedule_service.GetScheduledMessages(renamed); len(messages) != 1 || messages[0].From != renamed.UserId {
+		t.Errorf("Scheduled messages did not move to the new user id: %+v", messages)
+	}
+	if messages := schedule_service.GetScheduledMessages(u); len(messages) != 0 {
+		t.Errorf("Scheduled messages were left behind under the old user id: %+v", messages)
+	}
+}
+
+func TestScheduledMessagesOfSuspendedUser(t *testing.T) {
+	u, err := user_service.GetUser("scheduser7")
+	if err != nil {
+		t.Fatal(err)
+	}
+	smId, err := schedule_service.Schedule(u, "scheduser2", MockContent["ok_1"], "", time.Now().Add(time.Minute))
+	if err != nil {
+		t.Error(err)
+	}
+
+	// 1. Users who never registered a profile can be suspended too
+	err = moderation_service.Suspend("adminuser1", "scheduser7", nil, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 2. The messages a suspended user scheduled should not be delivered
+	err = schedule_service.DeliverDueMessages(time.Now().Add(2 * time.Minute))
+	if err != nil {
+		t.Error(err)
+	}
+	conv, err := conversation_service.GetConversationByUserIds([]string{"scheduser7", "scheduser2"})
+	if err != nil {
+		t.Error(err)
+	}
+	if len(conv.Messages) != 0 {
+		t.Errorf("Scheduled message of a suspended user was delivered")
+	}
+
+	// 3. The message should stay in the queue to be tried again, until the scheduler gives up on it
+	scheduled := schedule_service.GetScheduledMessages(u)
+	if len(scheduled) != 1 || scheduled[0].Attempts != 1 || scheduled[0].LastError == "" || scheduled[0].Failed {
+		t.Errorf("Scheduled message that couldn't be delivered was not kept for a retry: %+v", scheduled)
+	}
+	for _, later := range []time.Duration{time.Hour, 2 * time.Hour} {
+		err = schedule_service.DeliverDueMessages(time.Now().Add(later))
+		if err != nil {
+			t.Error(err)
+		}
+	}
+	scheduled = schedule_service.GetScheduledMessages(u)
+	if len(scheduled) != 1 || scheduled[0].Attempts != 3 || !scheduled[0].Failed {
+		t.Errorf("Scheduled message was not marked as failed after the last attempt: %+v", scheduled)
+	}
+
+	err = moderation_service.Reinstate("adminuser1", "scheduser7")
+	if err != nil {
+		t.Error(err)
+	}
+
+	// 4. A failed message should not be tried again, unless it's edited
+	err = schedule_service.DeliverDueMessages(time.Now().Add(3 * time.Hour))
+	if err != nil {
+		t.Error(err)
+	}
+	if len(schedule_service.GetScheduledMessages(u)) != 1 {
+		t.Errorf("Failed scheduled message was tried again")
+	}
+	err = schedule_service.Cancel(u, smId)
+	if err != nil {
+		t.Error(err)
+	}
+}
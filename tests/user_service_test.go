@@ -1,8 +1,15 @@
 package tests
 
 import (
+	"../config"
+	"../service/conversation_service"
 	"../service/user_service"
+	"github.com/teejays/gofiledb"
+	"io/ioutil"
+	"path/filepath"
+	"strings"
 	"testing"
+	"time"
 )
 
 /**************************************************************************
@@ -93,6 +100,12 @@ func TestSendMessage(t *testing.T) {
 	if err == nil {
 		t.Errorf("SendMessage() allowed the sending of message from the same user and recipient")
 	}
+
+	// 3. Sending message to a user that hasn't registered shouldn't work
+	_, err = u.SendMessage("notregistereduser1", MockContent["ok_1"])
+	if err == nil {
+		t.Errorf("SendMessage() allowed the sending of message to a user that is not registered")
+	}
 }
 
 func TestGetConversation(t *testing.T) {
@@ -156,6 +169,1270 @@ func TestGetBuddies(t *testing.T) {
 		t.Errorf("Invalid length of buddies returned, expected %d, got %d", 1, len(buddies))
 	}
 	if buddies[0].UserId != MockUsers["ok_id_1"] {
-		t.Errorf("Unexpected user id for buddy found, expected %s, got %s", MockUsers["ok_id_1"], buddies[0])
+		t.Errorf("Unexpected user id for buddy found, expected %s, got %s", MockUsers["ok_id_1"], buddies[0].UserId)
+	}
+}
+
+func TestRebuildFromEventLog(t *testing.T) {
+	// Create a conversation with a couple of messages
+	u, err := user_service.GetUser("rebuilduser1")
+	if err != nil {
+		t.Error(err)
+	}
+	buddy, err := user_service.GetUser("rebuilduser2")
+	if err != nil {
+		t.Error(err)
+	}
+	for _, content := range []string{MockContent["ok_1"], MockContent["ok_2"]} {
+		_, err = u.SendMessage(buddy.UserId, content)
+		if err != nil {
+			t.Error(err)
+		}
+	}
+	conv, err := u.GetConversation(buddy)
+	if err != nil {
+		t.Error(err)
+	}
+	db := gofiledb.GetClient()
+
+	// 1. A snapshot that points to a place in the log that doesn't exist should be ignored, and the whole log replayed
+	err = db.SetStruct("conversation", conv.UniqueKey(), conversation_service.Conversation{UserIds: conv.UserIds, LogSequence: 999, LogOffset: 999999})
+	if err != nil {
+		t.Error(err)
+	}
+	conv, err = u.GetConversation(buddy)
+	if err != nil {
+		t.Error(err)
+	}
+	if len(conv.Messages) != 2 {
+		t.Errorf("Conversation was not replayed from the log when the snapshot was invalid, expected %d messages, got %d", 2, len(conv.Messages))
+	}
+
+	// 2. Corrupt the snapshot in a way that can't be detected, and the buddies map
+	err = db.SetStruct("conversation", conv.UniqueKey(), conversation_service.Conversation{UserIds: conv.UserIds, LogSequence: conv.LogSequence, LogOffset: conv.LogOffset})
+	if err != nil {
+		t.Error(err)
+	}
+	err = db.SetStruct("buddies", "buddies_map", map[string]map[string]bool{})
+	if err != nil {
+		t.Error(err)
+	}
+
+	// 3. Rebuilding should bring back both of them from the log
+	n, err := user_service.RebuildFromEventLog()
+	if err != nil {
+		t.Error(err)
+	}
+	if n < 1 {
+		t.Errorf("Invalid number of rebuilt conversations, expected at least %d, got %d", 1, n)
+	}
+	conv, err = u.GetConversation(buddy)
+	if err != nil {
+		t.Error(err)
+	}
+	if len(conv.Messages) != 2 || conv.Messages[1].Content != MockContent["ok_2"] {
+		t.Errorf("Conversation snapshot was not rebuilt from the log")
+	}
+	buddies, err := u.GetBuddies()
+	if err != nil {
+		t.Error(err)
+	}
+	if len(buddies) != 1 || buddies[0].UserId != buddy.UserId {
+		t.Errorf("Buddies map was not rebuilt from the log")
+	}
+}
+
+func TestRegisterUser(t *testing.T) {
+	// 1. A new user should be able to register, and the profile should be saved
+	p, err := user_service.RegisterUser("profileuser1", "Profile User", "https://example.com/avatar.png", "Available")
+	if err != nil {
+		t.Error(err)
+	}
+	if p.UserId != "profileuser1" || p.DisplayName != "Profile User" || p.TimestampCreated.IsZero() {
+		t.Errorf("Unexpected profile returned after registration: %+v", p)
+	}
+	if !user_service.IsRegistered("ProfileUser1") {
+		t.Errorf("User was not found in the registry after registration")
+	}
+
+	// 2. Registering the same user again shouldn't work
+	_, err = user_service.RegisterUser("profileuser1", "", "", "")
+	if err == nil {
+		t.Errorf("RegisterUser() allowed the same user to register twice")
+	}
+
+	// 3. An empty display name should fall back to the user id
+	p, err = user_service.RegisterUser("profileuser2", "  ", "", "")
+	if err != nil {
+		t.Error(err)
+	}
+	if p.DisplayName != "profileuser2" {
+		t.Errorf("Unexpected display name, expected %s, got %s", "profileuser2", p.DisplayName)
+	}
+
+	// 4. Once registered, the user should be able to receive messages
+	u, err := user_service.GetUser("profileuser1")
+	if err != nil {
+		t.Error(err)
+	}
+	_, err = u.SendMessage("profileuser2", MockContent["ok_1"])
+	if err != nil {
+		t.Error(err)
+	}
+}
+
+func TestUpdateProfile(t *testing.T) {
+	_, err := user_service.RegisterUser("profileuser3", "Before", "", "")
+	if err != nil {
+		t.Error(err)
+	}
+	u, err := user_service.GetRegisteredUser("profileuser3")
+	if err != nil {
+		t.Error(err)
+	}
+
+	// 1. A valid update should change the profile
+	err = u.UpdateProfile("After", "avatar_ref_1", "Busy")
+	if err != nil {
+		t.Error(err)
+	}
+	p, err := u.GetProfile()
+	if err != nil {
+		t.Error(err)
+	}
+	if p.DisplayName != "After" || p.AvatarRef != "avatar_ref_1" || p.StatusText != "Busy" {
+		t.Errorf("Profile was not updated: %+v", p)
+	}
+
+	// 2. An invalid update shouldn't work, and shouldn't change anything
+	err = u.UpdateProfile("After", "avatar_ref_1", strings.Repeat("a", 1000))
+	if err == nil {
+		t.Errorf("UpdateProfile() allowed a status text that is too long")
+	}
+	p, err = u.GetProfile()
+	if err != nil {
+		t.Error(err)
+	}
+	if p.StatusText != "Busy" {
+		t.Errorf("Profile was changed by an invalid update")
+	}
+
+	// 3. Users that haven't registered don't have a profile
+	stranger, err := user_service.GetUser("notregistereduser1")
+	if err != nil {
+		t.Error(err)
+	}
+	_, err = stranger.GetProfile()
+	if err == nil {
+		t.Errorf("GetProfile() returned a profile for a user that is not registered")
+	}
+}
+
+func TestUserIdRules(t *testing.T) {
+	// 1. User ids should be normalized with NFKC, so full-width letters become plain letters
+	u, err := user_service.GetUser("ＩｄＲｕｌｅｓＵｓｅｒ１")
+	if err != nil {
+		t.Error(err)
+	}
+	if u != nil && u.UserId != "idrulesuser1" {
+		t.Errorf("User id was not normalized, expected %s, got %s", "idrulesuser1", u.UserId)
+	}
+
+	// 2. User ids that break the charset or length rules shouldn't work
+	for _, userId := range []string{"id_rules_user", "id/rules", "ab", "-idrules", strings.Repeat("a", 33), "idrulesuѕer"} {
+		_, err = user_service.GetUser(userId)
+		if err == nil {
+			t.Errorf("GetUser() allowed the invalid user id %s", userId)
+		}
+	}
+
+	// 3. Reserved names can't be registered
+	_, err = user_service.RegisterUser("System", "", "", "")
+	if err == nil {
+		t.Errorf("RegisterUser() allowed a reserved name to be registered")
+	}
+
+	// 4. User ids that look like a registered user id can't be registered
+	_, err = user_service.RegisterUser("idrulesuser1", "", "", "")
+	if err != nil {
+		t.Error(err)
+	}
+	_, err = user_service.RegisterUser("id.ru1esuser1", "", "", "")
+	if err == nil {
+		t.Errorf("RegisterUser() allowed a user id that looks like an existing user id")
+	}
+}
+
+func TestUserIdMigrationReport(t *testing.T) {
+	// Pretend that a user with an id that doesn't follow the rules had a conversation before the rules existed
+	db := gofiledb.GetClient()
+	var buddiesMap map[string]map[string]bool
+	_, err := db.GetStructIfExists("buddies", "buddies_map", &buddiesMap)
+	if err != nil {
+		t.Error(err)
+	}
+	buddiesMap["legacy_user1"] = map[string]bool{}
+	err = db.SetStruct("buddies", "buddies_map", buddiesMap)
+	if err != nil {
+		t.Error(err)
+	}
+	err = user_service.LoadBuddiesInfoToMemory()
+	if err != nil {
+		t.Error(err)
+	}
+
+	// 1. Legacy user ids should keep working
+	u, err := user_service.GetUser("Legacy_User1")
+	if err != nil {
+		t.Error(err)
+	}
+	if u != nil && u.UserId != "legacy_user1" {
+		t.Errorf("Unexpected legacy user id, expected %s, got %s", "legacy_user1", u.UserId)
+	}
+
+	// 2. But they should be in the migration report, with a suggestion of a conforming id
+	report := user_service.GetUserIdMigrationReport()
+	if len(report) != 1 {
+		t.Fatalf("Unexpected number of user ids in the migration report, expected %d, got %d", 1, len(report))
+	}
+	if report[0].UserId != "legacy_user1" || report[0].Suggestion != "legacy-user1" {
+		t.Errorf("Unexpected migration report entry: %+v", report[0])
+	}
+}
+
+func TestPresence(t *testing.T) {
+	_, err := user_service.RegisterUser("presuser2", "", "", "")
+	if err != nil {
+		t.Error(err)
+	}
+	u, err := user_service.GetUser("presuser1")
+	if err != nil {
+		t.Error(err)
+	}
+	buddy, err := user_service.GetUser("presuser2")
+	if err != nil {
+		t.Error(err)
+	}
+	_, err = u.SendMessage(buddy.UserId, MockContent["ok_1"])
+	if err != nil {
+		t.Error(err)
+	}
+
+	// 1. A buddy that has never been seen should be offline
+	presence := buddy.GetVisiblePresence(time.Now())
+	if presence.Status != user_service.PresenceOffline || presence.LastSeen != nil {
+		t.Errorf("Unexpected presence for a user that has never been seen: %+v", presence)
+	}
+
+	// 2. A buddy that used the API recently should be away, and offline once that was long ago
+	now := time.Now()
+	err = buddy.Touch(now)
+	if err != nil {
+		t.Error(err)
+	}
+	if presence = buddy.GetVisiblePresence(now.Add(time.Minute)); presence.Status != user_service.PresenceAway {
+		t.Errorf("Unexpected presence status, expected %s, got %s", user_service.PresenceAway, presence.Status)
+	}
+	if presence = buddy.GetVisiblePresence(now.Add(time.Hour)); presence.Status != user_service.PresenceOffline || presence.LastSeen == nil {
+		t.Errorf("Unexpected presence for a user that was seen a while ago: %+v", presence)
+	}
+
+	// 3. A buddy with a real-time connection should be online, and the other buddy should be told about it
+	events, disconnect, err := u.Connect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer disconnect()
+	_, buddyDisconnect, err := buddy.Connect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	buddies, err := u.GetBuddies()
+	if err != nil {
+		t.Error(err)
+	}
+	if len(buddies) != 1 || buddies[0].Presence == nil || buddies[0].Presence.Status != user_service.PresenceOnline {
+		t.Errorf("GetBuddies() did not return the buddy as online")
+	}
+	select {
+	case e := <-events:
+		if e.Type != user_service.EventTypePresence {
+			t.Errorf("Unexpected event type, expected %s, got %s", user_service.EventTypePresence, e.Type)
+		}
+	default:
+		t.Errorf("No presence event was sent when a buddy came online")
+	}
+
+	// 4. A buddy that hides its presence should always look offline, without a last-seen time
+	err = buddy.SetPresenceHidden(true)
+	if err != nil {
+		t.Error(err)
+	}
+	if presence = buddy.GetVisiblePresence(time.Now()); presence.Status != user_service.PresenceOffline || presence.LastSeen != nil {
+		t.Errorf("Unexpected presence for a user that hides its presence: %+v", presence)
+	}
+	if presence = buddy.GetPresence(time.Now()); presence.Status != user_service.PresenceOnline {
+		t.Errorf("Hiding the presence changed the actual presence of the user")
+	}
+	buddyDisconnect()
+}
+
+func TestTyping(t *testing.T) {
+	_, err := user_service.RegisterUser("typinguser2", "", "", "")
+	if err != nil {
+		t.Error(err)
+	}
+	u, err := user_service.GetUser("typinguser1")
+	if err != nil {
+		t.Error(err)
+	}
+	buddy, err := user_service.GetUser("typinguser2")
+	if err != nil {
+		t.Error(err)
+	}
+	events, disconnect, err := buddy.Connect()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer disconnect()
+
+	// Helps get the typing indicator the buddy was sent last, if any
+	nextIndicator := func() *user_service.TypingIndicator {
+		for {
+			select {
+			case e := <-events:
+				if indicator, ok := e.Data.(user_service.TypingIndicator); ok && e.Type == user_service.EventTypeTyping {
+					return &indicator
+				}
+			default:
+				return nil
+			}
+		}
+	}
+
+	// 1. The buddy should be told when the user starts typing
+	err = u.SetTyping(buddy.UserId, true)
+	if err != nil {
+		t.Error(err)
+	}
+	indicator := nextIndicator()
+	if indicator == nil || !indicator.Typing || indicator.UserId != u.UserId || indicator.TimestampExpires == nil {
+		t.Errorf("Unexpected typing indicator sent when the user started typing: %+v", indicator)
+	}
+
+	// 2. Sending a message should stop the indicator
+	_, err = u.SendMessage(buddy.UserId, MockContent["ok_1"])
+	if err != nil {
+		t.Error(err)
+	}
+	if indicator = nextIndicator(); indicator == nil || indicator.Typing {
+		t.Errorf("Unexpected typing indicator sent when the user sent a message: %+v", indicator)
+	}
+
+	// 3. The indicator should expire on its own if the user stops signaling
+	err = u.SetTyping(buddy.UserId, true)
+	if err != nil {
+		t.Error(err)
+	}
+	nextIndicator()
+	user_service.ExpireTypingIndicators(time.Now())
+	if indicator = nextIndicator(); indicator != nil {
+		t.Errorf("Typing indicator expired too early")
+	}
+	user_service.ExpireTypingIndicators(time.Now().Add(time.Minute))
+	if indicator = nextIndicator(); indicator == nil || indicator.Typing {
+		t.Errorf("Unexpected typing indicator sent when the indicator expired: %+v", indicator)
+	}
+
+	// 4. Nobody to tell if the recipient isn't registered
+	err = u.SetTyping("notregistereduser1", true)
+	if err == nil {
+		t.Errorf("SetTyping() allowed typing to a user that is not registered")
+	}
+}
+
+func TestBlock(t *testing.T) {
+	for _, userId := range []string{"blockuser1", "blockuser2"} {
+		_, err := user_service.RegisterUser(userId, "", "", "")
+		if err != nil {
+			t.Error(err)
+		}
+	}
+	u, err := user_service.GetUser("blockuser1")
+	if err != nil {
+		t.Error(err)
+	}
+	buddy, err := user_service.GetUser("blockuser2")
+	if err != nil {
+		t.Error(err)
+	}
+	_, err = u.SendMessage(buddy.UserId, MockContent["ok_1"])
+	if err != nil {
+		t.Error(err)
+	}
+
+	// 1. Once blocked, the blocked user shouldn't be able to send messages to the blocker, nor the other way around
+	err = u.Block(buddy.UserId)
+	if err != nil {
+		t.Error(err)
+	}
+	_, err = buddy.SendMessage(u.UserId, MockContent["ok_2"])
+	if err == nil {
+		t.Errorf("SendMessage() allowed a blocked user to send a message to the blocker")
+	}
+	_, err = u.SendMessage(buddy.UserId, MockContent["ok_2"])
+	if err == nil {
+		t.Errorf("SendMessage() allowed a user to send a message to a user they blocked")
+	}
+	if blocked := u.GetBlockedUserIds(); len(blocked) != 1 || blocked[0] != buddy.UserId {
+		t.Errorf("Unexpected blocked users, expected [%s], got %v", buddy.UserId, blocked)
+	}
+
+	// 2. The blocker shouldn't see the conversation anymore, but the blocked user should
+	convs, err := u.GetConversations()
+	if err != nil {
+		t.Error(err)
+	}
+	if len(convs) != 0 {
+		t.Errorf("The conversation with a blocked user was returned to the blocker")
+	}
+	convs, err = buddy.GetConversations()
+	if err != nil {
+		t.Error(err)
+	}
+	if len(convs) != 1 {
+		t.Errorf("Unexpected number of conversations for the blocked user, expected %d, got %d", 1, len(convs))
+	}
+
+	// 3. Once unblocked, everything should be back
+	err = u.Unblock(buddy.UserId)
+	if err != nil {
+		t.Error(err)
+	}
+	_, err = buddy.SendMessage(u.UserId, MockContent["ok_2"])
+	if err != nil {
+		t.Error(err)
+	}
+	convs, err = u.GetConversations()
+	if err != nil {
+		t.Error(err)
+	}
+	if len(convs) != 1 || len(convs[0].Messages) != 2 {
+		t.Errorf("The conversation was not back after unblocking the user")
+	}
+
+	// 4. Unblocking a user that isn't blocked, or blocking oneself, shouldn't work
+	err = u.Unblock(buddy.UserId)
+	if err == nil {
+		t.Errorf("Unblock() allowed unblocking a user that is not blocked")
+	}
+	err = u.Block(u.UserId)
+	if err == nil {
+		t.Errorf("Block() allowed a user to block themselves")
+	}
+}
+
+func TestContactRequests(t *testing.T) {
+	// Turn on contact requests for this test only
+	config.GetConfig().RequireContactRequests = true
+	defer func() {
+		config.GetConfig().RequireContactRequests = false
+	}()
+	for _, userId := range []string{"contactuser1", "contactuser2", "contactuser3"} {
+		_, err := user_service.RegisterUser(userId, "", "", "")
+		if err != nil {
+			t.Error(err)
+		}
+	}
+	u, err := user_service.GetUser("contactuser1")
+	if err != nil {
+		t.Error(err)
+	}
+	buddy, err := user_service.GetUser("contactuser2")
+	if err != nil {
+		t.Error(err)
+	}
+
+	// 1. Messaging a user who isn't a buddy should hold the message in a contact request
+	mId, err := u.SendMessage(buddy.UserId, MockContent["ok_1"])
+	if err != nil {
+		t.Error(err)
+	}
+	if mId != user_service.HeldMessageId {
+		t.Errorf("Unexpected message id for a held message, expected %d, got %d", user_service.HeldMessageId, mId)
+	}
+	_, err = u.SendMessage(buddy.UserId, MockContent["ok_2"])
+	if err != nil {
+		t.Error(err)
+	}
+	requests := buddy.GetContactRequests()
+	if len(requests) != 1 || requests[0].From != u.UserId || len(requests[0].HeldMessages) != 2 {
+		t.Errorf("Unexpected contact requests for the recipient: %+v", requests)
+	}
+	conv, err := u.GetConversation(buddy)
+	if err != nil {
+		t.Error(err)
+	}
+	if len(conv.Messages) != 0 {
+		t.Errorf("Held messages were delivered before the contact request was accepted")
+	}
+
+	// 2. Accepting the request should deliver the held messages, and make them buddies
+	err = buddy.AcceptContactRequest(u.UserId)
+	if err != nil {
+		t.Error(err)
+	}
+	conv, err = u.GetConversation(buddy)
+	if err != nil {
+		t.Error(err)
+	}
+	if len(conv.Messages) != 2 || conv.Messages[0].Content != MockContent["ok_1"] {
+		t.Errorf("Held messages were not delivered when the contact request was accepted")
+	}
+	mId, err = u.SendMessage(buddy.UserId, MockContent["ok_3"])
+	if err != nil {
+		t.Error(err)
+	}
+	if mId != 3 {
+		t.Errorf("Unexpected message id once the users are buddies, expected %d, got %d", 3, mId)
+	}
+
+	// 3. Rejecting a request should throw the held messages away
+	stranger, err := user_service.GetUser("contactuser3")
+	if err != nil {
+		t.Error(err)
+	}
+	_, err = stranger.SendMessage(u.UserId, MockContent["ok_1"])
+	if err != nil {
+		t.Error(err)
+	}
+	err = u.RejectContactRequest(stranger.UserId)
+	if err != nil {
+		t.Error(err)
+	}
+	if requests = u.GetContactRequests(); len(requests) != 0 {
+		t.Errorf("Contact request was not removed when it was rejected")
+	}
+	err = u.RejectContactRequest(stranger.UserId)
+	if err == nil {
+		t.Errorf("RejectContactRequest() allowed rejecting a contact request that doesn't exist")
+	}
+
+	// 4. Messaging back a user who sent a contact request should accept it
+	_, err = stranger.SendMessage(u.UserId, MockContent["ok_1"])
+	if err != nil {
+		t.Error(err)
+	}
+	mId, err = u.SendMessage(stranger.UserId, MockContent["ok_2"])
+	if err != nil {
+		t.Error(err)
+	}
+	if mId != 2 {
+		t.Errorf("Unexpected message id when messaging back, expected %d, got %d", 2, mId)
+	}
+}
+
+func TestDeleteAccount(t *testing.T) {
+	for _, userId := range []string{"deleteuser1", "deleteuser2"} {
+		_, err := user_service.RegisterUser(userId, "", "", "")
+		if err != nil {
+			t.Error(err)
+		}
+	}
+	u, err := user_service.GetUser("deleteuser1")
+	if err != nil {
+		t.Error(err)
+	}
+	buddy, err := user_service.GetUser("deleteuser2")
+	if err != nil {
+		t.Error(err)
+	}
+	stranger, err := user_service.GetUser("deleteuser3")
+	if err != nil {
+		t.Error(err)
+	}
+	_, err = u.SendMessage(buddy.UserId, MockContent["ok_1"])
+	if err != nil {
+		t.Error(err)
+	}
+	_, err = buddy.SendMessage(u.UserId, MockContent["ok_2"])
+	if err != nil {
+		t.Error(err)
+	}
+	// deleteuser3 never registered, but users don't have to register to send messages
+	_, err = stranger.SendMessage(u.UserId, MockContent["ok_3"])
+	if err != nil {
+		t.Error(err)
+	}
+
+	// 1. The export should have everything the user sent
+	export, err := u.ExportData()
+	if err != nil {
+		t.Error(err)
+	}
+	if len(export.Conversations) != 2 || len(export.AuthoredMessages) != 1 || export.Profile == nil {
+		t.Errorf("Unexpected data export: %d conversations, %d authored messages", len(export.Conversations), len(export.AuthoredMessages))
+	}
+
+	// 2. Once deleted, the messages of the user should be anonymized in the conversations someone else is still in
+	err = u.DeleteAccount()
+	if err != nil {
+		t.Error(err)
+	}
+	conv, err := conversation_service.GetConversationByUserIds([]string{"deleteuser1", "deleteuser2"})
+	if err != nil {
+		t.Error(err)
+	}
+	if len(conv.Messages) != 2 || conv.Messages[0].From != conversation_service.DeletedUserId || conv.Messages[1].From != buddy.UserId {
+		t.Errorf("Messages of the deleted user were not anonymized")
+	}
+	b, err := ioutil.ReadFile(filepath.Join(config.GetConfig().StorageRoot(), "conversation_log", conv.UniqueKey()+".log"))
+	if err != nil {
+		t.Error(err)
+	}
+	if strings.Contains(string(b), `"From":"deleteuser1"`) {
+		t.Errorf("Messages of the deleted user were not anonymized in the message log")
+	}
+
+	// 3. The conversations with users who never registered should be kept too
+	conv, err = conversation_service.GetConversationByUserIds([]string{"deleteuser1", "deleteuser3"})
+	if err != nil {
+		t.Error(err)
+	}
+	if len(conv.Messages) != 1 || conv.Messages[0].From != stranger.UserId {
+		t.Errorf("Conversation with a user who never registered was erased")
+	}
+
+	// 4. The user should be gone from the buddies, and its user id can't be used again
+	buddies, err := buddy.GetBuddies()
+	if err != nil {
+		t.Error(err)
+	}
+	if len(buddies) != 0 {
+		t.Errorf("Deleted user was not removed from the buddies map")
+	}
+	_, err = user_service.GetUser("deleteuser1")
+	if err == nil {
+		t.Errorf("GetUser() allowed the user id of a deleted account")
+	}
+	_, err = user_service.RegisterUser("deleteuser1", "", "", "")
+	if err == nil {
+		t.Errorf("RegisterUser() allowed the user id of a deleted account to be registered again")
+	}
+
+	// 5. Once the other user deletes their account too, nobody is left in the conversation, so it should be erased
+	err = buddy.DeleteAccount()
+	if err != nil {
+		t.Error(err)
+	}
+	conv, err = conversation_service.GetConversationByUserIds([]string{"deleteuser1", "deleteuser2"})
+	if err != nil {
+		t.Error(err)
+	}
+	if len(conv.Messages) != 0 {
+		t.Errorf("Conversation that nobody else is in was not erased")
+	}
+}
+
+func TestRename(t *testing.T) {
+	for _, userId := range []string{"renameuser1", "renameuser2", "renameuser3"} {
+		_, err := user_service.RegisterUser(userId, "", "", "")
+		if err != nil {
+			t.Error(err)
+		}
+	}
+	u, err := user_service.GetUser("renameuser1")
+	if err != nil {
+		t.Error(err)
+	}
+	buddy, err := user_service.GetUser("renameuser2")
+	if err != nil {
+		t.Error(err)
+	}
+	other, err := user_service.GetUser("renameuser3")
+	if err != nil {
+		t.Error(err)
+	}
+	_, err = u.SendMessage(buddy.UserId, MockContent["ok_1"])
+	if err != nil {
+		t.Error(err)
+	}
+	_, err = buddy.SendMessage(u.UserId, MockContent["ok_2"])
+	if err != nil {
+		t.Error(err)
+	}
+	err = other.Block(u.UserId)
+	if err != nil {
+		t.Error(err)
+	}
+
+	// 1. A user can't take a user id that's already taken
+	_, err = u.Rename("renameuser2")
+	if err == nil {
+		t.Errorf("Rename() allowed a user id that's already taken")
+	}
+
+	// 2. Once renamed, the messages of the user should be attributed to its new user id, both in the conversation and in the message log
+	renamed, err := u.Rename("renamed-user1")
+	if err != nil {
+		t.Error(err)
+	}
+	conv, err := renamed.GetConversation(buddy)
+	if err != nil {
+		t.Error(err)
+	}
+	if len(conv.Messages) != 2 || conv.Messages[0].From != "renamed-user1" || conv.Messages[1].From != buddy.UserId {
+		t.Errorf("Messages of the renamed user were not attributed to its new user id")
+	}
+	b, err := ioutil.ReadFile(filepath.Join(config.GetConfig().StorageRoot(), "conversation_log", conv.UniqueKey()+".log"))
+	if err != nil {
+		t.Error(err)
+	}
+	if strings.Contains(string(b), `"From":"renameuser1"`) || !strings.Contains(string(b), `"From":"renamed-user1"`) {
+		t.Errorf("Messages of the renamed user were not attributed to its new user id in the message log")
+	}
+	_, err = renamed.SendMessage(buddy.UserId, MockContent["ok_3"])
+	if err != nil {
+		t.Error(err)
+	}
+
+	// 3. The original conversation should be erased
+	conv, err = conversation_service.GetConversationByUserIds([]string{"renameuser1", "renameuser2"})
+	if err != nil {
+		t.Error(err)
+	}
+	if len(conv.Messages) != 0 {
+		t.Errorf("Original conversation of the renamed user was not erased")
+	}
+
+	// 4. The buddies and the blocks should know the new user id, and the old one can't be used anymore
+	buddies, err := buddy.GetBuddies()
+	if err != nil {
+		t.Error(err)
+	}
+	if len(buddies) != 1 || buddies[0].UserId != "renamed-user1" {
+		t.Errorf("Renamed user was not renamed in the buddies map")
+	}
+	if !other.HasBlocked(renamed) {
+		t.Errorf("Renamed user was not renamed in the blocks")
+	}
+	_, err = user_service.GetUser("renameuser1")
+	if err == nil {
+		t.Errorf("GetUser() allowed the old user id of a renamed user")
+	}
+	history := user_service.GetRenameHistory()
+	if len(history) == 0 || !history[len(history)-1].Completed {
+		t.Errorf("Rename was not recorded as completed in the rename history")
+	}
+}
+
+func TestInbox(t *testing.T) {
+	for _, userId := range []string{"inboxuser1", "inboxuser2", "inboxuser3"} {
+		_, err := user_service.RegisterUser(userId, "", "", "")
+		if err != nil {
+			t.Error(err)
+		}
+	}
+	u, err := user_service.GetUser("inboxuser1")
+	if err != nil {
+		t.Error(err)
+	}
+	buddy, err := user_service.GetUser("inboxuser2")
+	if err != nil {
+		t.Error(err)
+	}
+	other, err := user_service.GetUser("inboxuser3")
+	if err != nil {
+		t.Error(err)
+	}
+	_, err = buddy.SendMessage(u.UserId, MockContent["ok_1"])
+	if err != nil {
+		t.Error(err)
+	}
+	_, err = buddy.SendMessage(u.UserId, MockContent["ok_2"])
+	if err != nil {
+		t.Error(err)
+	}
+	_, err = other.SendMessage(u.UserId, strings.Repeat("long message\n", 20))
+	if err != nil {
+		t.Error(err)
+	}
+
+	// 1. The most recently active conversation should come first, with a preview of its last message and its unread count
+	inbox := u.GetInbox()
+	if len(inbox) != 2 {
+		t.Fatalf("Expected 2 conversations in the inbox, got %d", len(inbox))
+	}
+	if inbox[0].LastMessage == nil || inbox[0].LastMessage.From != other.UserId || inbox[0].UnreadCount != 1 {
+		t.Errorf("Unexpected first inbox entry: %+v", inbox[0])
+	}
+	if len([]rune(inbox[0].LastMessage.Preview)) != 100 || strings.Contains(inbox[0].LastMessage.Preview, "\n") {
+		t.Errorf("Preview of a long message was not shortened to a single line: %q", inbox[0].LastMessage.Preview)
+	}
+	if inbox[1].LastMessage == nil || inbox[1].LastMessage.Preview != MockContent["ok_2"] || inbox[1].UnreadCount != 2 {
+		t.Errorf("Unexpected second inbox entry: %+v", inbox[1])
+	}
+
+	// 2. Reading messages, or replying, should bring down the unread count
+	err = u.MarkRead(buddy.UserId, 1)
+	if err != nil {
+		t.Error(err)
+	}
+	if inbox = u.GetInbox(); inbox[1].UnreadCount != 1 {
+		t.Errorf("Expected 1 unread message after reading the first one, got %d", inbox[1].UnreadCount)
+	}
+	_, err = u.SendMessage(buddy.UserId, MockContent["ok_3"])
+	if err != nil {
+		t.Error(err)
+	}
+	inbox = u.GetInbox()
+	if inbox[0].LastMessage.From != u.UserId || inbox[0].UnreadCount != 0 {
+		t.Errorf("Replying did not move the conversation to the top and mark it as read: %+v", inbox[0])
+	}
+	if buddyInbox := buddy.GetInbox(); len(buddyInbox) != 1 || buddyInbox[0].UnreadCount != 1 {
+		t.Errorf("Unexpected inbox of the recipient: %+v", buddyInbox)
+	}
+
+	// 3. Conversations with blocked users should be hidden
+	err = u.Block(other.UserId)
+	if err != nil {
+		t.Error(err)
+	}
+	if inbox = u.GetInbox(); len(inbox) != 1 {
+		t.Errorf("Conversation with a blocked user was not hidden from the inbox")
+	}
+
+	// 4. Every inbox should be saved in its own record, and loaded back from it
+	var entries map[string]*conversation_service.InboxEntry
+	exists, err := gofiledb.GetClient().GetStructIfExists("inbox", "inbox_"+buddy.UserId, &entries)
+	if err != nil {
+		t.Error(err)
+	}
+	if !exists || len(entries) != 1 {
+		t.Errorf("Inbox of the recipient was not saved in its own record")
+	}
+	err = user_service.LoadInboxToMemory()
+	if err != nil {
+		t.Error(err)
+	}
+	if buddyInbox := buddy.GetInbox(); len(buddyInbox) != 1 || buddyInbox[0].UnreadCount != 1 {
+		t.Errorf("Inbox of the recipient was not loaded back: %+v", buddyInbox)
+	}
+
+	// 5. Editing the last message should update its preview, and deleting it should bring back the one before it, and bring down the unread count
+	err = u.EditMessage(buddy.UserId, 3, "Hello again")
+	if err != nil {
+		t.Error(err)
+	}
+	if buddyInbox := buddy.GetInbox(); buddyInbox[0].LastMessage.Preview != "Hello again" {
+		t.Errorf("Editing the last message did not update its preview: %+v", buddyInbox[0].LastMessage)
+	}
+	err = u.DeleteMessage(buddy.UserId, 3)
+	if err != nil {
+		t.Error(err)
+	}
+	if buddyInbox := buddy.GetInbox(); buddyInbox[0].LastMessage.Id != 2 || buddyInbox[0].UnreadCount != 0 {
+		t.Errorf("Deleting the last message did not update the inbox of the recipient: %+v", buddyInbox[0])
+	}
+}
+
+func TestConversationSettings(t *testing.T) {
+	for _, userId := range []string{"settingsuser1", "settingsuser2", "settingsuser3", "settingsuser4"} {
+		_, err := user_service.RegisterUser(userId, "", "", "")
+		if err != nil {
+			t.Error(err)
+		}
+	}
+	u, err := user_service.GetUser("settingsuser1")
+	if err != nil {
+		t.Error(err)
+	}
+	for _, buddyId := range []string{"settingsuser2", "settingsuser3", "settingsuser4"} {
+		_, err = u.SendMessage(buddyId, MockContent["ok_1"])
+		if err != nil {
+			t.Error(err)
+		}
+	}
+
+	// 1. Archived conversations should only be listed separately, and pinned ones should come first
+	err = u.ArchiveConversation("settingsuser2", true)
+	if err != nil {
+		t.Error(err)
+	}
+	err = u.PinConversation("settingsuser3", true)
+	if err != nil {
+		t.Error(err)
+	}
+	convs, err := u.GetConversations()
+	if err != nil {
+		t.Error(err)
+	}
+	if len(convs) != 2 || convs[0].UniqueKey() != "conversation_settingsuser1_settingsuser3" || !convs[0].Settings.Pinned {
+		t.Errorf("Expected the pinned conversation first, and the archived one left out")
+	}
+	archived, err := u.GetArchivedConversations()
+	if err != nil {
+		t.Error(err)
+	}
+	if len(archived) != 1 || archived[0].UniqueKey() != "conversation_settingsuser1_settingsuser2" {
+		t.Errorf("Expected only the archived conversation in the archived conversations")
+	}
+	inbox := u.GetInbox()
+	if len(inbox) != 2 || !inbox[0].Settings.Pinned || len(u.GetArchivedInbox()) != 1 {
+		t.Errorf("Settings were not applied to the inbox")
+	}
+
+	// 2. A mute should only last until the provided time
+	err = u.MuteConversation("settingsuser4", time.Now().Add(time.Hour))
+	if err != nil {
+		t.Error(err)
+	}
+	settings, err := u.GetConversationSettings("settingsuser4")
+	if err != nil {
+		t.Error(err)
+	}
+	if !settings.IsMuted(time.Now()) || settings.IsMuted(time.Now().Add(2*time.Hour)) {
+		t.Errorf("Conversation was not muted for an hour")
+	}
+	err = u.MuteConversation("settingsuser4", time.Time{})
+	if err != nil {
+		t.Error(err)
+	}
+	if settings, _ = u.GetConversationSettings("settingsuser4"); settings.MutedUntil != nil {
+		t.Errorf("Conversation was not unmuted")
+	}
+
+	// 3. The settings are only for the user who set them
+	buddy, err := user_service.GetUser("settingsuser2")
+	if err != nil {
+		t.Error(err)
+	}
+	if convs, _ = buddy.GetConversations(); len(convs) != 1 || convs[0].Settings.Archived {
+		t.Errorf("Archiving a conversation affected the other member")
+	}
+
+	// 4. Several settings can be changed at once, and the ones that aren't provided stay as they were
+	mutedUntil, pinned := time.Now().Add(time.Hour), true
+	err = u.UpdateConversationSettings("settingsuser2", &mutedUntil, nil, &pinned)
+	if err != nil {
+		t.Error(err)
+	}
+	if settings, _ = u.GetConversationSettings("settingsuser2"); !settings.IsMuted(time.Now()) || !settings.Pinned || !settings.Archived {
+		t.Errorf("Unexpected settings after changing several at once: %+v", settings)
+	}
+	if err = u.UpdateConversationSettings("settingsuser2", nil, nil, nil); err == nil {
+		t.Errorf("UpdateConversationSettings() allowed a change without any settings")
+	}
+}
+
+func TestForwardMessage(t *testing.T) {
+	for _, userId := range []string{"fwduser1", "fwduser2", "fwduser3", "fwduser4"} {
+		_, err := user_service.RegisterUser(userId, "", "", "")
+		if err != nil {
+			t.Error(err)
+		}
+	}
+	u, err := user_service.GetUser("fwduser1")
+	if err != nil {
+		t.Error(err)
+	}
+	source, err := user_service.GetUser("fwduser2")
+	if err != nil {
+		t.Error(err)
+	}
+	buddy, err := user_service.GetUser("fwduser3")
+	if err != nil {
+		t.Error(err)
+	}
+	_, err = source.SendMessage(u.UserId, MockContent["ok_1"])
+	if err != nil {
+		t.Error(err)
+	}
+	_, err = u.SendMessage(buddy.UserId, MockContent["ok_2"])
+	if err != nil {
+		t.Error(err)
+	}
+
+	// 1. Forwarding should only work for messages the user can see, into its other conversations
+	if _, err = u.ForwardMessage(source.UserId, 99, buddy.UserId); err == nil {
+		t.Errorf("ForwardMessage() allowed a message that doesn't exist to be forwarded")
+	}
+	if _, err = u.ForwardMessage(source.UserId, 1, "fwduser4"); err == nil {
+		t.Errorf("ForwardMessage() allowed a message to be forwarded into a conversation the user isn't a part of")
+	}
+	if _, err = buddy.ForwardMessage(source.UserId, 1, u.UserId); err == nil {
+		t.Errorf("ForwardMessage() allowed a message to be forwarded from a conversation the user isn't a part of")
+	}
+
+	// 2. The forwarded message should point to the original sender and conversation, even when forwarded again
+	messageId, err := u.ForwardMessage(source.UserId, 1, buddy.UserId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conv, err := u.GetConversation(buddy)
+	if err != nil {
+		t.Error(err)
+	}
+	forwarded := conv.Messages[len(conv.Messages)-1]
+	if forwarded.Id != messageId || forwarded.From != u.UserId || forwarded.Content != MockContent["ok_1"] || forwarded.ForwardedFrom == nil ||
+		forwarded.ForwardedFrom.From != source.UserId || forwarded.ForwardedFrom.ConversationKey != "conversation_fwduser1_fwduser2" || forwarded.ForwardedFrom.MessageId != 1 ||
+		len(forwarded.ForwardedFrom.UserIds) != 2 {
+		t.Errorf("Unexpected forwarded message: %+v", forwarded)
+	}
+	if err = u.EditMessage(buddy.UserId, messageId, "changed"); err == nil {
+		t.Errorf("EditMessage() allowed a forwarded message to be edited")
+	}
+	_, err = buddy.SendMessage("fwduser4", MockContent["ok_3"])
+	if err != nil {
+		t.Error(err)
+	}
+	_, err = buddy.ForwardMessage(u.UserId, messageId, "fwduser4")
+	if err != nil {
+		t.Error(err)
+	}
+	conv, err = conversation_service.GetConversationByUserIds([]string{"fwduser3", "fwduser4"})
+	if err != nil {
+		t.Error(err)
+	}
+	if reference := conv.Messages[len(conv.Messages)-1].ForwardedFrom; reference == nil || reference.From != source.UserId || reference.MessageId != 1 {
+		t.Errorf("Message forwarded again does not point to where it was first sent")
+	}
+
+	// 3. Once the original sender deletes their account, the forwarded message shouldn't point to them anymore
+	err = source.DeleteAccount()
+	if err != nil {
+		t.Error(err)
+	}
+	conv, err = u.GetConversation(buddy)
+	if err != nil {
+		t.Error(err)
+	}
+	forwarded = conv.Messages[len(conv.Messages)-1]
+	if forwarded.ForwardedFrom.From != conversation_service.DeletedUserId || forwarded.ForwardedFrom.ConversationKey != "" || forwarded.ForwardedFrom.UserIds != nil {
+		t.Errorf("Forwarded message still points to the deleted user: %+v", forwarded.ForwardedFrom)
+	}
+
+	// 4. The same goes for the other members of the original conversation, even if they didn't send the message
+	_, err = buddy.ForwardMessage("fwduser4", 1, u.UserId)
+	if err != nil {
+		t.Error(err)
+	}
+	last, err := user_service.GetUser("fwduser4")
+	if err != nil {
+		t.Error(err)
+	}
+	err = last.DeleteAccount()
+	if err != nil {
+		t.Error(err)
+	}
+	conv, err = u.GetConversation(buddy)
+	if err != nil {
+		t.Error(err)
+	}
+	forwarded = conv.Messages[len(conv.Messages)-1]
+	if forwarded.ForwardedFrom.From != buddy.UserId || forwarded.ForwardedFrom.ConversationKey != "" || forwarded.ForwardedFrom.UserIds != nil {
+		t.Errorf("Forwarded message still points to the conversation of the deleted user: %+v", forwarded.ForwardedFrom)
+	}
+}
+
+func TestChannels(t *testing.T) {
+	owner, err := user_service.GetUser("chanuser1")
+	if err != nil {
+		t.Error(err)
+	}
+	member, err := user_service.GetUser("chanuser2")
+	if err != nil {
+		t.Error(err)
+	}
+	outsider, err := user_service.GetUser("chanuser3")
+	if err != nil {
+		t.Error(err)
+	}
+
+	// 1. Channels should have unique, valid names, and be found by their name or topic
+	err = owner.CreateChannel(" #Gophers ", "All things Go", false)
+	if err != nil {
+		t.Error(err)
+	}
+	if err = member.CreateChannel("gophers", "", false); err == nil {
+		t.Errorf("CreateChannel() allowed two channels with the same name")
+	}
+	if err = owner.CreateChannel("not a name", "", false); err == nil {
+		t.Errorf("CreateChannel() allowed an invalid name")
+	}
+	channels := conversation_service.SearchChannels("GOPHER")
+	if len(channels) != 1 || channels[0].Name != "gophers" || channels[0].MemberCount != 1 {
+		t.Fatalf("Unexpected channels when searching by name: %+v", channels)
+	}
+	if channels = conversation_service.SearchChannels("things go"); len(channels) != 1 {
+		t.Errorf("Expected to find the channel by its topic, got %+v", channels)
+	}
+
+	// 2. Anybody should be able to join, but only members should be able to send messages
+	err = member.JoinChannel("gophers")
+	if err != nil {
+		t.Error(err)
+	}
+	if err = member.JoinChannel("gophers"); err == nil {
+		t.Errorf("JoinChannel() allowed a member to join twice")
+	}
+	if _, err = outsider.SendChannelMessage("gophers", MockContent["ok_1"], ""); err == nil {
+		t.Errorf("SendChannelMessage() allowed a user who isn't a member to send a message")
+	}
+	_, err = member.SendChannelMessage("gophers", MockContent["ok_1"], "")
+	if err != nil {
+		t.Error(err)
+	}
+	if channels = conversation_service.SearchChannels("gophers"); channels[0].MemberCount != 2 {
+		t.Errorf("Expected 2 members, got %d", channels[0].MemberCount)
+	}
+	// The system message about the member joining doesn't count as unread
+	inbox := owner.GetInbox()
+	if len(inbox) != 1 || inbox[0].ChannelName != "gophers" || inbox[0].UnreadCount != 1 {
+		t.Errorf("Unexpected inbox of the owner: %+v", inbox)
+	}
+
+	// 3. Only the owner and admins should be able to change the topic
+	if err = member.SetChannelTopic("gophers", "Something else"); err == nil {
+		t.Errorf("SetChannelTopic() allowed a member who isn't an admin to change the topic")
+	}
+	err = owner.SetChannelTopic("gophers", "Go, and nothing else")
+	if err != nil {
+		t.Error(err)
+	}
+
+	// 4. When the owner leaves, the ownership should pass on, and the channel should leave their inbox
+	err = owner.LeaveChannel("gophers")
+	if err != nil {
+		t.Error(err)
+	}
+	if inbox = owner.GetInbox(); len(inbox) != 0 {
+		t.Errorf("Channel stayed in the inbox of a user who left it: %+v", inbox)
+	}
+	conversation_service.PurgeCache()
+	channel, err := member.GetChannel("gophers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	roles := channel.GetRoles()
+	if len(channel.UserIds) != 1 || roles[member.UserId] != conversation_service.RoleOwner || channel.Topic != "Go, and nothing else" {
+		t.Errorf("Unexpected channel after replaying the log: %+v, roles %+v", channel.UserIds, roles)
+	}
+	last := channel.Messages[len(channel.Messages)-1]
+	if !last.System || last.From != owner.UserId || last.Content != "left the channel" {
+		t.Errorf("Unexpected system message: %+v", last)
+	}
+
+	// 5. Users joining through two copies of the channel loaded at the same time should both become members
+	first, err := conversation_service.GetChannel("gophers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	second, err := conversation_service.GetChannel("gophers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = first.Join(owner.UserId)
+	if err != nil {
+		t.Error(err)
+	}
+	err = second.Join(outsider.UserId)
+	if err != nil {
+		t.Error(err)
+	}
+	if channel, err = conversation_service.GetChannel("gophers"); err != nil || len(channel.UserIds) != 3 {
+		t.Errorf("Members were lost when joining through two copies of the channel: %+v", channel.UserIds)
+	}
+}
+
+func TestInvites(t *testing.T) {
+	owner, err := user_service.GetUser("inviteuser1")
+	if err != nil {
+		t.Error(err)
+	}
+	invitee, err := user_service.GetUser("inviteuser2")
+	if err != nil {
+		t.Error(err)
+	}
+	latecomer, err := user_service.GetUser("inviteuser3")
+	if err != nil {
+		t.Error(err)
+	}
+
+	// 1. Private channels shouldn't be listed, and shouldn't be joined or read without an invite
+	err = owner.CreateChannel("secret-club", "", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if channels := conversation_service.SearchChannels("secret"); len(channels) != 0 {
+		t.Errorf("Private channel was listed: %+v", channels)
+	}
+	if err = invitee.JoinChannel("secret-club"); err == nil {
+		t.Errorf("JoinChannel() allowed a user to join a private channel without an invite")
+	}
+	if _, err = invitee.GetChannel("secret-club"); err == nil {
+		t.Errorf("GetChannel() served a private channel to a user who isn't a member")
+	}
+
+	// 2. Only the owner and admins should be able to create invites, and they should be valid
+	if _, err = invitee.CreateInvite("secret-club", nil, 0); err == nil {
+		t.Errorf("CreateInvite() allowed a user who isn't a member to create an invite")
+	}
+	past := time.Now().Add(-time.Minute)
+	if _, err = owner.CreateInvite("secret-club", &past, 0); err == nil {
+		t.Errorf("CreateInvite() allowed an invite that has already expired")
+	}
+	invite, err := owner.CreateInvite("secret-club", nil, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// 3. An invite should stop working once it's used up, but not by users who couldn't join with it
+	if err = owner.JoinWithInvite(invite.Token); err == nil {
+		t.Errorf("JoinWithInvite() allowed a member to join again")
+	}
+	err = invitee.JoinWithInvite(invite.Token)
+	if err != nil {
+		t.Error(err)
+	}
+	if _, err = invitee.GetChannel("secret-club"); err != nil {
+		t.Error(err)
+	}
+	if err = latecomer.JoinWithInvite(invite.Token); err == nil {
+		t.Errorf("JoinWithInvite() allowed more users to join than the invite allows")
+	}
+	invites, err := owner.GetInvites("secret-club")
+	if err != nil {
+		t.Error(err)
+	}
+	if len(invites) != 1 || invites[0].Uses != 1 {
+		t.Errorf("Unexpected invites: %+v", invites)
+	}
+
+	// 4. An invite should stop working once it expires
+	soon := time.Now().Add(50 * time.Millisecond)
+	expiring, err := owner.CreateInvite("secret-club", &soon, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	time.Sleep(100 * time.Millisecond)
+	if err = latecomer.JoinWithInvite(expiring.Token); err == nil {
+		t.Errorf("JoinWithInvite() allowed a user to join with an expired invite")
+	}
+
+	// 5. A revoked invite should stop working, and be gone
+	revoked, err := owner.CreateInvite("secret-club", nil, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = owner.RevokeInvite("secret-club", revoked.Token)
+	if err != nil {
+		t.Error(err)
+	}
+	if err = latecomer.JoinWithInvite(revoked.Token); err == nil {
+		t.Errorf("JoinWithInvite() allowed a user to join with a revoked invite")
+	}
+	if invites, _ = owner.GetInvites("secret-club"); len(invites) != 2 {
+		t.Errorf("Expected 2 invites left, got %d", len(invites))
 	}
 }